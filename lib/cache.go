@@ -1,6 +1,12 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
 	"github.com/boltdb/bolt"
 )
 
@@ -8,32 +14,179 @@ type Cache interface {
 	Set(ns, k string, v []byte)
 	Get(ns, k string) ([]byte, bool)
 	Del(ns, k string)
+	// SetMany sets each of ks to v in one transaction.
+	SetMany(ns string, ks []string, v []byte)
+	// DelNs deletes everything in ns.
+	DelNs(ns string)
 	Items(ns string, ks chan<- string)
 	Close()
 }
 
+// Most writes committed in one transaction.
+const maxWriteBatch = 256
+
+// How long to wait for another process to release a cache file.
+const lockTimeout = time.Second
+
+// ErrLocked is returned when opening a cache that another process, such as
+// another run on the same directory, has open.
+var ErrLocked = errors.New("cache is locked by another process")
+
 type BoltCache struct {
 	Cache
 	db *bolt.DB
+	// Writes queued for the writer goroutine, and closed when it exits. Nil
+	// for read-only caches.
+	writes  chan cacheWrite
+	stopped chan struct{}
+	// Makes Close idempotent.
+	closed *sync.Once
 }
 
-func NewBoltCache(path string) (BoltCache, error) {
-	db, err := bolt.Open(path, 0666, nil)
-	return BoltCache{db: db}, err
+// cacheWrite is a Set of ks, or with del a Del, or with drop a DelNs, queued
+// for the writer goroutine.
+type cacheWrite struct {
+	ns   string
+	ks   []string
+	v    []byte
+	del  bool
+	drop bool
+	done chan error
 }
 
-func (c BoltCache) Set(ns, k string, v []byte) {
-	if err := c.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte(ns))
-		if err != nil {
+func (w cacheWrite) apply(tx *bolt.Tx) error {
+	if w.drop {
+		if err := tx.DeleteBucket([]byte(w.ns)); err != nil && err != bolt.ErrBucketNotFound {
 			return err
 		}
-		return b.Put([]byte(k), v)
-	}); err != nil {
+		return nil
+	}
+	if w.del {
+		if b := tx.Bucket([]byte(w.ns)); b != nil {
+			return b.Delete([]byte(w.ks[0]))
+		}
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(w.ns))
+	if err != nil {
+		return err
+	}
+	for _, k := range w.ks {
+		if err := b.Put([]byte(k), w.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewBoltCache(path string) (BoltCache, error) {
+	db, err := openBolt(path, &bolt.Options{})
+	if err != nil {
+		return BoltCache{db: db}, err
+	}
+	c := BoltCache{db: db, writes: make(chan cacheWrite), stopped: make(chan struct{}), closed: new(sync.Once)}
+	go c.writer()
+	return c, nil
+}
+
+// IsCorrupt reports whether err, from opening a BoltCache, means the file is
+// damaged, as by a power loss mid-write.
+func IsCorrupt(err error) bool {
+	// Bolt only checks the meta pages on open.
+	return errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum)
+}
+
+// RecoverBoltCache is like NewBoltCache, but if the file at path is corrupt,
+// it's moved aside to path + ".corrupt" and an empty cache is created in its
+// place. The bool reports whether that happened. Bolt keeps two copies of its
+// meta page and already falls back to the second if the first is damaged, so
+// this is only for files it can't open at all.
+func RecoverBoltCache(path string) (BoltCache, bool, error) {
+	c, err := NewBoltCache(path)
+	if !IsCorrupt(err) {
+		return c, false, err
+	}
+	if err := os.Rename(path, path+".corrupt"); err != nil {
+		return c, false, err
+	}
+	c, err = NewBoltCache(path)
+	return c, true, err
+}
+
+// NewReadOnlyBoltCache opens an existing cache for reading. Unlike
+// NewBoltCache, it can be open in several places at once.
+func NewReadOnlyBoltCache(path string) (BoltCache, error) {
+	db, err := openBolt(path, &bolt.Options{ReadOnly: true})
+	return BoltCache{db: db, closed: new(sync.Once)}, err
+}
+
+// openBolt opens the bolt database at path, giving up with ErrLocked if
+// another process holds it for more than lockTimeout, rather than waiting
+// forever.
+func openBolt(path string, o *bolt.Options) (*bolt.DB, error) {
+	o.Timeout = lockTimeout
+	db, err := bolt.Open(path, 0666, o)
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %v", ErrLocked, path)
+	}
+	return db, err
+}
+
+func (c BoltCache) Set(ns, k string, v []byte) {
+	c.write(cacheWrite{ns: ns, ks: []string{k}, v: v})
+}
+
+func (c BoltCache) SetMany(ns string, ks []string, v []byte) {
+	if len(ks) > 0 {
+		c.write(cacheWrite{ns: ns, ks: ks, v: v})
+	}
+}
+
+// write hands w to the writer goroutine and waits for it to be committed.
+func (c BoltCache) write(w cacheWrite) {
+	if c.writes == nil {
+		panic(bolt.ErrDatabaseReadOnly)
+	}
+	w.done = make(chan error, 1)
+	c.writes <- w
+	if err := <-w.done; err != nil {
 		panic(err)
 	}
 }
 
+// writer commits queued writes. Whatever queues up while one transaction
+// commits goes into the next, so concurrent writers share transactions (and
+// fsyncs) rather than each contending for bolt's write lock.
+func (c BoltCache) writer() {
+	defer close(c.stopped)
+	for w := range c.writes {
+		batch := []cacheWrite{w}
+	fill:
+		for len(batch) < maxWriteBatch {
+			select {
+			case w, ok := <-c.writes:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, w)
+			default:
+				break fill
+			}
+		}
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			for _, w := range batch {
+				if err := w.apply(tx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		for _, w := range batch {
+			w.done <- err
+		}
+	}
+}
+
 func (c BoltCache) Get(ns, k string) ([]byte, bool) {
 	var b []byte
 	var ok bool
@@ -57,15 +210,11 @@ func (c BoltCache) Get(ns, k string) ([]byte, bool) {
 }
 
 func (c BoltCache) Del(ns, k string) {
-	if err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(ns))
-		if b != nil {
-			b.Delete([]byte(k))
-		}
-		return nil
-	}); err != nil {
-		panic(err)
-	}
+	c.write(cacheWrite{ns: ns, ks: []string{k}, del: true})
+}
+
+func (c BoltCache) DelNs(ns string) {
+	c.write(cacheWrite{ns: ns, drop: true})
 }
 
 func (c BoltCache) Items(ns string, ks chan<- string) {
@@ -85,3 +234,17 @@ func (c BoltCache) Items(ns string, ks chan<- string) {
 		}
 	}()
 }
+
+// Close flushes and closes the cache, releasing the file. Later calls do
+// nothing.
+func (c BoltCache) Close() {
+	c.closed.Do(func() {
+		if c.writes != nil {
+			close(c.writes)
+			<-c.stopped
+		}
+		if err := c.db.Close(); err != nil {
+			panic(err)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBoltCacheConcurrentWrites(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	f := path.Join(d, "cache")
+	c, err := NewBoltCache(f)
+	if err != nil {
+		t.Fatalf(`NewBoltCache(%v) = %v, expected no error`, f, err)
+	}
+	const writers, writes = 32, 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				c.Set("ns", fmt.Sprintf("%d-%d", i, j), []byte(fmt.Sprint(j)))
+				// Each write is visible as soon as Set returns.
+				if _, ok := c.Get("ns", fmt.Sprintf("%d-%d", i, j)); !ok {
+					t.Errorf(`Get(%d-%d) = false after Set, expected true`, i, j)
+				}
+				if j%2 == 1 {
+					c.Del("ns", fmt.Sprintf("%d-%d", i, j))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Close()
+
+	c, err = NewReadOnlyBoltCache(f)
+	if err != nil {
+		t.Fatalf(`NewReadOnlyBoltCache(%v) = %v, expected no error`, f, err)
+	}
+	defer c.Close()
+	ks := make(chan string)
+	c.Items("ns", ks)
+	n := 0
+	for range ks {
+		n++
+	}
+	if n != writers*writes/2 {
+		t.Errorf(`Items() returned %v keys, expected %v`, n, writers*writes/2)
+	}
+	for i := 0; i < writers; i++ {
+		for j := 0; j < writes; j += 2 {
+			if v, ok := c.Get("ns", fmt.Sprintf("%d-%d", i, j)); !ok || string(v) != fmt.Sprint(j) {
+				t.Errorf(`Get(%d-%d) = %q, %v, expected %v`, i, j, v, ok, j)
+			}
+		}
+	}
+}
+
+func TestBoltCacheItemsEmpty(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	c, err := NewBoltCache(path.Join(d, "cache"))
+	if err != nil {
+		t.Fatalf(`NewBoltCache() = %v, expected no error`, err)
+	}
+	defer c.Close()
+	// Neither a namespace that was never written nor one emptied again, key
+	// by key or all at once, has any items.
+	c.Set("emptied", "k", []byte("v"))
+	c.Del("emptied", "k")
+	c.SetMany("dropped", []string{"a", "b"}, []byte("v"))
+	if v, ok := c.Get("dropped", "b"); !ok || string(v) != "v" {
+		t.Errorf(`Get(dropped, b) = %q, %v, expected "v"`, v, ok)
+	}
+	c.DelNs("dropped")
+	c.DelNs("missing")
+	for _, ns := range []string{"missing", "emptied", "dropped"} {
+		ks := make(chan string)
+		c.Items(ns, ks)
+		n := 0
+		for range ks {
+			n++
+		}
+		if n != 0 {
+			t.Errorf(`Items(%v) returned %v keys, expected 0`, ns, n)
+		}
+	}
+}
+
+func TestBoltCacheClose(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	f := path.Join(d, "cache")
+	c, err := NewBoltCache(f)
+	if err != nil {
+		t.Fatalf(`NewBoltCache() = %v, expected no error`, err)
+	}
+	c.Set("ns", "k", []byte("v"))
+	// A second process can't open it meanwhile, and says so.
+	start := time.Now()
+	if _, err := NewBoltCache(f); !errors.Is(err, ErrLocked) {
+		t.Errorf(`NewBoltCache() = %v, expected ErrLocked`, err)
+	}
+	if d := time.Since(start); d > 5*lockTimeout {
+		t.Errorf(`NewBoltCache() took %v, expected to give up after %v`, d, lockTimeout)
+	}
+	c.Close()
+	c.Close()
+	// Closing released the lock and kept the write.
+	c, err = NewReadOnlyBoltCache(f)
+	if err != nil {
+		t.Fatalf(`NewReadOnlyBoltCache() = %v, expected no error`, err)
+	}
+	if v, ok := c.Get("ns", "k"); !ok || string(v) != "v" {
+		t.Errorf(`Get(k) = %q, %v, expected v`, v, ok)
+	}
+	c.Close()
+	c.Close()
+}
+
+func TestRecoverBoltCache(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	// A cache whose meta pages were both lost, and one zeroed entirely.
+	good := path.Join(d, "good")
+	c, err := NewBoltCache(good)
+	if err != nil {
+		t.Fatalf(`NewBoltCache() = %v, expected no error`, err)
+	}
+	c.Set("ns", "k", []byte("v"))
+	c.Close()
+	bs, err := ioutil.ReadFile(good)
+	if err != nil {
+		panic(err)
+	}
+	garbled := append([]byte{}, bs...)
+	for i := 0; i < 2*os.Getpagesize() && i < len(garbled); i++ {
+		garbled[i] = 0xff
+	}
+	for name, bs := range map[string][]byte{"garbled": garbled, "zeroed": make([]byte, len(bs))} {
+		f := path.Join(d, name)
+		if err := ioutil.WriteFile(f, bs, 0666); err != nil {
+			panic(err)
+		}
+		if _, err := NewBoltCache(f); !IsCorrupt(err) {
+			t.Errorf(`NewBoltCache(%v) = %v, expected a corrupt cache`, name, err)
+		}
+		c, recovered, err := RecoverBoltCache(f)
+		if err != nil || !recovered {
+			t.Fatalf(`RecoverBoltCache(%v) = _, %v, %v, expected a fresh cache`, name, recovered, err)
+		}
+		if _, ok := c.Get("ns", "k"); ok {
+			t.Errorf(`Get(ns, k) on recovered %v = _, true, expected an empty cache`, name)
+		}
+		c.Set("ns", "k", []byte("v"))
+		c.Close()
+		if _, err := os.Stat(f + ".corrupt"); err != nil {
+			t.Errorf(`Stat(%v.corrupt) = %v, expected the corrupt cache to be kept`, name, err)
+		}
+	}
+	// Sound caches are left alone.
+	c, recovered, err := RecoverBoltCache(good)
+	if err != nil || recovered {
+		t.Fatalf(`RecoverBoltCache(good) = _, %v, %v, expected it to open`, recovered, err)
+	}
+	defer c.Close()
+	if v, ok := c.Get("ns", "k"); !ok || string(v) != "v" {
+		t.Errorf(`Get(ns, k) = %q, %v, expected "v"`, v, ok)
+	}
+}
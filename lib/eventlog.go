@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event is a single entry in an EventLog.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Type is e.g. "rpc", "rate_limit", "deliver", "delete" or "relabel".
+	Type   string `json:"type"`
+	Method string `json:"method,omitempty"`
+	Id     string `json:"id,omitempty"`
+	Key    string `json:"key,omitempty"`
+	// Delay is the backoff for rate_limit events, in nanoseconds.
+	Delay time.Duration `json:"delay,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// EventLog writes Events as JSON lines, for auditing what a run did. A nil
+// *EventLog discards everything, so callers needn't check whether logging is
+// enabled. It is safe for concurrent use.
+type EventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewEventLog(w io.Writer) *EventLog {
+	return &EventLog{enc: json.NewEncoder(w)}
+}
+
+// Log records e, filling in its timestamp and error. Write errors are
+// ignored; the event log is best-effort.
+func (l *EventLog) Log(e Event, err error) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now()
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(e)
+}
@@ -0,0 +1,136 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// The Gmail API's batch endpoint.
+	batchURL = "https://gmail.googleapis.com/batch/gmail/v1"
+	// Most requests the API accepts in one batch.
+	MaxFetchBatch = 100
+)
+
+// GetRawMessages fetches messages in raw format, like GetRawMessage, in one
+// batch request. Each message still counts against the rate limit (and
+// quota) as if fetched alone, but they share one HTTP round trip.
+func (s *restGmailService) GetRawMessages(ctx context.Context, ids []string) ([]*gmail.Message, error) {
+	// DoWithBackoff takes a token for the first.
+	for i := 1; i < len(ids); i++ {
+		if err := s.limiter.Get(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var ms []*gmail.Message
+	var err error
+	err = s.do(ctx, func() error {
+		ms, err = s.batch(ctx, ids)
+		return err
+	})
+	return ms, err
+}
+
+// batch sends a batch request getting each of ids in raw format. Messages
+// whose part of the response failed are left nil.
+func (s *restGmailService) batch(ctx context.Context, ids []string) ([]*gmail.Message, error) {
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	for i, id := range ids {
+		p, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {fmt.Sprintf("<%d>", i)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(p, "GET /gmail/v1/users/me/messages/%v?format=raw HTTP/1.1\r\n\r\n", id)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", s.batchURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+w.Boundary())
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]*gmail.Message, len(ids))
+	r := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		// Responses are identified as "response-" plus the request's ID.
+		cid := strings.Trim(p.Header.Get("Content-Id"), "<>")
+		i, err := strconv.Atoi(strings.TrimPrefix(cid, "response-"))
+		if err != nil || i < 0 || i >= len(ids) {
+			return nil, fmt.Errorf("unexpected batch response part %q", cid)
+		}
+		pr, err := http.ReadResponse(bufio.NewReader(p), req)
+		if err != nil {
+			return nil, err
+		}
+		if pr.StatusCode == http.StatusOK {
+			var m gmail.Message
+			if err := json.NewDecoder(pr.Body).Decode(&m); err != nil {
+				return nil, err
+			}
+			ms[i] = &m
+		}
+		pr.Body.Close()
+	}
+	return ms, nil
+}
+
+// prefetch fetches, in one batch, those of ids that are new, for getBody to
+// pick up from g.prefetched. If that fails, getBody fetches them one by one.
+func (g *Gmail) prefetch(ctx context.Context, ids []string) {
+	fetch := []string{}
+	for _, id := range ids {
+		if _, ok := g.cache.GetMsgKey(id); (!ok || g.forceRedownload) && !g.cache.FullSyncDone(id) {
+			fetch = append(fetch, id)
+		}
+	}
+	if len(fetch) < 2 {
+		return
+	}
+	ms, err := g.svc.GetRawMessages(ctx, fetch)
+	if err != nil {
+		log.Println("Batch fetch failed, fetching messages one by one:", err)
+		return
+	}
+	for i, m := range ms {
+		if m != nil {
+			g.prefetched.Store(fetch[i], m)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package gmail
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// batchServer emulates the batch endpoint, answering a GET for each message
+// in msgs with its raw content and anything else with a 404.
+func batchServer(t *testing.T, msgs map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Errorf(`batch Content-Type = %v, expected multipart`, err)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			req, err := http.ReadRequest(bufio.NewReader(p))
+			if err != nil {
+				t.Errorf(`ReadRequest() = %v, expected nil`, err)
+				return
+			}
+			id := strings.TrimPrefix(req.URL.Path, "/gmail/v1/users/me/messages/")
+			rp, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type": {"application/http"},
+				"Content-Id":   {"<response-" + strings.Trim(p.Header.Get("Content-Id"), "<>") + ">"},
+			})
+			if raw, ok := msgs[id]; ok && req.URL.Query().Get("format") == "raw" {
+				fmt.Fprintf(rp, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n{\"id\": %q, \"raw\": %q}", id, raw)
+			} else {
+				fmt.Fprint(rp, "HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\n\r\n{}")
+			}
+		}
+		mw.Close()
+	}))
+}
+
+func TestGetRawMessages(t *testing.T) {
+	srv := batchServer(t, map[string]string{"0x1": "one", "0x3": "three"})
+	defer srv.Close()
+	s := newRestGmailService(nil, srv.Client(), nil, nil)
+	defer s.limiter.Stop()
+	s.batchURL = srv.URL
+	ms, err := s.GetRawMessages(context.Background(), []string{"0x1", "0x2", "0x3"})
+	if err != nil {
+		t.Fatalf(`GetRawMessages() = %v, expected nil`, err)
+	}
+	if len(ms) != 3 {
+		t.Fatalf(`GetRawMessages() = %v, expected 3 messages`, ms)
+	}
+	if ms[0] == nil || ms[0].Id != "0x1" || ms[0].Raw != "one" {
+		t.Errorf(`GetRawMessages()[0] = %v, expected 0x1`, ms[0])
+	}
+	if ms[1] != nil {
+		t.Errorf(`GetRawMessages()[1] = %v, expected nil for the missing message`, ms[1])
+	}
+	if ms[2] == nil || ms[2].Id != "0x3" || ms[2].Raw != "three" {
+		t.Errorf(`GetRawMessages()[2] = %v, expected 0x3`, ms[2])
+	}
+}
+
+func TestGetRawMessagesError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"code": 400, "message": "bad batch"}}`, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	s := newRestGmailService(nil, srv.Client(), nil, nil)
+	defer s.limiter.Stop()
+	s.batchURL = srv.URL
+	if _, err := s.GetRawMessages(context.Background(), []string{"0x1", "0x2"}); err == nil {
+		t.Errorf(`GetRawMessages() = nil, expected an error`)
+	}
+}
+
+func TestCustomRetriable(t *testing.T) {
+	ok := batchServer(t, map[string]string{"0x1": "one", "0x2": "two"})
+	defer ok.Close()
+	// Fails every other request, as a flaky proxy might.
+	requests := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%2 == 1 {
+			http.Error(w, `{"error": {"code": 502, "message": "proxy hiccup"}}`, http.StatusBadGateway)
+			return
+		}
+		ok.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	s := newRestGmailService(nil, srv.Client(), nil, nil)
+	defer s.limiter.Stop()
+	s.batchURL = srv.URL
+	s.limiter.BackoffStart = time.Millisecond
+	s.limiter.OnBackoff, s.limiter.OnSuccess = nil, nil
+	// A 502 isn't retried by default.
+	if _, err := s.GetRawMessages(context.Background(), []string{"0x1", "0x2"}); err == nil {
+		t.Errorf(`GetRawMessages() = nil, expected the 502`)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf(`GetRawMessages() made %v requests, expected 1`, n)
+	}
+	atomic.StoreInt32(&requests, 0)
+	s.retriable = func(err error) bool {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == 502 {
+			return true
+		}
+		return DefaultRetriable(err)
+	}
+	ms, err := s.GetRawMessages(context.Background(), []string{"0x1", "0x2"})
+	if err != nil || len(ms) != 2 || ms[0] == nil || ms[1] == nil {
+		t.Errorf(`GetRawMessages() = %v, %v, expected both messages after a retry`, ms, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf(`GetRawMessages() made %v requests, expected 2`, n)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"log"
+	"time"
 
 	"github.com/danmarg/outtake/lib"
 	"github.com/danmarg/outtake/lib/maildir"
+	"github.com/danmarg/outtake/lib/oauth"
 	"golang.org/x/oauth2"
 )
 
@@ -15,13 +18,33 @@ const (
 	midToKey     = "mid_to_key"
 	midToLabels  = "mid_to_label"
 	historyIndex = "history_index"
+	midToThread  = "mid_to_thread"
+	threadToMids = "thread_to_mids"
+	knownLabels  = "known_labels"
+	labelMapNs   = "labels"
 	oauthToken   = "oauth_token"
+	fullSyncIdx  = "full_sync_index"
+	fullSyncDone = "full_sync_done"
 )
 
 type gmailCache struct {
 	Cache lib.Cache
 }
 
+// dryRunCache reads from a Cache but drops writes, so that a dry run leaves
+// it as it was.
+type dryRunCache struct {
+	lib.Cache
+}
+
+func (dryRunCache) Set(ns, k string, v []byte) {}
+
+func (dryRunCache) Del(ns, k string) {}
+
+func (dryRunCache) SetMany(ns string, ks []string, v []byte) {}
+
+func (dryRunCache) DelNs(ns string) {}
+
 func (c *gmailCache) GetOauthToken() (*oauth2.Token, bool) {
 	var tok oauth2.Token
 	if bs, ok := c.Cache.Get(oauthToken, "0"); ok {
@@ -33,6 +56,20 @@ func (c *gmailCache) GetOauthToken() (*oauth2.Token, bool) {
 	return nil, false
 }
 
+// GetOauthClientId returns the ID of the OAuth client the cached token was
+// issued to. Caches from before this was recorded only ever held tokens for
+// the built-in client.
+func (c *gmailCache) GetOauthClientId() string {
+	if bs, ok := c.Cache.Get(oauthToken, "client"); ok {
+		return string(bs)
+	}
+	return oauth.ClientId
+}
+
+func (c *gmailCache) SetOauthClientId(id string) {
+	c.Cache.Set(oauthToken, "client", []byte(id))
+}
+
 func (c *gmailCache) SetOauthToken(tok *oauth2.Token) {
 	bs := new(bytes.Buffer)
 	if err := gob.NewEncoder(bs).Encode(tok); err != nil {
@@ -41,6 +78,10 @@ func (c *gmailCache) SetOauthToken(tok *oauth2.Token) {
 	c.Cache.Set(oauthToken, "0", bs.Bytes())
 }
 
+func (c *gmailCache) DelOauthToken() {
+	c.Cache.Del(oauthToken, "0")
+}
+
 func (c *gmailCache) GetMsgKey(m string) (maildir.Key, bool) {
 	k, ok := c.Cache.Get(midToKey, m)
 	return maildir.Key(k), ok
@@ -55,8 +96,83 @@ func (g *gmailCache) GetMsgs(ms chan<- string) {
 }
 
 func (c *gmailCache) DelMsg(m string) {
+	if t, _, ok := c.GetMsgThread(m); ok {
+		c.delThreadMsg(t, m)
+	}
 	c.Cache.Del(midToKey, m)
 	c.Cache.Del(midToLabels, m)
+	c.Cache.Del(midToThread, m)
+}
+
+// threadInfo is the per-message data needed to build the thread index.
+type threadInfo struct {
+	ThreadId string
+	Date     int64
+}
+
+func (c *gmailCache) GetMsgThread(m string) (string, int64, bool) {
+	var ti threadInfo
+	bs, ok := c.Cache.Get(midToThread, m)
+	if !ok {
+		return "", 0, false
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&ti); err != nil {
+		panic(err)
+	}
+	return ti.ThreadId, ti.Date, true
+}
+
+func (c *gmailCache) SetMsgThread(m, t string, date int64) {
+	bs := new(bytes.Buffer)
+	if err := gob.NewEncoder(bs).Encode(threadInfo{t, date}); err != nil {
+		panic(err)
+	}
+	c.Cache.Set(midToThread, m, bs.Bytes())
+	ms := c.GetThreadMsgs(t)
+	for _, x := range ms {
+		if x == m {
+			return
+		}
+	}
+	c.setThreadMsgs(t, append(ms, m))
+}
+
+func (c *gmailCache) GetThreadMsgs(t string) []string {
+	ms := []string{}
+	bs, ok := c.Cache.Get(threadToMids, t)
+	if !ok {
+		return ms
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&ms); err != nil {
+		panic(err)
+	}
+	return ms
+}
+
+func (c *gmailCache) setThreadMsgs(t string, ms []string) {
+	if len(ms) == 0 {
+		c.Cache.Del(threadToMids, t)
+		return
+	}
+	bs := new(bytes.Buffer)
+	if err := gob.NewEncoder(bs).Encode(ms); err != nil {
+		panic(err)
+	}
+	c.Cache.Set(threadToMids, t, bs.Bytes())
+}
+
+func (c *gmailCache) delThreadMsg(t, m string) {
+	ms := c.GetThreadMsgs(t)
+	for i, x := range ms {
+		if x == m {
+			c.setThreadMsgs(t, append(ms[:i], ms[i+1:]...))
+			return
+		}
+	}
+}
+
+func (c *gmailCache) GetThreads(ts chan<- string) {
+	c.Cache.Items(threadToMids, ts)
 }
 
 func (c *gmailCache) GetMsgLabels(m string) ([]string, bool) {
@@ -87,8 +203,130 @@ func (c *gmailCache) GetHistoryIdx() uint64 {
 	return hidx
 }
 
+// SetHistoryIdx advances the history checkpoint to i. The checkpoint never
+// moves backward: a lower value is logged and ignored.
 func (c *gmailCache) SetHistoryIdx(i uint64) {
+	if old := c.GetHistoryIdx(); i < old {
+		log.Printf("not moving history index back from %d to %d", old, i)
+		return
+	}
+	c.ResetHistoryIdx(i)
+}
+
+// ResetHistoryIdx sets the history checkpoint to i, even if that's lower, as
+// it is after a full sync replaces an expired one.
+func (c *gmailCache) ResetHistoryIdx(i uint64) {
 	b := make([]byte, 8)
 	binary.PutUvarint(b, i)
 	c.Cache.Set(historyIndex, "0", b)
 }
+
+// GetFullSyncIdx returns the history checkpoint of an interrupted full sync,
+// or 0 if there is none.
+func (c *gmailCache) GetFullSyncIdx() uint64 {
+	hidx := uint64(0)
+	if b, ok := c.Cache.Get(fullSyncIdx, "0"); ok {
+		hidx, _ = binary.Uvarint(b)
+	}
+	return hidx
+}
+
+// SetFullSyncIdx records the history checkpoint of a full sync in progress,
+// and base, the history index in place when it started.
+func (c *gmailCache) SetFullSyncIdx(i, base uint64) {
+	b := make([]byte, 8)
+	binary.PutUvarint(b, i)
+	c.Cache.Set(fullSyncIdx, "0", b)
+	b = make([]byte, 8)
+	binary.PutUvarint(b, base)
+	c.Cache.Set(fullSyncIdx, "base", b)
+}
+
+// GetFullSyncBase returns the history index in place when the interrupted
+// full sync started. If it's changed since, other syncs have superseded it.
+func (c *gmailCache) GetFullSyncBase() uint64 {
+	base := uint64(0)
+	if b, ok := c.Cache.Get(fullSyncIdx, "base"); ok {
+		base, _ = binary.Uvarint(b)
+	}
+	return base
+}
+
+// FullSyncDone reports whether an interrupted full sync already handled
+// message m.
+func (c *gmailCache) FullSyncDone(m string) bool {
+	_, ok := c.Cache.Get(fullSyncDone, m)
+	return ok
+}
+
+// SetFullSyncDone records that the full sync handled messages ms, in one
+// transaction.
+func (c *gmailCache) SetFullSyncDone(ms []string) {
+	c.Cache.SetMany(fullSyncDone, ms, []byte{1})
+}
+
+// ClearFullSync forgets the progress of an interrupted full sync.
+func (c *gmailCache) ClearFullSync() {
+	c.Cache.DelNs(fullSyncDone)
+	c.Cache.DelNs(fullSyncIdx)
+}
+
+// GetKnownLabels returns the label IDs present on the server at the end of the
+// last sync.
+func (c *gmailCache) GetKnownLabels() ([]string, bool) {
+	ls := []string{}
+	bs, ok := c.Cache.Get(knownLabels, "0")
+	if !ok {
+		return ls, false
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&ls); err != nil {
+		panic(err)
+	}
+	return ls, true
+}
+
+func (c *gmailCache) SetKnownLabels(ls []string) {
+	bs := new(bytes.Buffer)
+	if err := gob.NewEncoder(bs).Encode(ls); err != nil {
+		panic(err)
+	}
+	c.Cache.Set(knownLabels, "0", bs.Bytes())
+}
+
+// labelMap is the cached label list: label names by ID, and when they were
+// fetched.
+type labelMap struct {
+	Names   map[string]string
+	Fetched time.Time
+}
+
+// GetLabelMap returns the cached label names by ID, and when they were
+// fetched from the server.
+func (c *gmailCache) GetLabelMap() (map[string]string, time.Time, bool) {
+	var m labelMap
+	bs, ok := c.Cache.Get(labelMapNs, "0")
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&m); err != nil {
+		panic(err)
+	}
+	if m.Names == nil {
+		m.Names = make(map[string]string)
+	}
+	return m.Names, m.Fetched, true
+}
+
+// SetLabelMap caches the label names by ID, as fetched just now.
+func (c *gmailCache) SetLabelMap(names map[string]string) {
+	bs := new(bytes.Buffer)
+	if err := gob.NewEncoder(bs).Encode(labelMap{names, time.Now()}); err != nil {
+		panic(err)
+	}
+	c.Cache.Set(labelMapNs, "0", bs.Bytes())
+}
+
+// DelLabelMap forgets the cached label names, so that they're fetched again.
+func (c *gmailCache) DelLabelMap() {
+	c.Cache.Del(labelMapNs, "0")
+}
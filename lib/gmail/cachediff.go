@@ -0,0 +1,83 @@
+package gmail
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/danmarg/outtake/lib"
+)
+
+// openCacheFile opens an existing cache file read-only.
+func openCacheFile(f string) (gmailCache, lib.BoltCache, error) {
+	c, err := lib.NewReadOnlyBoltCache(f)
+	if err != nil {
+		return gmailCache{}, c, err
+	}
+	return gmailCache{c}, c, nil
+}
+
+func (c *gmailCache) msgSet() map[string]struct{} {
+	ms := make(chan string)
+	c.GetMsgs(ms)
+	s := make(map[string]struct{})
+	for m := range ms {
+		s[m] = struct{}{}
+	}
+	return s
+}
+
+// DiffCaches compares two cache files, writing to w the messages present in
+// only one, messages whose labels differ, and any difference in the history
+// index. It returns the number of differences found.
+func DiffCaches(a, b string, w io.Writer) (int, error) {
+	ca, ba, err := openCacheFile(a)
+	if err != nil {
+		return 0, err
+	}
+	defer ba.Close()
+	cb, bb, err := openCacheFile(b)
+	if err != nil {
+		return 0, err
+	}
+	defer bb.Close()
+	n := 0
+	if ha, hb := ca.GetHistoryIdx(), cb.GetHistoryIdx(); ha != hb {
+		fmt.Fprintf(w, "history index: %d in %v, %d in %v\n", ha, a, hb, b)
+		n++
+	}
+	ma, mb := ca.msgSet(), cb.msgSet()
+	ids := make([]string, 0, len(ma)+len(mb))
+	for m := range ma {
+		ids = append(ids, m)
+	}
+	for m := range mb {
+		if _, ok := ma[m]; !ok {
+			ids = append(ids, m)
+		}
+	}
+	sort.Strings(ids)
+	for _, m := range ids {
+		_, inA := ma[m]
+		_, inB := mb[m]
+		switch {
+		case !inB:
+			fmt.Fprintf(w, "only in %v: %v\n", a, m)
+			n++
+		case !inA:
+			fmt.Fprintf(w, "only in %v: %v\n", b, m)
+			n++
+		default:
+			la, _ := ca.GetMsgLabels(m)
+			lb, _ := cb.GetMsgLabels(m)
+			sort.Strings(la)
+			sort.Strings(lb)
+			if strings.Join(la, ",") != strings.Join(lb, ",") {
+				fmt.Fprintf(w, "labels of %v: %v in %v, %v in %v\n", m, la, a, lb, b)
+				n++
+			}
+		}
+	}
+	return n, nil
+}
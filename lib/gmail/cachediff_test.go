@@ -0,0 +1,68 @@
+package gmail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/danmarg/outtake/lib"
+)
+
+func newTestCacheFile(d, name string) (gmailCache, string) {
+	f := path.Join(d, name)
+	c, err := lib.NewBoltCache(f)
+	if err != nil {
+		panic(err)
+	}
+	return gmailCache{c}, f
+}
+
+func TestDiffCaches(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	a, fa := newTestCacheFile(d, "a")
+	b, fb := newTestCacheFile(d, "b")
+	for _, c := range []gmailCache{a, b} {
+		c.SetMsgKey("same", "k")
+		c.SetMsgLabels("same", []string{"INBOX", "STARRED"})
+		c.SetMsgKey("relabeled", "k")
+	}
+	a.SetHistoryIdx(5)
+	b.SetHistoryIdx(7)
+	a.SetMsgKey("onlyA", "k")
+	b.SetMsgKey("onlyB", "k")
+	a.SetMsgLabels("relabeled", []string{"INBOX"})
+	b.SetMsgLabels("relabeled", []string{"Label_1"})
+	a.Cache.Close()
+	b.Cache.Close()
+
+	out := new(bytes.Buffer)
+	n, err := DiffCaches(fa, fb, out)
+	if err != nil {
+		t.Fatalf(`DiffCaches() = %v, expected no error`, err)
+	}
+	want := []string{
+		"history index: 5 in " + fa + ", 7 in " + fb,
+		"only in " + fa + ": onlyA",
+		"only in " + fb + ": onlyB",
+		"labels of relabeled: [INBOX] in " + fa + ", [Label_1] in " + fb,
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); n != 4 || strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf(`DiffCaches() = %v, %q, expected 4, %q`, n, got, want)
+	}
+	// Identical caches don't differ.
+	out.Reset()
+	if n, err := DiffCaches(fa, fa, out); n != 0 || err != nil || out.Len() != 0 {
+		t.Errorf(`DiffCaches(a, a) = %v, %v, %q, expected 0, nil, ""`, n, err, out.String())
+	}
+	// Missing files aren't created.
+	if _, err := DiffCaches(fa, path.Join(d, "missing"), out); err == nil {
+		t.Errorf(`DiffCaches(a, missing) = nil, expected error`)
+	}
+}
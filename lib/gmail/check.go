@@ -0,0 +1,44 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Gmail's per-user quota, in units per second.
+const userQuotaPerSec = 250
+
+// fullSyncCost estimates the quota units used by a full sync of n messages:
+// a raw and a metadata messages.get each, and a messages.list per page of
+// 100.
+func fullSyncCost(n uint) uint {
+	return 2*n*quotaCost["messages.get"] + (n/100+1)*quotaCost["messages.list"]
+}
+
+// Check verifies that the credentials work by fetching the account's
+// profile, writing the account and the estimated quota cost of a full sync
+// to w. The error, if any, says whether the credentials were rejected.
+func (g *Gmail) Check(ctx context.Context, w io.Writer) error {
+	p, err := g.svc.GetProfile(ctx)
+	if err != nil {
+		var apiErr *googleapi.Error
+		var authErr *oauth2.RetrieveError
+		if errors.As(err, &authErr) ||
+			errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden) {
+			return fmt.Errorf("check failed: credentials rejected: %w", err)
+		}
+		return fmt.Errorf("check failed: %w", err)
+	}
+	n := uint(p.MessagesTotal)
+	units := fullSyncCost(n)
+	fmt.Fprintf(w, "OK: authenticated as %v\n", p.EmailAddress)
+	fmt.Fprintf(w, "A full sync of %d messages would use about %d quota units (at least %ds at the per-user limit of %d units/s).\n",
+		n, units, (units+userQuotaPerSec-1)/userQuotaPerSec, userQuotaPerSec)
+	return nil
+}
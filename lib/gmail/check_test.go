@@ -0,0 +1,47 @@
+package gmail
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// profileErrService fails GetProfile.
+type profileErrService struct {
+	*testService
+	err error
+}
+
+func (s profileErrService) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	return nil, s.err
+}
+
+func TestCheck(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Profile = &gmail.Profile{EmailAddress: "me@example.com", MessagesTotal: 1000}
+	buf := new(bytes.Buffer)
+	if err := c.Check(context.Background(), buf); err != nil {
+		t.Fatalf(`Check() = %v, expected no error`, err)
+	}
+	// 2 * 1000 * 5 + 11 * 5 units.
+	want := "OK: authenticated as me@example.com\nA full sync of 1000 messages would use about 10055 quota units (at least 41s at the per-user limit of 250 units/s).\n"
+	if buf.String() != want {
+		t.Errorf(`Check() wrote %q, expected %q`, buf.String(), want)
+	}
+
+	c.svc = profileErrService{svc, &googleapi.Error{Code: 401, Message: "Invalid Credentials"}}
+	err := c.Check(context.Background(), buf)
+	if err == nil || !strings.Contains(err.Error(), "credentials rejected") {
+		t.Errorf(`Check() = %v, expected credentials rejected`, err)
+	}
+	c.svc = profileErrService{svc, errors.New("connection refused")}
+	err = c.Check(context.Background(), buf)
+	if err == nil || strings.Contains(err.Error(), "credentials rejected") {
+		t.Errorf(`Check() = %v, expected a non-credentials error`, err)
+	}
+}
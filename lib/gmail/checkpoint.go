@@ -0,0 +1,69 @@
+package gmail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Checkpoint is the progress written to the checkpoint file, for monitoring
+// a long sync or recovering from one by hand. Outtake itself resumes from
+// the cache, and never reads the file back.
+type Checkpoint struct {
+	// "full" or "incremental".
+	Phase string `json:"phase"`
+	// The history index a sync stopped now would resume from.
+	HistoryId uint64 `json:"history_id"`
+	// Token of the next page of the message listing, during full sync.
+	PageToken string `json:"page_token,omitempty"`
+	// Messages handled, added and deleted so far in this run.
+	Handled uint      `json:"handled"`
+	Added   uint      `json:"added"`
+	Deleted uint      `json:"deleted"`
+	Time    time.Time `json:"time"`
+}
+
+// setListPage records the token of the next page of the message listing.
+func (g *Gmail) setListPage(p string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.listPage = p
+}
+
+// writeCheckpointFile updates the checkpoint file, if there is one, with
+// history index h and the number of messages handled. Failing to write it
+// doesn't stop the sync.
+func (g *Gmail) writeCheckpointFile(h uint64, handled uint) {
+	if g.checkpointFile == "" || g.dryRun {
+		return
+	}
+	g.mu.Lock()
+	page := g.listPage
+	g.mu.Unlock()
+	if g.phase != "full" {
+		page = ""
+	}
+	bs, err := json.Marshal(Checkpoint{
+		Phase:     g.phase,
+		HistoryId: h,
+		PageToken: page,
+		Handled:   handled,
+		Added:     uint(atomic.LoadUint64(&g.added)),
+		Deleted:   uint(atomic.LoadUint64(&g.deleted)),
+		Time:      time.Now(),
+	})
+	if err == nil {
+		// Write to a temporary file first so readers never see a partial
+		// checkpoint.
+		tmp := g.checkpointFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, bs, 0644); err == nil {
+			err = os.Rename(tmp, g.checkpointFile)
+		}
+	}
+	if err != nil {
+		log.Println("could not write checkpoint file", err)
+	}
+}
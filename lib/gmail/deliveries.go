@@ -0,0 +1,74 @@
+package gmail
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// deliveries writes a full sync's new messages on background workers, so
+// that downloads carry on while the disk catches up. It records the messages
+// written, and the first error.
+type deliveries struct {
+	ops     chan msgOp
+	workers sync.WaitGroup
+	// Queued messages not yet written.
+	pending sync.WaitGroup
+	// Guards the rest.
+	mu   sync.Mutex
+	done []string
+	err  error
+}
+
+// startDeliveries starts n workers writing the messages queued.
+func (g *Gmail) startDeliveries(ctx context.Context, n int) *deliveries {
+	d := &deliveries{ops: make(chan msgOp)}
+	for i := 0; i < n; i++ {
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			for o := range d.ops {
+				err := g.writeOperation(ctx, o)
+				d.mu.Lock()
+				if err == nil {
+					d.done = append(d.done, o.Id)
+				} else if d.err == nil {
+					d.err = err
+				}
+				d.mu.Unlock()
+				d.pending.Done()
+			}
+		}()
+	}
+	return d
+}
+
+// queue hands o to a worker, waiting for one to be free.
+func (d *deliveries) queue(o msgOp) {
+	d.pending.Add(1)
+	d.ops <- o
+}
+
+// failed returns the first error writing a message, if any.
+func (d *deliveries) failed() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// flush waits for the messages queued so far to be written, returning those
+// written since the last flush, and the first error.
+func (d *deliveries) flush() ([]string, error) {
+	d.pending.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	done := d.done
+	d.done = nil
+	return done, d.err
+}
+
+// stop waits for the workers to finish and exit.
+func (d *deliveries) stop() {
+	close(d.ops)
+	d.workers.Wait()
+}
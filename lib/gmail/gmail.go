@@ -10,22 +10,25 @@
 //
 // To abstract this a bit, and to parallelize slower network operations, our
 // flow looks like this:
-//     full() --> getBody() --> getMetaData() --> writeAdd()
+//     full() --> getBody() --> writeAdd()
 //            --> getMetaData() --> writeLabels()
 //            --> writeDel()
 //
-//     incremental() --> getBody() --> getMetaData() --> writeAdd()
+//     incremental() --> getBody() --> writeAdd()
 //                   --> writeLabels()
 //                   --> writeDel()
 // getBody() and getMetaData() make RPCs to the Gmail API, and multiple
-// workers run in parallel.
+// workers run in parallel. getBody() gets a new message's labels along with
+// its body, in one RPC.
 
 package gmail
 
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -35,7 +38,10 @@ import (
 	"path"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/danmarg/outtake/lib"
 	"github.com/danmarg/outtake/lib/maildir"
@@ -52,21 +58,55 @@ const (
 	labelsHeader = "X-Keywords"
 	// Cache filename.
 	cacheFile = ".outtake"
+	// Environment variable holding a base64-encoded JSON OAuth token.
+	tokenEnv = "OUTTAKE_TOKEN"
+	// System label for drafts.
+	draftLabel = "DRAFT"
+	// System label for unread messages.
+	unreadLabel = "UNREAD"
+	// Extra attempts to fetch a message returned without content.
+	emptyRawRetries = 2
+	// How long the account's message count is reused in progress reports.
+	accountTotalTTL = 30 * time.Second
 )
 
 var (
 	// Errors.
 	unknownMessage   = errors.New("unknown message")
 	fullSyncRequired = errors.New("full sync required")
+	// Returned by Sync in incremental-only mode when only a full sync would
+	// do.
+	ErrFullSyncNeeded = errors.New("a full sync is needed but incremental-only mode is set")
 	// Parallelism.
-	MessageBufferSize   = 128
 	ConcurrentDownloads = 8
+	ConcurrentDeletes   = 8
+	// Maximum concurrent deliveries and deletions in the Maildir; 0 means
+	// unlimited, with full sync delivering one message at a time.
+	ConcurrentDiskWrites = 0
+	// Maximum total API retries per run; 0 means unlimited.
+	RetryBudget uint = 0
+	// Retries of each rate-limited API call, and the longest backoff between
+	// them. The backoff doubles from a second up to MaxBackoff, however many
+	// retries there are.
+	MaxRetries uint          = 7
+	MaxBackoff time.Duration = time.Minute
+	// Messages handled between full sync checkpoints, and between updates of
+	// the checkpoint file; replaced in tests.
+	fullSyncCheckpointEvery = 500
+	// How long the cached label list is trusted to resolve label names.
+	labelMapTTL = time.Hour
+	// Interactive OAuth flow, the source that refreshes its tokens, and
+	// whether someone may be there to sign in again mid-sync; replaced in
+	// tests.
+	getOAuthToken    = oauth.GetOAuthClient
+	refreshingSource = (*oauth2.Config).TokenSource
+	interactive      = stdinIsTerminal
 )
 
 // This function creates a JWT (JSON Web Token) HTTP client using a JSON
 // key file with the ability to impersonate any given gmail user of the
 // domain.
-func newJWTClient(serviceAccountJSONFile string, toImpersonate string) (*http.Client, error) {
+func newJWTClient(ctx context.Context, serviceAccountJSONFile string, toImpersonate string) (*http.Client, error) {
 	// Read the JSON account file content.
 	data, err := ioutil.ReadFile(serviceAccountJSONFile)
 	if err != nil {
@@ -81,76 +121,551 @@ func newJWTClient(serviceAccountJSONFile string, toImpersonate string) (*http.Cl
 	// Note: this is a NOP if toImpersonate is an empty string.
 	config.Subject = toImpersonate
 	// Create the http client and return it.
-	client := config.Client(oauth2.NoContext)
+	client := config.Client(ctx)
 	return client, nil
 }
 
-func newOAuthClient(g *Gmail) (*http.Client, error) {
+// findDefaultCredentials is a variable for testing.
+var findDefaultCredentials = google.FindDefaultCredentials
+
+// newADCClient authenticates with Application Default Credentials, as set up
+// by gcloud or named by $GOOGLE_APPLICATION_CREDENTIALS.
+func newADCClient(ctx context.Context) (*http.Client, error) {
+	creds, err := findDefaultCredentials(ctx, gmail.GmailReadonlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("finding application default credentials: %w", err)
+	}
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
+}
+
+// newClient returns an authenticated client for the credentials selected by
+// opts: a service account key file, Application Default Credentials (if
+// requested, or if $GOOGLE_APPLICATION_CREDENTIALS is set), or else the
+// interactive OAuth flow.
+func newClient(ctx context.Context, g *Gmail, opts Options) (*http.Client, error) {
+	if len(opts.ServiceAccountJSONFile) != 0 {
+		// Use a JSON key file.
+		return newJWTClient(ctx, opts.ServiceAccountJSONFile, opts.ToImpersonate)
+	}
+	if opts.UseADC || os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
+		return newADCClient(ctx)
+	}
+	// Regular Web authentication.
+	cfg, err := oauthConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return newOAuthClient(ctx, g, cfg)
+}
+
+// oauthConfig returns the configuration for the interactive OAuth flow, with
+// the client from opts, if any, or else the built-in one. Every user of the
+// built-in client shares its project's API quota.
+func oauthConfig(opts Options) (*oauth2.Config, error) {
+	id, secret := oauth.ClientId, oauth.Secret
+	if opts.OAuthClientFile != "" {
+		var err error
+		if id, secret, err = oauth.ClientFromFile(opts.OAuthClientFile); err != nil {
+			return nil, err
+		}
+	}
+	if opts.OAuthClientID != "" || opts.OAuthClientSecret != "" {
+		if opts.OAuthClientID == "" || opts.OAuthClientSecret == "" {
+			return nil, errors.New("an OAuth client needs both an ID and a secret")
+		}
+		id, secret = opts.OAuthClientID, opts.OAuthClientSecret
+	}
 	cfg := &oauth2.Config{
-		ClientID:     oauth.ClientId,
-		ClientSecret: oauth.Secret,
+		ClientID:     id,
+		ClientSecret: secret,
 		Scopes:       []string{gmail.GmailReadonlyScope},
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
 			TokenURL: "https://accounts.google.com/o/oauth2/token",
 		},
 	}
+	if opts.OAuthPort < 0 || opts.OAuthPort > 65535 {
+		return nil, fmt.Errorf("OAuth redirect port %d is out of range", opts.OAuthPort)
+	} else if opts.OAuthPort > 0 {
+		cfg.RedirectURL = oauth.RedirectURL(opts.OAuthPort)
+	}
+	return cfg, nil
+}
+
+// tokenFromEnv returns the OAuth token in $OUTTAKE_TOKEN, if set.
+func tokenFromEnv() (*oauth2.Token, bool, error) {
+	v := os.Getenv(tokenEnv)
+	if v == "" {
+		return nil, false, nil
+	}
+	bs, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding %v: %v", tokenEnv, err)
+	}
+	tok := new(oauth2.Token)
+	if err := json.Unmarshal(bs, tok); err != nil {
+		return nil, false, fmt.Errorf("decoding %v: %v", tokenEnv, err)
+	}
+	return tok, true, nil
+}
+
+func newOAuthClient(ctx context.Context, g *Gmail, cfg *oauth2.Config) (*http.Client, error) {
+	if tok, ok, err := tokenFromEnv(); err != nil {
+		return nil, err
+	} else if ok {
+		// Tokens from the environment are refreshed in memory only and never
+		// written to the cache.
+		return cfg.Client(ctx, tok), nil
+	}
 	tok, ok := g.cache.GetOauthToken()
-	if !ok {
-		// XXX: should we use a client-specified context here?
+	if ok && g.cache.GetOauthClientId() != cfg.ClientID {
+		// Tokens can only be refreshed by the client they were issued to.
+		log.Println("Stored OAuth token is for a different OAuth client; re-authenticating.")
+		ok = false
+	}
+	if !ok || tok.RefreshToken == "" {
+		// Ask for offline access so the token can be refreshed silently.
+		opts := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+		if ok {
+			// Google only issues a refresh token on first consent unless
+			// consent is forced.
+			log.Println("Stored OAuth token has no refresh token; re-authenticating to get one.")
+			opts = append(opts, oauth2.SetAuthURLParam("prompt", "consent"))
+		}
 		var err error
-		tok, err = oauth.GetOAuthClient(context.TODO(), cfg)
+		tok, err = getOAuthToken(ctx, cfg, opts...)
 		if err != nil {
 			return nil, err
 		}
 		g.cache.SetOauthToken(tok)
+		g.cache.SetOauthClientId(cfg.ClientID)
 	}
-	clt := cfg.Client(oauth2.NoContext, tok)
-	return clt, nil
+	return newCachedTokenSource(ctx, cfg, g.cache, tok).client(), nil
 }
 
 // Gmail represents a Gmail client.
 type Gmail struct {
-	label    string
-	labelId  string
-	cache    gmailCache
-	svc      gmailService
-	dir      maildir.Maildir
-	progress chan<- lib.Progress
+	label   string
+	labelId string
+	// Number of messages listing will find, if known, for progress
+	// reporting.
+	listTotal uint
+	cache     gmailCache
+	svc       gmailService
+	dir       lib.Store
+	progress  chan<- lib.Progress
+	// Last progress update sent.
+	lastProgress lib.Progress
+	// The operation in progress, and messages added and deleted so far, for
+	// progress reports. The counts are updated atomically.
+	phase   string
+	added   uint64
+	deleted uint64
+	// Messages in the account, for progress during incremental sync, and
+	// when that was last fetched.
+	accountTotal   uint
+	accountTotalAt time.Time
+	// Thread index file, and threads changed since it was last written.
+	threadIndex  string
+	dirtyThreads map[string]struct{}
+	// API call counts.
+	stats rpcStats
+	// Serializes cache bookkeeping when deletes run in parallel, and guards
+	// listPage and the label names.
+	mu sync.Mutex
+	// Label names by ID for the keywords header, loaded on first use, and
+	// whether they've been fetched again this run. Loading them holds
+	// labelFetch.
+	labelDisplay    map[string]string
+	labelsRefreshed bool
+	labelFetch      sync.Mutex
+	// Checkpoint file, and the token of the next page of the message
+	// listing to record in it.
+	checkpointFile string
+	listPage       string
+	// Whether to enumerate drafts on full sync.
+	drafts bool
+	// Headers to keep or strip on export.
+	headers HeaderFilter
+	// Senders whose mail is synced.
+	senders SenderFilter
+	// The rest of the listing's search query; see QueryOptions.
+	since        time.Time
+	search       string
+	includeChats bool
+	// Whether to mark read messages, or all messages, as seen on delivery.
+	readState   bool
+	markAllRead bool
+	// How labels are exported.
+	labelPolicy LabelPolicy
+	// Maildir flags set for labels, alongside their keywords.
+	labelFlags map[string]string
+	// Names of labels whose messages aren't synced, and their IDs once
+	// resolved.
+	excludeLabels []string
+	excludeIds    []string
+	// History change types to fetch; all if empty.
+	historyTypes []string
+	// Most history pages to fetch per incremental sync; 0 for no limit.
+	maxHistoryPages int
+	// Limits active download workers under persistent rate limiting; nil in
+	// tests.
+	throttle *lib.Throttle
+	// RawFormat or FullFormat.
+	fetchFormat string
+	// Capacity of the download pipeline's channels; 0 for the default.
+	bufferSize int
+	// Messages fetched per batch request on full sync, if more than 1, and
+	// the batches' messages, by ID, until getBody takes them.
+	fetchBatch int
+	prefetched sync.Map
+	// Maps message IDs to incremental sync shards. If nil, shardForMsgId is
+	// used; tests set it to control ordering.
+	sharder func(id string) int
+	// Audit log of RPCs and filesystem operations; may be nil.
+	events *lib.EventLog
+	// Changelog of label transitions; may be nil.
+	labelLog *LabelLog
+	// Called with each delivered message's file; may be nil.
+	onDeliver func(id, path string)
+	// The client without credentials, and the credentials' token source if
+	// known, for WhoAmI.
+	base   *http.Client
+	tokens oauth2.TokenSource
+	// Whether to skip all deletions.
+	onlyNew bool
+	// Local messages received more recently than this aren't deleted for
+	// missing from a listing; 0 to delete them regardless.
+	keepRecent time.Duration
+	// Whether to fail rather than run a full sync.
+	incrementalOnly bool
+	// Whether to download and store again messages that are already stored.
+	forceRedownload bool
+	// Whether listMsgs handles each thread's messages on one worker.
+	threadOrder bool
+	// Whether full sync writes messages in the order they're listed.
+	newestFirst bool
+	// Whether to only log changes instead of making them, and what they
+	// were, guarded by mu.
+	dryRun  bool
+	planned Planned
+}
+
+// Planned counts the changes a dry run found to make.
+type Planned struct {
+	Adds, Deletes, Relabels int
+}
+
+// Options configures a Gmail synchronizer.
+type Options struct {
+	// Label to sync. If empty, all mail is synced.
+	Label string
+	// Labels whose messages are not synced, even if they also carry other
+	// labels. Messages that gain one of these labels are removed locally.
+	ExcludeLabels []string
+	// JSON key file of a service account to authenticate with instead of
+	// the interactive OAuth flow.
+	ServiceAccountJSONFile string
+	// Domain user to impersonate when using a service account.
+	ToImpersonate string
+	// OAuth client for the interactive flow, instead of the built-in one,
+	// whose API quota every outtake user shares. Either a client secrets
+	// JSON file, as downloaded from the Google Cloud console, or an ID and
+	// secret, which take precedence.
+	OAuthClientFile   string
+	OAuthClientID     string
+	OAuthClientSecret string
+	// Loopback port for the interactive flow's redirect, for a client that
+	// only allows a known redirect URI, http://localhost:<port>; if 0, a
+	// random free port.
+	OAuthPort int
+	// Authenticate with Application Default Credentials instead of the
+	// built-in OAuth client. Implied by $GOOGLE_APPLICATION_CREDENTIALS.
+	UseADC bool
+	// PEM file of additional CA certificates to trust, e.g. for
+	// TLS-inspecting corporate proxies.
+	CACertFile string
+	// Disable TLS certificate verification. Dangerous; for testing only.
+	InsecureSkipVerify bool
+	// If the cache is corrupt, move it aside and start with an empty one,
+	// instead of failing. The cache maps messages to files, so with an empty
+	// one every message is downloaded again, alongside the existing copies.
+	RecoverCache bool
+	// If set, a JSON index of thread ID to message keys is written here
+	// after each sync.
+	ThreadIndexFile string
+	// If set, a JSON Checkpoint is written here as sync progresses, for
+	// monitoring or manual recovery.
+	CheckpointFile string
+	// Additional Maildirs to write every message to. Must be the same on
+	// every run.
+	MirrorDirs []string
+	// Also enumerate drafts on full sync, in case they're missing from the
+	// message list.
+	Drafts bool
+	// Headers to keep or strip from exported messages. Keeps all by default.
+	Headers HeaderFilter
+	// Senders whose mail is synced. Syncs mail from anyone by default.
+	// Messages already stored are kept even if their sender isn't allowed.
+	Senders SenderFilter
+	// Only list mail received at or after this time on full sync. Stored
+	// messages from before are kept, and incremental sync is unaffected.
+	Since time.Time
+	// A Gmail search that full sync listings must also match, such as
+	// "-category:promotions". Stored messages that don't are kept. History
+	// can't be searched, so incremental sync still adds all new mail.
+	Query string
+	// List chats on full sync too. They aren't MIME messages, so they're
+	// stored wrapped; see unparsed.go.
+	IncludeChats bool
+	// Deliver new messages that are already read in Gmail (i.e. lack the
+	// UNREAD label) into "cur" with the Seen flag, instead of into "new".
+	ReadState bool
+	// Deliver every message into "cur" with the Seen flag, regardless of
+	// its read state in Gmail.
+	MarkAllRead bool
+	// History change types to request on incremental sync, from
+	// HistoryTypes. If empty, all types are requested.
+	HistoryTypes []string
+	// Most pages of history to process in one incremental sync. Past that,
+	// the sync checkpoints what it has done and stops, to be continued by
+	// the next one. 0 means no limit.
+	MaxHistoryPages int
+	// Capacity of the download pipeline's buffers. If 0, it's scaled to
+	// ConcurrentDownloads.
+	MessageBufferSize int
+	// How to download messages: RawFormat (the default, if empty) or
+	// FullFormat.
+	FetchFormat string
+	// If more than 1, full sync fetches new messages in batch requests of
+	// up to this many, at most MaxFetchBatch, instead of one by one. Only
+	// for RawFormat, and without ExcludeLabels or Senders, which need each
+	// message's metadata first.
+	FetchBatch int
+	// What to export each label as. By default, every label is a keyword.
+	LabelPolicy LabelPolicy
+	// Maildir info flags to set, in addition to any keywords, on messages
+	// with these labels; e.g. {"STARRED": "F"}. Flags are single letters.
+	LabelFlags map[string]string
+	// Times to retry transient filesystem errors when writing messages.
+	FSRetries int
+	// If set, every RPC and filesystem operation is recorded here.
+	Events *lib.EventLog
+	// If set, every change to a message's labels is recorded here.
+	LabelLog *LabelLog
+	// If set, called with the message ID and final path of each message
+	// written, whether new or rewritten on relabeling, e.g. to index it for
+	// search. Not called for stores without files, such as a TarStore.
+	OnDeliver func(id, path string)
+	// If positive, files in the Maildir's tmp/ older than this, left by
+	// interrupted runs, are removed on startup.
+	TmpMaxAge time.Duration
+	// If greater than 0, spread messages across this many subfolders of the
+	// Maildir in dir. See lib.ShardedStore.
+	Shards int
+	// Maintain a Maildir++ maildirsize file in dir for quota-aware servers.
+	// See lib.SizeStore.
+	MaildirSize bool
+	// If set, messages are written here instead of to the Maildir in dir.
+	// The cache is still kept in dir.
+	Store lib.Store
+	// Never delete local messages: skip deletion detection on full sync and
+	// ignore deletes on incremental sync. Local copies of messages deleted
+	// from the server are kept.
+	OnlyNew bool
+	// Local messages received within this long are kept even if a full
+	// listing leaves them out, as a safeguard against inconsistent
+	// listings: recent mail is unlikely to be gone for good. Deletions
+	// reported by the history are still applied. 0 disables it.
+	KeepRecent time.Duration
+	// Decides which API errors are retried with backoff, for errors
+	// particular to an environment, such as a flaky proxy's. Defaults to
+	// DefaultRetriable, which a custom predicate may call for the rest.
+	IsRetriable func(error) bool
+	// Never fall back to a full sync, say when the history index has
+	// expired or there is none yet: Sync returns ErrFullSyncNeeded instead,
+	// unless asked for a full sync. For tight quotas, which a full sync
+	// could use up.
+	IncrementalOnly bool
+	// If true, full sync handles all of a thread's messages on one worker,
+	// so they're delivered in the order they're listed.
+	ThreadOrder bool
+	// If true, full sync writes messages strictly in the order Gmail lists
+	// them, newest first, rather than as their downloads finish.
+	NewestFirst bool
+	// If true, full sync downloads every listed message again, even those
+	// already stored, replacing the stored copies. Sync is then always
+	// full. Combine with Query or Since to repair a subset.
+	ForceRedownload bool
+	// If true, sync logs the changes it would make to the Maildir without
+	// making them, and leaves the cache, including the history index, as
+	// it is. See Planned.
+	DryRun bool
+}
+
+// CachePath returns the path of the cache file for the Maildir dir.
+func CachePath(dir string) string {
+	return path.Join(dir, cacheFile)
 }
 
+// HistoryTypes are the change types History.List can be limited to.
+var HistoryTypes = []string{"messageAdded", "messageDeleted", "labelAdded", "labelRemoved"}
+
 // Creates a new Gmail synchronizer.
-func NewGmail(dir string, label string, serviceAccountJSONFile string, toImpersonate string) (*Gmail, error) {
+func NewGmail(dir string, opts Options) (*Gmail, error) {
 	g := Gmail{
-		label: label,
+		label:           opts.Label,
+		threadIndex:     opts.ThreadIndexFile,
+		checkpointFile:  opts.CheckpointFile,
+		forceRedownload: opts.ForceRedownload,
+		drafts:          opts.Drafts,
+		headers:         opts.Headers,
+		senders:         opts.Senders,
+		since:           opts.Since,
+		search:          opts.Query,
+		includeChats:    opts.IncludeChats,
+		readState:       opts.ReadState,
+		markAllRead:     opts.MarkAllRead,
+		events:          opts.Events,
+		labelLog:        opts.LabelLog,
+		onDeliver:       opts.OnDeliver,
+		onlyNew:         opts.OnlyNew,
+		keepRecent:      opts.KeepRecent,
+		incrementalOnly: opts.IncrementalOnly,
+		threadOrder:     opts.ThreadOrder,
+		newestFirst:     opts.NewestFirst,
+		dryRun:          opts.DryRun,
+		labelPolicy:     opts.LabelPolicy,
+		labelFlags:      opts.LabelFlags,
+		excludeLabels:   opts.ExcludeLabels,
+		historyTypes:    opts.HistoryTypes,
+		maxHistoryPages: opts.MaxHistoryPages,
+		fetchFormat:     opts.FetchFormat,
+		bufferSize:      opts.MessageBufferSize,
+		fetchBatch:      opts.FetchBatch,
 	}
-	f := path.Join(dir, cacheFile)
-	if c, err := lib.NewBoltCache(f); err != nil {
+	if opts.MessageBufferSize < 0 {
+		return nil, fmt.Errorf("message buffer size %d is negative", opts.MessageBufferSize)
+	} else if opts.MessageBufferSize > 0 && opts.MessageBufferSize < ConcurrentDownloads {
+		log.Printf("Message buffer size %d is smaller than the %d download workers, which may starve them", opts.MessageBufferSize, ConcurrentDownloads)
+	}
+	for l, f := range opts.LabelFlags {
+		if !isFlag(f) {
+			return nil, fmt.Errorf("flag %q for label %v is not a single letter", f, l)
+		}
+	}
+	switch opts.FetchFormat {
+	case "", RawFormat, FullFormat:
+	default:
+		return nil, fmt.Errorf("unknown fetch format %q; must be %v or %v", opts.FetchFormat, RawFormat, FullFormat)
+	}
+	if opts.FetchBatch > MaxFetchBatch {
+		return nil, fmt.Errorf("fetch batch size %d is more than the API's limit of %d", opts.FetchBatch, MaxFetchBatch)
+	}
+	for _, t := range opts.HistoryTypes {
+		if !containsLabel(HistoryTypes, t) {
+			return nil, fmt.Errorf("unknown history type %q; must be one of %v", t, strings.Join(HistoryTypes, ", "))
+		}
+	}
+	g.throttle = lib.NewThrottle(ConcurrentDownloads)
+	if opts.RecoverCache {
+		c, recovered, err := lib.RecoverBoltCache(CachePath(dir))
+		if err != nil {
+			return nil, err
+		}
+		if recovered {
+			log.Printf("Cache %v was corrupt; moved it to %v.corrupt and starting afresh with a full sync. Messages already in the Maildir will be downloaded again.", CachePath(dir), CachePath(dir))
+		}
+		g.cache = gmailCache{c}
+	} else if c, err := lib.NewBoltCache(CachePath(dir)); lib.IsCorrupt(err) {
+		return nil, fmt.Errorf("cache %v is corrupt (%v); pass --recover-cache to move it aside and start afresh", CachePath(dir), err)
+	} else if err != nil {
 		return nil, err
 	} else {
 		g.cache = gmailCache{c}
 	}
-	var clt *http.Client
-	var err error
-	if len(serviceAccountJSONFile) != 0 {
-		// Use a JSON key file.
-		clt, err = newJWTClient(serviceAccountJSONFile, toImpersonate)
-	} else {
-		// Regular Web authentication.
-		clt, err = newOAuthClient(&g)
+	// The base client carries the TLS settings; oauth2 picks it up from the
+	// context for both the token exchange and API calls.
+	base, err := lib.NewHTTPClient(opts.CACertFile, opts.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
 	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, base)
+	clt, err := newClient(ctx, &g, opts)
 	if err != nil {
 		return nil, err
 	}
+	g.base = base
+	if t, ok := clt.Transport.(*oauth2.Transport); ok {
+		g.tokens = t.Source
+	}
+	// Surface any notice that the API is going away, once per run.
+	clt = &http.Client{Transport: &lib.DeprecationWarner{Base: clt.Transport}, Timeout: clt.Timeout}
 	if c, err := gmail.New(clt); err != nil {
 		return nil, err
 	} else {
-		g.svc = newRestGmailService(gmail.NewUsersService(c))
+		r := newRestGmailService(gmail.NewUsersService(c), clt, g.events, g.throttle)
+		r.retriable = opts.IsRetriable
+		if ts, ok := g.tokens.(*cachedTokenSource); ok {
+			r.unauthorized = ts.expire
+		}
+		g.svc = &countingService{r, &g.stats, g.events}
 	}
-	if d, err := maildir.Create(dir); err != nil {
+	// Sweeps stale files from the Maildir's tmp/, if we created it.
+	var sweep func(time.Duration) (int, error)
+	if opts.Store != nil {
+		g.dir = opts.Store
+	} else if opts.Shards > 0 {
+		s, err := lib.NewShardedStore(dir, opts.Shards)
+		if err != nil {
+			return nil, err
+		}
+		g.dir = s
+		sweep = s.SweepTmp
+	} else if d, err := maildir.Create(dir); err != nil {
 		return nil, err
 	} else {
 		g.dir = d
+		sweep = d.SweepTmp
+	}
+	// The cache's file lock keeps any other run out of dir, so nothing can be
+	// mid-delivery.
+	if sweep != nil && opts.TmpMaxAge > 0 && !opts.DryRun {
+		if n, err := sweep(opts.TmpMaxAge); err != nil {
+			return nil, err
+		} else if n > 0 {
+			lib.Infof("Removed %d stale files from tmp/ in %v", n, dir)
+		}
+	}
+	if opts.MaildirSize && opts.Store == nil && !opts.DryRun {
+		s, err := lib.NewSizeStore(g.dir, dir)
+		if err != nil {
+			return nil, err
+		}
+		g.dir = s
+	}
+	if len(opts.MirrorDirs) > 0 {
+		s := lib.MultiStore{g.dir}
+		for _, m := range opts.MirrorDirs {
+			d, err := maildir.Create(m)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, d)
+		}
+		g.dir = s
+	}
+	// Inside the RetryStore, so that retries don't hold a slot while they
+	// sleep.
+	if ConcurrentDiskWrites > 0 {
+		g.dir = lib.NewLimitStore(g.dir, ConcurrentDiskWrites)
+	}
+	if opts.FSRetries > 0 {
+		g.dir = lib.RetryStore{Store: g.dir, Retries: opts.FSRetries, Delay: 100 * time.Millisecond}
+	}
+	// Only now, so that a new OAuth token is still saved.
+	if opts.DryRun {
+		g.cache = gmailCache{dryRunCache{g.cache.Cache}}
 	}
 
 	return &g, nil
@@ -163,13 +678,27 @@ const (
 	WRITE_LABELS = iota
 )
 
+// Operation names, for logging.
+var opNames = map[int32]string{NONE: "NONE", ADD: "ADD", DELETE: "DELETE", WRITE_LABELS: "WRITE_LABELS"}
+
 type msgOp struct {
 	Id        string
 	HistoryId uint64
+	// In incremental sync, the history record the operation came from.
+	Record uint64
+	// From listMsgs, the message's position in the listing, from 1.
+	Seq       uint64
+	ThreadId  string
+	Date      int64
+	Size      int64
+	From      string
 	Labels    []string
+	Draft     bool
 	Msg       *mail.Message
 	Operation int32
 	Error     error
+	// From handleRefreshMsg: relabel without ever downloading the body.
+	LabelsOnly bool
 }
 
 func (g *Gmail) getMaildirMessage(k maildir.Key) (*mail.Message, io.ReadCloser, error) {
@@ -178,6 +707,15 @@ func (g *Gmail) getMaildirMessage(k maildir.Key) (*mail.Message, io.ReadCloser,
 		return nil, nil, err
 	}
 	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		// A mail client may have just renamed the file, e.g. to change its
+		// flags. Its key stays the same, so look for it once more; GetFile
+		// rescans the Maildir when its index is stale.
+		if fn, err = g.dir.GetFile(k); err != nil {
+			return nil, nil, err
+		}
+		f, err = os.Open(fn)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -185,101 +723,279 @@ func (g *Gmail) getMaildirMessage(k maildir.Key) (*mail.Message, io.ReadCloser,
 	return m, f, err
 }
 
-func (g *Gmail) getBody(m string) (*mail.Message, error) {
-	body, err := g.svc.GetRawMessage(m)
+// getBody fetches message m, returning it along with the API's copy, which
+// carries its labels and other metadata for setMetaData.
+func (g *Gmail) getBody(ctx context.Context, m string) (*mail.Message, *gmail.Message, error) {
+	if g.fetchFormat == FullFormat {
+		return g.getFullBody(ctx, m)
+	}
+	var r *gmail.Message
+	var err error
+	if p, ok := g.prefetched.LoadAndDelete(m); ok {
+		r = p.(*gmail.Message)
+	} else {
+		r, err = g.svc.GetRawMessage(ctx, m)
+	}
+	// The API occasionally returns no content at all, which is usually
+	// transient. Never deliver that as a blank message.
+	for i := 0; i < emptyRawRetries && err == nil && (r == nil || r.Raw == ""); i++ {
+		r, err = g.svc.GetRawMessage(ctx, m)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if r == nil || r.Raw == "" {
+		if msg, full, err := g.getFullBody(ctx, m); err == nil {
+			return msg, full, nil
+		}
+		log.Println("Skipping message", m, "with no content; a full sync will retry it")
+		return nil, nil, nil
 	}
-	raw, err := base64.URLEncoding.DecodeString(body)
+	raw, err := base64.URLEncoding.DecodeString(r.Raw)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	raw = g.headers.apply(raw)
+	msg, perr := mail.ReadMessage(bytes.NewReader(raw))
+	if perr != nil {
+		if msg, full, err := g.getFullBody(ctx, m); err == nil {
+			log.Println("Error parsing message", m, ", reconstructed it from parts:", perr)
+			return msg, full, nil
+		}
+		// These are often chats and calendar invitations, due to bugs in the
+		// Gmail API. Keep them anyway.
+		log.Println("Error parsing message", m, ", storing it wrapped:", perr)
+		return wrapUnparsed(m, raw, perr), r, nil
+	}
+	return msg, r, nil
+}
+
+// getFullBody fetches a message with format=full and reconstructs it.
+func (g *Gmail) getFullBody(ctx context.Context, m string) (*mail.Message, *gmail.Message, error) {
+	full, err := g.svc.GetFullMessage(ctx, m)
+	if err != nil {
+		return nil, nil, err
 	}
-	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	raw, err := reconstructMessage(full)
 	if err != nil {
-		log.Println("Error parsing message", m, ":", err)
-		// XXX: Don't return an error here. These are often chats and such, due to bugs in the Gmail API.
-		return nil, nil
+		return nil, nil, err
 	}
-	return msg, nil
+	msg, err := mail.ReadMessage(bytes.NewReader(g.headers.apply(raw)))
+	return msg, full, err
 }
 
-func (g *Gmail) getMetaData(m *msgOp) error {
-	meta, err := g.svc.GetMetadata(m.Id)
+func (g *Gmail) getMetaData(ctx context.Context, m *msgOp) error {
+	meta, err := g.svc.GetMetadata(ctx, m.Id)
 	if err != nil {
 		return err
 	}
+	g.setMetaData(m, meta)
+	return nil
+}
+
+// setMetaData copies the labels and other metadata of meta, as returned by
+// any of the message formats, to m.
+func (g *Gmail) setMetaData(m *msgOp, meta *gmail.Message) {
 	m.Labels = meta.LabelIds
+	if m.Draft {
+		m.Labels = addLabel(m.Labels, draftLabel)
+	}
 	m.HistoryId = meta.HistoryId
-	return err
+	m.ThreadId = meta.ThreadId
+	m.Date = meta.InternalDate
+	m.Size = meta.SizeEstimate
+	if meta.Payload != nil {
+		for _, h := range meta.Payload.Headers {
+			if strings.EqualFold(h.Name, "From") {
+				m.From = h.Value
+			}
+		}
+	}
+}
+
+// addLabel returns ls with l appended, unless it's already present.
+func addLabel(ls []string, l string) []string {
+	for _, x := range ls {
+		if x == l {
+			return ls
+		}
+	}
+	return append(ls, l)
+}
+
+// flagsForLabels returns the maildir info flags for a message with the given
+// labels.
+func (g *Gmail) flagsForLabels(labels []string) string {
+	_, flags := g.labelPolicy.apply(labels)
+	for _, l := range labels {
+		if f, ok := g.labelFlags[l]; ok && !strings.Contains(flags, f) {
+			flags += f
+		}
+	}
+	if strings.Contains(flags, "S") {
+		return flags
+	} else if g.markAllRead {
+		return flags + "S"
+	} else if !g.readState {
+		return flags
+	}
+	for _, l := range labels {
+		if l == unreadLabel {
+			return flags
+		}
+	}
+	return flags + "S"
 }
 
 func (g *Gmail) writeAdd(m msgOp) error {
-	k, err := g.dir.Deliver(m.Msg)
+	old, replacing := g.cache.GetMsgKey(m.Id)
+	k, err := g.dir.DeliverWithFlags(m.Msg, g.flagsForLabels(m.Labels))
+	g.events.Log(lib.Event{Type: "deliver", Id: m.Id, Key: string(k)}, err)
 	if err != nil {
 		return err
 	}
+	g.delivered(m.Id, k)
+	atomic.AddUint64(&g.added, 1)
 	// Update the cache.
 	g.cache.SetMsgLabels(m.Id, m.Labels)
 	g.cache.SetMsgKey(m.Id, k)
+	if m.ThreadId != "" {
+		g.cache.SetMsgThread(m.Id, m.ThreadId, m.Date)
+		// Full sync delivers on its own workers.
+		g.mu.Lock()
+		g.markThread(m.Id)
+		g.mu.Unlock()
+	}
+	if replacing && old != k {
+		// Re-downloaded; drop the copy it replaces.
+		if err := g.dir.Delete(old); err != nil && !errors.Is(err, maildir.ErrNotExist) {
+			return err
+		}
+	}
 	return nil
 }
 
+// delivered passes the file of the message just delivered as k to the
+// onDeliver callback, if any.
+func (g *Gmail) delivered(id string, k maildir.Key) {
+	if g.onDeliver == nil {
+		return
+	}
+	f, err := g.dir.GetFile(k)
+	if errors.Is(err, lib.ErrAppendOnly) {
+		return
+	} else if err != nil {
+		log.Println("could not find delivered message", id, err)
+		return
+	}
+	g.onDeliver(id, f)
+}
+
 func (g *Gmail) writeDel(id string) error {
 	k, ok := g.cache.GetMsgKey(id)
 	if !ok {
 		// XXX: It doesn't make sense to error out here, since we're deleting anyway...
 		return nil
 	}
-	if err := g.dir.Delete(k); err != nil {
+	err := g.dir.Delete(k)
+	g.events.Log(lib.Event{Type: "delete", Id: id, Key: string(k)}, err)
+	if errors.Is(err, maildir.ErrNotExist) {
+		// Removed behind our back; just forget it.
+		log.Println("message", id, "already missing from Maildir")
+	} else if err != nil {
 		return err
+	} else {
+		atomic.AddUint64(&g.deleted, 1)
 	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.markThread(id)
 	g.cache.DelMsg(id)
 	return nil
 }
 
 func (g *Gmail) computeLabels(id string, added, removed []string) []string {
-	if old, ok := g.cache.GetMsgLabels(id); ok {
-		nlabels := make(map[string]struct{})
-		for _, l := range old {
-			nlabels[l] = struct{}{}
+	ls, _ := g.updateLabels(id, added, removed)
+	return ls
+}
+
+// updateLabels applies added and removed to the cached labels of id,
+// returning the new labels, sorted, and whether they differ from the cached
+// ones. It's equivalent to computeLabels followed by labelsChanged, but reads
+// the cache once and avoids the intermediate set, which matters over long
+// histories.
+func (g *Gmail) updateLabels(id string, added, removed []string) ([]string, bool) {
+	old, ok := g.cache.GetMsgLabels(id)
+	if !ok {
+		// This shouldn't happen--there should always be a cache hit--but OK.
+		ls := append([]string{}, added...)
+		sort.Strings(ls)
+		return ls, true
+	}
+	return applyLabels(old, added, removed)
+}
+
+// applyLabels returns old with added and removed applied, sorted and without
+// duplicates, and whether that differs from old.
+func applyLabels(old, added, removed []string) ([]string, bool) {
+	ls := make([]string, 0, len(old)+len(added))
+	for _, l := range old {
+		if !containsLabel(removed, l) {
+			ls = append(ls, l)
 		}
-		for _, l := range added {
-			nlabels[l] = struct{}{}
+	}
+	for _, l := range added {
+		if !containsLabel(removed, l) {
+			ls = append(ls, l)
 		}
-		for _, l := range removed {
-			delete(nlabels, l)
+	}
+	sort.Strings(ls)
+	// Drop duplicates, in place.
+	n := 0
+	for i, l := range ls {
+		if i == 0 || l != ls[n-1] {
+			ls[n] = l
+			n++
 		}
-		labels := make([]string, len(nlabels))
-		i := 0
-		for l, _ := range nlabels {
-			labels[i] = l
-			i++
+	}
+	ls = ls[:n]
+	return ls, !sameLabels(old, ls)
+}
+
+// containsLabel is a linear search; label lists are short enough that this
+// beats building a map.
+func containsLabel(ls []string, l string) bool {
+	for _, x := range ls {
+		if x == l {
+			return true
 		}
-		return labels
 	}
-	// This shouldn't happen--there should always be a cache hit--but OK.
-	return added
+	return false
 }
 
 func (g *Gmail) labelsChanged(id string, newLabels []string) bool {
-	if old, ok := g.cache.GetMsgLabels(id); ok {
-		sort.Strings(old)
-		sort.Strings(newLabels)
-		if old != nil && len(old) == len(newLabels) {
-			for i := 0; i < len(old); i++ {
-				if old[i] != newLabels[i] {
-					return true
-				}
-			}
+	old, ok := g.cache.GetMsgLabels(id)
+	return !ok || old == nil || !sameLabels(old, newLabels)
+}
+
+// sameLabels reports whether a and b hold the same labels, in any order. It
+// leaves both as they are.
+func sameLabels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, l := range a {
+		if !containsLabel(b, l) {
 			return false
-		} else {
-			return true
 		}
 	}
 	return true
 }
 
-func (g *Gmail) writeLabels(id string, labels []string) error {
+// writeLabels rewrites a stored message with new labels. If the Maildir has
+// lost the message, it is downloaded again if redownload is set; otherwise
+// only the cached labels are updated.
+func (g *Gmail) writeLabels(ctx context.Context, id string, labels []string, redownload bool) error {
 	k, ok := g.cache.GetMsgKey(id)
 	if !ok {
 		log.Println("unknown message", id, "for write labels")
@@ -287,19 +1003,41 @@ func (g *Gmail) writeLabels(id string, labels []string) error {
 		return nil //unknownMessage
 	}
 	msg, c, err := g.getMaildirMessage(k)
-	if err != nil {
+	if errors.Is(err, lib.ErrAppendOnly) {
+		// The stored copy can't be rewritten, so just track the new labels.
+		g.cache.SetMsgLabels(id, labels)
+		return nil
+	} else if errors.Is(err, maildir.ErrNotExist) && !redownload {
+		log.Println("message", id, "missing from Maildir, updating its cached labels only")
+		g.cache.SetMsgLabels(id, labels)
+		return nil
+	} else if errors.Is(err, maildir.ErrNotExist) {
+		// Removed behind our back; download it again.
+		log.Println("message", id, "missing from Maildir, re-downloading")
+		return g.redeliver(ctx, id, labels)
+	} else if err != nil {
 		return err
 	}
 	defer c.Close()
-	msg.Header[labelsHeader] = labels
-	// Note that this will mark a message as "new" for any clients. This might be undesirable if only labels have changed?
-	kn, err := g.dir.Deliver(msg)
+	msg.Header[labelsHeader] = g.keywordsHeader(ctx, labels)
+	flags := g.flagsForLabels(labels)
+	if f, err := g.dir.GetFile(k); err == nil {
+		old, _ := g.cache.GetMsgLabels(id)
+		flags = keepFlags(maildir.Flags(f), g.flagsForLabels(old), flags)
+	}
+	// Note that without flags, this will mark a message as "new" for any clients.
+	kn, err := g.dir.DeliverWithFlags(msg, flags)
+	g.events.Log(lib.Event{Type: "relabel", Id: id, Key: string(kn)}, err)
 	if err != nil {
 		return err
 	}
+	g.delivered(id, kn)
 	// Update the cache.
 	g.cache.SetMsgLabels(id, labels)
 	g.cache.SetMsgKey(id, kn)
+	g.mu.Lock()
+	g.markThread(id)
+	g.mu.Unlock()
 	// Delete the old message
 	if err := g.dir.Delete(k); err != nil {
 		return err
@@ -307,25 +1045,191 @@ func (g *Gmail) writeLabels(id string, labels []string) error {
 	return nil
 }
 
-func (g *Gmail) labelToId(label string) (string, error) {
-	ls, err := g.svc.GetLabels()
+// keepFlags returns the flags for a rewritten message: those set on the old
+// copy, e.g. by a mail client marking it seen or replied, except for those
+// its old labels set (oldFlags), plus those its new labels set (newFlags).
+func keepFlags(flags, oldFlags, newFlags string) string {
+	kept := newFlags
+	for _, f := range flags {
+		if !strings.ContainsRune(oldFlags, f) && !strings.ContainsRune(kept, f) {
+			kept += string(f)
+		}
+	}
+	return kept
+}
+
+// redeliver downloads a message the cache knows about but the Maildir has
+// lost and delivers it afresh with the given labels.
+func (g *Gmail) redeliver(ctx context.Context, id string, labels []string) error {
+	m, _, err := g.getBody(ctx, id)
+	if err != nil {
+		return err
+	} else if m == nil {
+		// Skipped; see getBody.
+		return nil
+	}
+	classifyUnparsed(m, labels)
+	m.Header[labelsHeader] = g.keywordsHeader(ctx, labels)
+	if err := g.writeAdd(msgOp{Id: id, Labels: labels, Msg: m}); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.markThread(id)
+	g.mu.Unlock()
+	return nil
+}
+
+// labelNames returns label names by ID, from the cache if they were fetched
+// within labelMapTTL and refresh is false, or else from the server.
+func (g *Gmail) labelNames(ctx context.Context, refresh bool) (map[string]string, error) {
+	if m, at, ok := g.cache.GetLabelMap(); ok && !refresh && time.Since(at) < labelMapTTL {
+		return m, nil
+	}
+	ls, err := g.svc.GetLabels(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return g.setLabelNames(ls), nil
+}
+
+// setLabelNames caches the names of the labels in ls, returning them by ID.
+func (g *Gmail) setLabelNames(ls *gmail.ListLabelsResponse) map[string]string {
+	m := make(map[string]string, len(ls.Labels))
 	for _, l := range ls.Labels {
-		if l.Name == label {
-			return l.Id, nil
+		m[l.Id] = l.Name
+	}
+	g.cache.SetLabelMap(m)
+	return m
+}
+
+// labelToId returns the ID of the label named label. The cached label list
+// is refreshed if the label isn't in it, in case it was created since.
+func (g *Gmail) labelToId(ctx context.Context, label string) (string, error) {
+	find := func(m map[string]string) (string, bool) {
+		for id, name := range m {
+			if name == label {
+				return id, true
+			}
+		}
+		return "", false
+	}
+	m, err := g.labelNames(ctx, false)
+	if err == nil {
+		if id, ok := find(m); ok {
+			return id, nil
+		}
+		m, err = g.labelNames(ctx, true)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not list labels to resolve %q: %w", label, err)
+	}
+	if id, ok := find(m); ok {
+		return id, nil
+	}
+	names := make([]string, 0, len(m))
+	for _, name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("label %q not found; available labels: %v", label, strings.Join(names, ", "))
+}
+
+// reconcileLabels strips labels that have been deleted from Gmail from every
+// cached message. History events usually cover this, but deleting a label in
+// bulk doesn't reliably produce an event for every message carrying it. The
+// label list cached within labelMapTTL is used, so a label deleted since is
+// only stripped once it expires.
+func (g *Gmail) reconcileLabels(ctx context.Context) error {
+	names, err := g.labelNames(ctx, false)
+	if err != nil {
+		return fmt.Errorf("could not list labels for reconciliation: %w", err)
+	}
+	current := make(map[string]struct{})
+	ids := make([]string, 0, len(names))
+	for id := range names {
+		current[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if known, ok := g.cache.GetKnownLabels(); ok {
+		gone := make(map[string]struct{})
+		for _, l := range known {
+			if _, ok := current[l]; !ok {
+				gone[l] = struct{}{}
+			}
+		}
+		if len(gone) > 0 {
+			lib.Infoln("Removing", len(gone), "deleted label(s) from cached messages")
+			// Collect IDs first; we can't rewrite while iterating the cache.
+			ms := make(chan string)
+			g.cache.GetMsgs(ms)
+			all := []string{}
+			for m := range ms {
+				all = append(all, m)
+			}
+			for _, m := range all {
+				old, _ := g.cache.GetMsgLabels(m)
+				nl := make([]string, 0, len(old))
+				for _, l := range old {
+					if _, ok := gone[l]; !ok {
+						nl = append(nl, l)
+					}
+				}
+				if len(nl) == len(old) {
+					continue
+				}
+				if g.dryRun {
+					g.plan(WRITE_LABELS, m)
+					continue
+				}
+				if err := g.writeLabels(ctx, m, nl, true); err != nil {
+					return err
+				}
+			}
 		}
 	}
-	return "", errors.New("label not found")
+	g.cache.SetKnownLabels(ids)
+	return nil
+}
+
+func (g *Gmail) handleNewMsg(ctx context.Context, id string) msgOp {
+	return g.handleMsg(ctx, msgOp{Id: id})
 }
 
-func (g *Gmail) handleNewMsg(id string) msgOp {
+// handleNewDraft is like handleNewMsg, but makes sure the message is labeled
+// as a draft.
+func (g *Gmail) handleNewDraft(ctx context.Context, id string) msgOp {
+	return g.handleMsg(ctx, msgOp{Id: id, Draft: true})
+}
+
+func (g *Gmail) handleMsg(ctx context.Context, o msgOp) msgOp {
+	id := o.Id
 	k, exists := g.cache.GetMsgKey(id)
-	o := msgOp{Id: id}
-	if !exists {
+	// A forced re-download replaces the stored copy as if it were new.
+	fetch := !exists || g.forceRedownload
+	haveMeta := false
+	if len(g.excludeIds) > 0 || !exists && !g.senders.empty() {
+		// Check for excluded labels and senders before downloading anything.
+		if err := g.getMetaData(ctx, &o); err != nil {
+			if e, ok := err.(*googleapi.Error); !ok || e.Code != 404 {
+				o.Error = err
+			}
+			return o
+		}
+		haveMeta = true
+		if g.excluded(o.Labels) {
+			if exists && !g.onlyNew {
+				o.Operation = DELETE
+			}
+			return o
+		}
+		if !exists && !g.senders.allows(o.From) {
+			return o
+		}
+	}
+	if fetch {
 		o.Operation = ADD
-		m, err := g.getBody(id)
+		m, meta, err := g.getBody(ctx, id)
 		if err != nil || m == nil {
 			if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
 				// XXX: 404 on a message add probably means it was deleted later. OK.
@@ -336,36 +1240,78 @@ func (g *Gmail) handleNewMsg(id string) msgOp {
 			return o
 		}
 		o.Msg = m
+		if !haveMeta {
+			g.setMetaData(&o, meta)
+			haveMeta = true
+		}
 	}
-	if err := g.getMetaData(&o); err != nil {
-		o.Error = err
-		return o
+	if !haveMeta {
+		if err := g.getMetaData(ctx, &o); err != nil {
+			o.Error = err
+			return o
+		}
 	}
-	if g.labelsChanged(id, o.Labels) && exists {
+	if g.labelsChanged(id, o.Labels) && !fetch {
 		// Have to fetch body.
+		o.Operation = WRITE_LABELS
 		m, c, err := g.getMaildirMessage(k)
-		if err != nil {
+		if errors.Is(err, lib.ErrAppendOnly) || errors.Is(err, maildir.ErrNotExist) {
+			// writeLabels just records the labels, or re-downloads the
+			// missing message.
+			return o
+		} else if err != nil {
 			o.Error = err
 			return o
 		}
 		defer c.Close()
 		o.Msg = m
-		o.Operation = WRITE_LABELS
-		o.Msg.Header[labelsHeader] = o.Labels
+		o.Msg.Header[labelsHeader] = g.keywordsHeader(ctx, o.Labels)
 	} else if o.Operation == ADD {
-		o.Msg.Header[labelsHeader] = o.Labels
+		classifyUnparsed(o.Msg, o.Labels)
+		o.Msg.Header[labelsHeader] = g.keywordsHeader(ctx, o.Labels)
 	}
 	return o
 }
 
+// shardFor returns the incremental sync shard, in [0, ConcurrentDownloads),
+// that handles message id. All operations on a message go through one shard,
+// in order. Thread IDs have the same form, and are sharded the same way by
+// listMsgs.
+func (g *Gmail) shardFor(id string) int {
+	if g.sharder != nil {
+		return g.sharder(id)
+	}
+	return shardForMsgId(id)
+}
+
+// Download buffer slots per worker: enough to keep workers busy through
+// bursts without holding many messages in memory.
+const bufferPerWorker = 16
+
+func defaultBufferSize(workers int) int {
+	return bufferPerWorker * workers
+}
+
+// messageBuffer returns the capacity of the download pipeline's channels.
+func (g *Gmail) messageBuffer() int {
+	if g.bufferSize > 0 {
+		return g.bufferSize
+	}
+	return defaultBufferSize(ConcurrentDownloads)
+}
+
 func shardForMsgId(id string) int {
 	shard, _ := strconv.ParseUint(id, 16, 64)
 	shard = shard % uint64(ConcurrentDownloads)
 	return int(shard)
 }
 
-func (g *Gmail) incremental(historyId uint64) error {
-	log.Println("Performing incremental sync.")
+func (g *Gmail) incremental(ctx context.Context, historyId uint64) error {
+	lib.Infoln("Performing incremental sync.")
+	g.phase = "incremental"
+	// Returning early stops the history reader and the workers.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	page := ""
 	// histEvents is an array of channels, where each channel receives a shard of
 	// history events. We can thus guarantee that all history events for a single
@@ -373,9 +1319,9 @@ func (g *Gmail) incremental(historyId uint64) error {
 	// mailbox operations will be enqueued into "ops" in order.
 	histEvents := make([]chan msgOp, ConcurrentDownloads)
 	for i := 0; i < len(histEvents); i++ {
-		histEvents[i] = make(chan msgOp, MessageBufferSize)
+		histEvents[i] = make(chan msgOp, g.messageBuffer())
 	}
-	ops := make(chan msgOp, MessageBufferSize)
+	ops := make(chan msgOp, g.messageBuffer())
 
 	// Process new messages. This spins off ConcurrentDownloads goroutines that
 	// download message bodies and labels.
@@ -394,9 +1340,16 @@ func (g *Gmail) incremental(historyId uint64) error {
 			defer wg.Done()
 			for op := range histEvents[idx] {
 				if op.Operation == ADD {
-					ops <- g.handleNewMsg(op.Id)
-				} else {
-					ops <- op
+					g.throttle.Acquire()
+					o := g.handleNewMsg(ctx, op.Id)
+					g.throttle.Release()
+					o.Record = op.Record
+					op = o
+				}
+				select {
+				case ops <- op:
+				case <-ctx.Done():
+					return
 				}
 			}
 		}()
@@ -407,95 +1360,255 @@ func (g *Gmail) incremental(historyId uint64) error {
 	}()
 
 	t := uint(0) // Total count, for progress reporting.
+	w := newHistoryWatermark()
 	go func() {
+		// Fetch the whole history window first, so that we can see which
+		// messages are deleted within it.
+		// Once it's done, the workers finish up and close ops.
+		defer func() {
+			for _, h := range histEvents {
+				close(h)
+			}
+		}()
+		hist := []*gmail.History{}
+		pages := 0
 		for true {
-			r, err := g.svc.GetHistory(historyId, g.labelId, page)
+			r, err := g.svc.GetHistory(ctx, historyId, g.labelId, g.historyTypes, page)
 			if e, ok := err.(*googleapi.Error); ok && e.Code == 404 && page == "" && historyId > 0 {
 				// Full sync required.
-				ops <- msgOp{Error: fullSyncRequired}
-				return
-			} else if err != nil {
-				ops <- msgOp{Error: err}
+				err = fullSyncRequired
+			}
+			if err != nil {
+				select {
+				case ops <- msgOp{Error: err}:
+				case <-ctx.Done():
+				}
 				return
 			}
 			page = r.NextPageToken
 			t += uint(len(r.History))
-			for _, m := range r.History {
-				if m.Id > historyId {
-					historyId = m.Id
-				}
-				// Enqueue adds.
-				for _, a := range m.MessagesAdded {
-					shard := shardForMsgId(a.Message.Id)
-					histEvents[shard] <- msgOp{Id: a.Message.Id, Operation: ADD, HistoryId: m.Id}
-				}
-				// Enqueue deletes.
-				for _, d := range m.MessagesDeleted {
-					shard := shardForMsgId(d.Message.Id)
-					histEvents[shard] <- msgOp{Id: d.Message.Id, Operation: DELETE, HistoryId: m.Id}
-				}
-				// Enqueue label changes. First we have to compute what the real labels are.
-				type lchange struct {
-					Added   []string
-					Removed []string
-				}
-				labels := make(map[string]lchange)
-				for _, l := range m.LabelsAdded {
-					if ls, ok := labels[l.Message.Id]; ok {
-						labels[l.Message.Id] = lchange{
-							Added:   append(ls.Added, l.LabelIds...),
-							Removed: ls.Removed}
-					} else {
-						labels[l.Message.Id] = lchange{Added: l.LabelIds, Removed: []string{}}
-					}
+			hist = append(hist, r.History...)
+			if page == "" {
+				break
+			}
+			// Guards against an endless (or enormous) history. The records
+			// so far are processed and checkpointed as usual, and the next
+			// run picks up after them.
+			if pages++; g.maxHistoryPages > 0 && pages >= g.maxHistoryPages {
+				log.Printf("Stopping after %d pages of history; run again to continue.", pages)
+				break
+			}
+		}
+		// Message IDs are never reused, so a message deleted anywhere in the
+		// window needn't be downloaded or relabeled first.
+		lw := newLabelWindow()
+		for _, m := range hist {
+			for _, d := range m.MessagesDeleted {
+				lw.deleted[d.Message.Id] = struct{}{}
+			}
+		}
+		for _, m := range hist {
+			if m.Id > historyId {
+				historyId = m.Id
+			}
+			w.start(m.Id)
+			enqueue := func(o msgOp) {
+				o.Record = m.Id
+				w.add(m.Id)
+				select {
+				case histEvents[g.shardFor(o.Id)] <- o:
+				case <-ctx.Done():
 				}
-				for _, l := range m.LabelsRemoved {
-					if ls, ok := labels[l.Message.Id]; ok {
-						labels[l.Message.Id] = lchange{
-							Added:   ls.Added,
-							Removed: append(ls.Removed, l.LabelIds...)}
-					} else {
-						labels[l.Message.Id] = lchange{Removed: l.LabelIds, Added: []string{}}
-					}
+			}
+			// Enqueue adds.
+			for _, a := range m.MessagesAdded {
+				if _, ok := lw.deleted[a.Message.Id]; ok {
+					continue
 				}
-				for id, changes := range labels {
-					newLabels := g.computeLabels(id, changes.Added, changes.Removed)
-					if g.labelsChanged(id, newLabels) {
-						shard := shardForMsgId(id)
-						histEvents[shard] <- msgOp{Id: id, Labels: newLabels, Operation: WRITE_LABELS, HistoryId: m.Id}
-					}
+				lw.added[a.Message.Id] = struct{}{}
+				enqueue(msgOp{Id: a.Message.Id, Operation: ADD, HistoryId: m.Id})
+			}
+			// Enqueue deletes, unless we never delete.
+			for _, d := range m.MessagesDeleted {
+				if g.onlyNew {
+					break
 				}
+				enqueue(msgOp{Id: d.Message.Id, Operation: DELETE, HistoryId: m.Id})
 			}
-			if page == "" {
+			// Enqueue label changes.
+			g.labelOps(m, lw, enqueue)
+			w.finish(m.Id)
+			if ctx.Err() != nil {
 				break
 			}
 		}
-		for _, h := range histEvents {
-			close(h)
-		}
 	}()
 	i := uint(0)
 	for o := range ops {
-		// Update progress bar.
-		if g.progress != nil {
-			g.progress <- lib.Progress{Current: i, Total: t}
-		}
+		// Update progress bar. The history delta says little about the size
+		// of the mailbox, so include the account's total.
+		g.refreshAccountTotal(ctx)
+		g.report(i, t)
 		i++
-		if o.Error != nil {
+		if o.Error == fullSyncRequired {
+			return o.Error
+		} else if o.Error != nil {
+			g.checkpoint(w, i)
 			return o.Error
 		}
-		if o.Operation == NONE {
-			continue
+		if o.Operation != NONE {
+			if err := g.writeOperation(ctx, o); err != nil {
+				g.checkpoint(w, i)
+				return err
+			}
 		}
-		if err := g.writeOperation(o); err != nil {
-			return err
+		w.applied(o.Record)
+		if i%uint(fullSyncCheckpointEvery) == 0 {
+			g.writeCheckpointFile(w.mark(), i)
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		// Canceled: workers may have dropped operations, so only record
+		// what was applied.
+		g.checkpoint(w, i)
+		return err
+	}
 	g.cache.SetHistoryIdx(historyId)
+	g.writeCheckpointFile(historyId, i)
 	return nil
 }
 
-func (g *Gmail) writeOperation(o msgOp) error {
+// checkpoint saves the history index up to which an interrupted incremental
+// sync applied every change, so the next run resumes without skipping any.
+func (g *Gmail) checkpoint(w *historyWatermark, handled uint) {
+	if h := w.mark(); h > 0 {
+		g.cache.SetHistoryIdx(h)
+		g.writeCheckpointFile(h, handled)
+	}
+}
+
+type labelChange struct {
+	Added   []string
+	Removed []string
+}
+
+// labelWindow tracks messages through the records of a history window, whose
+// operations only reach the cache once written, so that each record's label
+// changes apply on top of the earlier ones'.
+type labelWindow struct {
+	// Labels that the records so far leave each message they touched with.
+	labels map[string][]string
+	// Messages deleted anywhere in the window, and added by the records so
+	// far.
+	deleted map[string]struct{}
+	added   map[string]struct{}
+	// Scratch space, cleared and reused for each record.
+	changes map[string]labelChange
+}
+
+func newLabelWindow() *labelWindow {
+	return &labelWindow{
+		labels:  make(map[string][]string),
+		deleted: make(map[string]struct{}),
+		added:   make(map[string]struct{}),
+		changes: make(map[string]labelChange),
+	}
+}
+
+// labelOps calls emit with a WRITE_LABELS operation for each message whose
+// labels are changed by the history record h, given the records before it in
+// lw, which it updates. Messages deleted in the window are skipped, as are
+// those added in it, whose download already gets their current labels.
+func (g *Gmail) labelOps(h *gmail.History, lw *labelWindow, emit func(msgOp)) {
+	changes := lw.changes
+	clear(changes)
+	for _, l := range h.LabelsAdded {
+		c := changes[l.Message.Id]
+		c.Added = append(c.Added, l.LabelIds...)
+		changes[l.Message.Id] = c
+	}
+	for _, l := range h.LabelsRemoved {
+		c := changes[l.Message.Id]
+		c.Removed = append(c.Removed, l.LabelIds...)
+		changes[l.Message.Id] = c
+	}
+	for id, c := range changes {
+		if _, ok := lw.deleted[id]; ok {
+			continue
+		}
+		if _, ok := lw.added[id]; ok {
+			continue
+		}
+		old, known := lw.labels[id]
+		if !known {
+			old, known = g.cache.GetMsgLabels(id)
+		}
+		var ls []string
+		changed := true
+		if known {
+			ls, changed = applyLabels(old, c.Added, c.Removed)
+		} else {
+			// This shouldn't happen--there should always be a cache hit--but
+			// OK.
+			ls = append([]string{}, c.Added...)
+			sort.Strings(ls)
+		}
+		lw.labels[id] = ls
+		if len(g.excludeIds) > 0 {
+			if o, ok := g.exclusionOp(id, c, ls, h.Id); ok {
+				switch o.Operation {
+				case DELETE:
+					lw.deleted[id] = struct{}{}
+				case ADD:
+					lw.added[id] = struct{}{}
+				}
+				emit(o)
+				continue
+			}
+		}
+		if changed {
+			emit(msgOp{Id: id, Labels: ls, Operation: WRITE_LABELS, HistoryId: h.Id})
+		}
+	}
+}
+
+// excluded reports whether a message with labels is excluded from syncing.
+// Carrying any excluded label excludes it, whatever its other labels.
+func (g *Gmail) excluded(labels []string) bool {
+	for _, l := range labels {
+		if containsLabel(g.excludeIds, l) {
+			return true
+		}
+	}
+	return false
+}
+
+// exclusionOp returns the operation, if any, that label exclusion calls for
+// on label change c to message id, which leaves it with labels ls: deleting a
+// stored message that gains an excluded label, or adding an unknown message
+// that loses one. handleMsg makes the same decision for added messages, and
+// on full sync.
+func (g *Gmail) exclusionOp(id string, c labelChange, ls []string, historyId uint64) (msgOp, bool) {
+	if _, known := g.cache.GetMsgKey(id); known {
+		if !g.excluded(ls) {
+			return msgOp{}, false
+		} else if g.onlyNew {
+			return msgOp{Id: id, Operation: NONE}, true
+		}
+		return msgOp{Id: id, Operation: DELETE, HistoryId: historyId}, true
+	}
+	if g.excluded(c.Removed) {
+		// handleNewMsg checks that it's no longer excluded.
+		return msgOp{Id: id, Operation: ADD, HistoryId: historyId}, true
+	}
+	return msgOp{}, false
+}
+
+func (g *Gmail) writeOperation(ctx context.Context, o msgOp) error {
+	if g.dryRun {
+		g.plan(o.Operation, o.Id)
+		return nil
+	}
 	switch o.Operation {
 	case ADD:
 		if err := g.writeAdd(o); err != nil {
@@ -506,107 +1619,794 @@ func (g *Gmail) writeOperation(o msgOp) error {
 			return err
 		}
 	case WRITE_LABELS:
-		if err := g.writeLabels(o.Id, o.Labels); err != nil {
+		old, known := g.cache.GetMsgLabels(o.Id)
+		if err := g.writeLabels(ctx, o.Id, o.Labels, !o.LabelsOnly); err != nil {
 			return err
 		}
+		if known {
+			g.labelLog.Record(o.Id, o.HistoryId, old, o.Labels)
+		}
 	}
 	return nil
 }
 
-func (g *Gmail) full() error {
-	log.Println("Performing full sync.")
-	// XXX: -in:chats to skip chats that aren't MIME messages.
-	newMsgs := make(chan string, MessageBufferSize)
-	ops := make(chan msgOp, MessageBufferSize)
+// plan logs and counts an operation that a dry run would perform.
+func (g *Gmail) plan(op int32, id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch op {
+	case ADD:
+		g.planned.Adds++
+	case DELETE:
+		g.planned.Deletes++
+	case WRITE_LABELS:
+		g.planned.Relabels++
+	}
+	log.Printf("would %v %v", opNames[op], id)
+}
+
+// Planned returns the changes found by a dry run.
+func (g *Gmail) Planned() Planned {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.planned
+}
+
+// listMsgs lists every message on the server (subject to the label filter)
+// and runs handle on each of them in ConcurrentDownloads parallel workers,
+// returning a channel of the resulting operations. The progress total is
+// accumulated into t, and if seen is non-nil every listed ID is recorded in it
+// (it is safe to read once the returned channel is closed). With threadOrder,
+// each worker has its own queue, sharded by thread ID like incremental sync
+// shards by message ID, so a thread's messages are handled in listing order.
+// If prefetch is non-nil, each worker takes up to fetchBatch queued messages
+// at a time and passes them to prefetch before handling them one by one.
+// Once ctx is done, listing stops and operations may be dropped, so callers
+// must check ctx.Err() when the channel closes before trusting seen.
+func (g *Gmail) listMsgs(ctx context.Context, handle func(ctx context.Context, id string) msgOp, prefetch func(ctx context.Context, ids []string), seen map[string]struct{}, t *uint) <-chan msgOp {
+	queues := make([]chan listedMsg, 1)
+	if g.threadOrder {
+		queues = make([]chan listedMsg, ConcurrentDownloads)
+	}
+	buf := g.messageBuffer()
+	if prefetch != nil && buf < g.fetchBatch*ConcurrentDownloads/len(queues) {
+		// Enough for every worker to fill a batch.
+		buf = g.fetchBatch * ConcurrentDownloads / len(queues)
+	}
+	for i := range queues {
+		queues[i] = make(chan listedMsg, buf)
+	}
+	ops := make(chan msgOp, g.messageBuffer())
 	wg := sync.WaitGroup{}
 	for i := 0; i < ConcurrentDownloads; i++ {
 		wg.Add(1)
-		go func() {
+		go func(newMsgs <-chan listedMsg) {
 			defer wg.Done()
-			for id := range newMsgs {
-				ops <- g.handleNewMsg(id)
+			for m := range newMsgs {
+				batch := []listedMsg{m}
+				if prefetch != nil {
+					batch = takeBatch(newMsgs, batch, g.fetchBatch)
+					ids := make([]string, len(batch))
+					for i, m := range batch {
+						ids[i] = m.id
+					}
+					g.throttle.Acquire()
+					prefetch(ctx, ids)
+					g.throttle.Release()
+				}
+				for _, m := range batch {
+					// Hold a slot only while making requests, not while
+					// blocked on ops.
+					g.throttle.Acquire()
+					o := handle(ctx, m.id)
+					g.throttle.Release()
+					o.Seq = m.seq
+					select {
+					case ops <- o:
+					case <-ctx.Done():
+						return
+					}
+				}
 			}
-		}()
+		}(queues[i%len(queues)])
 	}
 	go func() {
 		wg.Wait()
 		close(ops)
 	}()
-	seen := make(map[string]struct{}) // Used to compute deletes.
-	t := uint(0)                      // Total count, for progress reporting.
 	go func() {
-		defer close(newMsgs)
+		defer func() {
+			for _, q := range queues {
+				close(q)
+			}
+		}()
 		page := ""
+		seq := uint64(0)
 		for true {
-			r, err := g.svc.GetMessages(g.labelId, page)
+			r, err := g.svc.GetMessages(ctx, g.labelId, BuildQuery(g.queryOptions()), page)
 			if err != nil {
-				ops <- msgOp{Error: err}
+				select {
+				case ops <- msgOp{Error: err}:
+				case <-ctx.Done():
+				}
 				return
 			}
 			page = r.NextPageToken
-			t += uint(r.ResultSizeEstimate)
+			g.setListPage(page)
+			if g.listTotal > 0 {
+				*t = g.listTotal
+			} else {
+				*t += uint(r.ResultSizeEstimate)
+			}
 			for _, m := range r.Messages {
-				newMsgs <- m.Id
-				seen[m.Id] = struct{}{}
+				q := queues[0]
+				if g.threadOrder {
+					q = queues[g.shardFor(m.ThreadId)]
+				}
+				seq++
+				select {
+				case q <- listedMsg{m.Id, seq}:
+				case <-ctx.Done():
+					return
+				}
+				if seen != nil {
+					seen[m.Id] = struct{}{}
+				}
 			}
 			if page == "" {
 				break
 			}
 		}
 	}()
+	return ops
+}
+
+// listedMsg is a message queued by listMsgs, with its position in the
+// listing.
+type listedMsg struct {
+	id  string
+	seq uint64
+}
+
+// takeBatch adds to batch whatever is already waiting in q, up to n messages
+// in all, without blocking.
+func takeBatch(q <-chan listedMsg, batch []listedMsg, n int) []listedMsg {
+	for len(batch) < n {
+		select {
+		case m, ok := <-q:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, m)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// inOrder passes on the operations from listMsgs in listing order, holding
+// back any whose messages were handled early. Errors from the listing itself
+// pass straight through.
+func inOrder(ctx context.Context, in <-chan msgOp) <-chan msgOp {
+	out := make(chan msgOp, cap(in))
+	go func() {
+		defer close(out)
+		send := func(o msgOp) bool {
+			select {
+			case out <- o:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		next := uint64(1)
+		held := make(map[uint64]msgOp)
+		for o := range in {
+			if o.Seq == 0 {
+				if !send(o) {
+					return
+				}
+				continue
+			}
+			held[o.Seq] = o
+			for o, ok := held[next]; ok; o, ok = held[next] {
+				delete(held, next)
+				next++
+				if !send(o) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// deleteMsgs deletes the given messages using ConcurrentDeletes workers. A
+// failure doesn't stop the other deletions: each is logged, and an error
+// counting them is returned once all have been tried. Transient filesystem
+// errors are already retried by the RetryStore, with --fs-retries.
+func (g *Gmail) deleteMsgs(ids []string) error {
+	if g.dryRun {
+		for _, id := range ids {
+			g.plan(DELETE, id)
+		}
+		return nil
+	}
+	work := make(chan string)
+	var mu sync.Mutex
+	failed := 0
+	var first error
+	wg := sync.WaitGroup{}
+	for i := 0; i < ConcurrentDeletes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				if err := g.writeDel(id); err != nil {
+					log.Println("could not delete message", id, err)
+					mu.Lock()
+					if failed++; first == nil {
+						first = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, id := range ids {
+		work <- id
+	}
+	close(work)
+	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("could not delete %d of %d messages (--reconcile-deletes retries them): %w", failed, len(ids), first)
+	}
+	return nil
+}
+
+// syncDrafts downloads the messages of any drafts not already listed in seen,
+// adding them to seen. Drafts are few, so this runs serially. It returns the
+// highest history ID encountered.
+func (g *Gmail) syncDrafts(ctx context.Context, seen map[string]struct{}) (uint64, error) {
 	historyId := uint64(0)
-	i := uint(0) // For updating progress bar.
+	page := ""
+	for true {
+		r, err := g.svc.GetDrafts(ctx, page)
+		if err != nil {
+			return historyId, err
+		}
+		for _, d := range r.Drafts {
+			if d.Message == nil {
+				continue
+			}
+			if _, ok := seen[d.Message.Id]; ok {
+				continue
+			}
+			seen[d.Message.Id] = struct{}{}
+			o := g.handleNewDraft(ctx, d.Message.Id)
+			if o.Error != nil {
+				return historyId, o.Error
+			}
+			if o.Operation == NONE {
+				continue
+			}
+			if o.HistoryId > historyId {
+				historyId = o.HistoryId
+			}
+			if err := g.writeOperation(ctx, o); err != nil {
+				return historyId, err
+			}
+		}
+		page = r.NextPageToken
+		if page == "" {
+			break
+		}
+	}
+	return historyId, nil
+}
+
+func (g *Gmail) full(ctx context.Context) error {
+	lib.Infoln("Performing full sync.")
+	g.phase = "full"
+	// Labels may have changed as much as the messages have: list them again.
+	g.cache.DelLabelMap()
+	g.mu.Lock()
+	g.labelDisplay, g.labelsRefreshed = nil, false
+	g.mu.Unlock()
+	// Returning early stops the listing and the workers.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// If an earlier full sync was interrupted, skip the messages it handled.
+	// The history index is then set to its checkpoint, so that incremental
+	// sync catches up on any changes to them since.
+	resumeIdx := g.cache.GetFullSyncIdx()
+	base := g.cache.GetHistoryIdx()
+	if resumeIdx > 0 && g.cache.GetFullSyncBase() != base {
+		// Syncs since have moved on, so its checkpoint is likely expired
+		// and the messages it handled may have changed.
+		lib.Infoln("Discarding the progress of a superseded full sync.")
+		g.cache.ClearFullSync()
+		resumeIdx = 0
+	}
+	if resumeIdx > 0 {
+		lib.Infoln("Resuming interrupted full sync.")
+	}
+	handle := func(ctx context.Context, id string) msgOp {
+		if g.cache.FullSyncDone(id) {
+			return msgOp{Id: id}
+		}
+		return g.handleNewMsg(ctx, id)
+	}
+	seen := make(map[string]struct{}) // Used to compute deletes.
+	t := uint(0)                      // Total count, for progress reporting.
+	// Only a listing of everything matches the mailbox size.
+	if g.label == "" && BuildQuery(g.queryOptions()) == BuildQuery(QueryOptions{}) && g.progress != nil {
+		g.listTotal = g.mailboxTotal(ctx)
+	}
+	var prefetch func(context.Context, []string)
+	if g.fetchBatch > 1 && g.fetchFormat != FullFormat && len(g.excludeIds) == 0 && g.senders.empty() {
+		prefetch = g.prefetch
+	}
+	ops := g.listMsgs(ctx, handle, prefetch, seen, &t)
+	if g.newestFirst {
+		ops = inOrder(ctx, ops)
+	}
+	// New messages are written in the background. With --disk-parallel, by
+	// as many workers as download, with the store limiting how many write at
+	// once; otherwise, and where order matters, by one.
+	writers := 1
+	if ConcurrentDiskWrites > 0 && !g.threadOrder && !g.newestFirst {
+		writers = ConcurrentDownloads
+	}
+	adds := g.startDeliveries(ctx, writers)
+	defer adds.stop()
+	historyId := uint64(0)
+	done := []string{} // Handled since the last checkpoint.
+	queued := 0        // Added since the last checkpoint, not yet in done.
+	i := uint(0)       // For updating progress bar.
+	checkpoint := func() error {
+		written, err := adds.flush()
+		done, queued = append(done, written...), 0
+		// Only the first checkpoint's history ID is kept: it's the earliest,
+		// so replaying from it misses the fewest changes.
+		if g.cache.GetFullSyncIdx() == 0 && historyId > 0 {
+			g.cache.SetFullSyncIdx(historyId, base)
+		}
+		g.cache.SetFullSyncDone(done)
+		done = done[:0]
+		g.writeCheckpointFile(g.cache.GetFullSyncIdx(), i)
+		return err
+	}
 	for o := range ops {
 		// Update progress bar.
-		if g.progress != nil {
-			g.progress <- lib.Progress{Current: i, Total: t}
-		}
+		g.report(i, t)
 		i++
 		if o.Error != nil {
+			checkpoint()
 			return o.Error
 		}
-		if o.Operation == NONE {
-			continue
+		if err := adds.failed(); err != nil {
+			checkpoint()
+			return err
 		}
-		if o.HistoryId > historyId {
+		if o.HistoryId > historyId && o.Operation != NONE {
 			historyId = o.HistoryId
 		}
-		if err := g.writeOperation(o); err != nil {
+		if o.Operation == ADD {
+			// Goes in done once written.
+			adds.queue(o)
+			queued++
+		} else if o.Operation != NONE {
+			if err := g.writeOperation(ctx, o); err != nil {
+				checkpoint()
+				return err
+			}
+			done = append(done, o.Id)
+		} else if _, cached := g.cache.GetMsgKey(o.Id); cached {
+			// Messages skipped without being stored, such as those the API
+			// returned no content for, are left for the next run to retry.
+			done = append(done, o.Id)
+		}
+		if len(done)+queued >= fullSyncCheckpointEvery {
+			if err := checkpoint(); err != nil {
+				return err
+			}
+		}
+	}
+	// Waits for the last messages to be written.
+	err := checkpoint()
+	if cerr := ctx.Err(); cerr != nil {
+		// Messages not yet listed may predate any history ID reached so far,
+		// so only the full sync checkpoint advances.
+		return cerr
+	} else if err != nil {
+		return err
+	}
+	if g.drafts {
+		if h, err := g.syncDrafts(ctx, seen); err != nil {
 			return err
+		} else if h > historyId {
+			historyId = h
 		}
 	}
+	if resumeIdx > 0 {
+		historyId = resumeIdx
+	}
+	// With --only-new, local messages missing from the server are kept, as
+	// are all of them if the listing left out some that still exist.
+	// The full sync replaces the old index, which may have expired, even
+	// if its messages' history IDs are all lower.
+	if g.onlyNew || g.queryOptions().narrows() {
+		g.cache.ResetHistoryIdx(historyId)
+		g.cache.ClearFullSync()
+		g.writeCheckpointFile(historyId, i)
+		return nil
+	}
+	// Everything else is synced even if some deletions failed, so record
+	// the history index anyway. The messages not deleted stay cached, for
+	// --reconcile-deletes or the next full sync to retry.
+	err = g.deleteUnseen(seen)
+	g.cache.ResetHistoryIdx(historyId)
+	g.cache.ClearFullSync()
+	g.writeCheckpointFile(historyId, i)
+	return err
+}
+
+// queryOptions returns the filters for listing messages.
+func (g *Gmail) queryOptions() QueryOptions {
+	return QueryOptions{
+		ExcludeLabels: g.excludeLabels,
+		Senders:       g.senders,
+		Since:         g.since,
+		Search:        g.search,
+		IncludeChats:  g.includeChats,
+	}
+}
+
+// deleteUnseen deletes every cached message not in seen, except those
+// received within keepRecent.
+func (g *Gmail) deleteUnseen(seen map[string]struct{}) error {
 	is := make(chan string)
 	g.cache.GetMsgs(is)
+	dels := []string{}
 	for i := range is {
 		if _, ok := seen[i]; !ok {
-			if err := g.writeDel(i); err != nil {
+			dels = append(dels, i)
+		}
+	}
+	if g.keepRecent > 0 {
+		cutoff := time.Now().Add(-g.keepRecent).UnixNano() / int64(time.Millisecond)
+		old := dels[:0]
+		for _, i := range dels {
+			// Dates are Gmail's internalDate, in milliseconds; messages
+			// cached before dates were kept have none, and aren't protected.
+			if _, d, ok := g.cache.GetMsgThread(i); ok && d > cutoff {
+				log.Println("not deleting recent message", i, "missing from the listing")
+				continue
+			}
+			old = append(old, i)
+		}
+		dels = old
+	}
+	return g.deleteMsgs(dels)
+}
+
+// ReconcileDeletes lists the messages on the server and deletes local
+// messages that are no longer there, as the last phase of a full sync does.
+// Nothing is downloaded or relabeled, and the history checkpoint is left
+// alone.
+func (g *Gmail) ReconcileDeletes(ctx context.Context, progress chan<- lib.Progress) error {
+	g.startProgress(progress)
+	defer g.finishProgress()
+	if g.queryOptions().narrows() {
+		return errors.New("can't reconcile deletes when the listing is narrowed by senders, date or search")
+	}
+	if err := g.resolveLabel(ctx); err != nil {
+		return err
+	}
+	lib.Infoln("Reconciling deletes.")
+	g.phase = "reconcile-deletes"
+	// Returning early stops the listing and the workers.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	seen := make(map[string]struct{})
+	t := uint(0)
+	i := uint(0)
+	// Only the listing matters; handle is a no-op.
+	for o := range g.listMsgs(ctx, func(_ context.Context, id string) msgOp { return msgOp{Id: id} }, nil, seen, &t) {
+		g.report(i, t)
+		i++
+		if o.Error != nil {
+			return o.Error
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if g.drafts {
+		page := ""
+		for true {
+			r, err := g.svc.GetDrafts(ctx, page)
+			if err != nil {
 				return err
 			}
+			for _, d := range r.Drafts {
+				if d.Message != nil {
+					seen[d.Message.Id] = struct{}{}
+				}
+			}
+			page = r.NextPageToken
+			if page == "" {
+				break
+			}
 		}
 	}
-	g.cache.SetHistoryIdx(historyId)
-	return nil
+	if err := g.deleteUnseen(seen); err != nil {
+		return err
+	}
+	return g.writeThreadIndex()
 }
 
-func (g *Gmail) Sync(full bool, progress chan<- lib.Progress) error {
+// startProgress sets the channel for progress updates, which may be nil.
+func (g *Gmail) startProgress(progress chan<- lib.Progress) {
 	g.progress = progress
-	if g.label != "" {
-		if l, err := g.labelToId(g.label); err != nil {
+	g.lastProgress = lib.Progress{}
+	g.phase = ""
+	atomic.StoreUint64(&g.added, 0)
+	atomic.StoreUint64(&g.deleted, 0)
+}
+
+// update returns a progress update with the current phase and counts.
+func (g *Gmail) update(current, total uint) lib.Progress {
+	return lib.Progress{
+		Current:      current,
+		Total:        total,
+		AccountTotal: g.accountTotal,
+		Phase:        g.phase,
+		Added:        uint(atomic.LoadUint64(&g.added)),
+		Deleted:      uint(atomic.LoadUint64(&g.deleted)),
+	}
+}
+
+// report sends a progress update, if anyone's listening.
+func (g *Gmail) report(current, total uint) {
+	if g.progress == nil {
+		return
+	}
+	g.lastProgress = g.update(current, total)
+	g.progress <- g.lastProgress
+}
+
+// refreshAccountTotal updates the account's message count for progress
+// reports, at most once per accountTotalTTL and only if anyone's listening.
+func (g *Gmail) refreshAccountTotal(ctx context.Context) {
+	if g.progress == nil || time.Since(g.accountTotalAt) < accountTotalTTL {
+		return
+	}
+	g.accountTotalAt = time.Now()
+	p, err := g.svc.GetProfile(ctx)
+	if err != nil {
+		log.Println("could not get account size:", err)
+		return
+	}
+	g.accountTotal = uint(p.MessagesTotal)
+}
+
+// mailboxTotal returns the number of messages a listing of the whole mailbox
+// finds: all of them but those in SPAM and TRASH, which listing skips. Chats
+// are skipped too but can't be counted, so this may overshoot a little. It
+// returns 0 if any of the counts is unavailable.
+func (g *Gmail) mailboxTotal(ctx context.Context) uint {
+	p, err := g.svc.GetProfile(ctx)
+	if err != nil {
+		log.Println("could not get account size:", err)
+		return 0
+	}
+	n := p.MessagesTotal
+	for _, l := range []string{"SPAM", "TRASH"} {
+		lbl, err := g.svc.GetLabel(ctx, l)
+		if err != nil {
+			log.Println("could not get size of label", l, err)
+			return 0
+		}
+		n -= lbl.MessagesTotal
+	}
+	if n <= 0 {
+		return 0
+	}
+	return uint(n)
+}
+
+// finishProgress sends a final, complete update and closes the progress
+// channel, so that readers can rely on seeing the end of every operation.
+func (g *Gmail) finishProgress() {
+	if g.progress == nil {
+		return
+	}
+	// Totals are often estimates; whatever they were, we're done.
+	t := g.lastProgress.Total
+	if t == 0 {
+		t = g.lastProgress.Current
+	}
+	g.progress <- g.update(t, t)
+	close(g.progress)
+	g.progress = nil
+}
+
+// resolveLabel looks up the IDs of the label filter and excluded labels, if
+// any.
+func (g *Gmail) resolveLabel(ctx context.Context) error {
+	g.excludeIds = g.excludeIds[:0]
+	for _, name := range g.excludeLabels {
+		l, err := g.labelToId(ctx, name)
+		if err != nil {
+			return err
+		}
+		g.excludeIds = append(g.excludeIds, l)
+	}
+	if g.label == "" {
+		return nil
+	}
+	l, err := g.labelToId(ctx, g.label)
+	if err != nil {
+		return err
+	}
+	g.labelId = l
+	// Only Labels.Get reports the number of messages in a label; it's exact,
+	// unlike the listing's ResultSizeEstimate, so prefer it for progress.
+	if lbl, err := g.svc.GetLabel(ctx, l); err != nil {
+		log.Println("could not get size of label", g.label, err)
+	} else {
+		g.listTotal = uint(lbl.MessagesTotal)
+	}
+	return nil
+}
+
+// Estimate returns the number and approximate total size in bytes of the
+// messages a full sync would download. Only message metadata is fetched.
+func (g *Gmail) Estimate(ctx context.Context, progress chan<- lib.Progress) (uint, int64, error) {
+	g.startProgress(progress)
+	defer g.finishProgress()
+	g.phase = "estimate"
+	if err := g.resolveLabel(ctx); err != nil {
+		return 0, 0, err
+	}
+	t := uint(0)
+	n := uint(0)
+	size := int64(0)
+	// Returning early stops the listing and the workers.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	meta := func(ctx context.Context, id string) msgOp {
+		o := msgOp{Id: id}
+		o.Error = g.getMetaData(ctx, &o)
+		return o
+	}
+	for o := range g.listMsgs(ctx, meta, nil, nil, &t) {
+		g.report(n, t)
+		if o.Error != nil {
+			return n, size, o.Error
+		} else if g.excluded(o.Labels) {
+			continue
+		}
+		n++
+		size += o.Size
+	}
+	return n, size, ctx.Err()
+}
+
+// Usage returns the number of Gmail API calls made so far and an estimate of
+// the quota units they consumed.
+func (g *Gmail) Usage() (calls, units uint) {
+	return g.stats.Calls(), g.stats.QuotaUnits()
+}
+
+// Counts returns the number of messages added to and deleted from the
+// Maildir by the last operation.
+func (g *Gmail) Counts() (added, deleted uint) {
+	return uint(atomic.LoadUint64(&g.added)), uint(atomic.LoadUint64(&g.deleted))
+}
+
+// Close closes the cache, waiting for any write in progress to commit and
+// releasing its lock for the next run. Later calls do nothing.
+func (g *Gmail) Close() {
+	g.cache.Cache.Close()
+}
+
+// handleRefreshMsg fetches only the metadata of a known message and returns a
+// WRITE_LABELS operation if its labels changed. It never downloads the body.
+func (g *Gmail) handleRefreshMsg(ctx context.Context, id string) msgOp {
+	o := msgOp{Id: id, LabelsOnly: true}
+	if _, ok := g.cache.GetMsgKey(id); !ok {
+		// Not yet downloaded; leave it to a regular sync.
+		return o
+	}
+	if err := g.getMetaData(ctx, &o); err != nil {
+		o.Error = err
+		return o
+	}
+	if g.labelsChanged(id, o.Labels) {
+		o.Operation = WRITE_LABELS
+	}
+	return o
+}
+
+// RefreshMetadata re-fetches the labels of every message on the server and
+// rewrites X-Keywords for those that changed, without re-downloading any
+// message bodies. Messages not yet in the cache are skipped.
+func (g *Gmail) RefreshMetadata(ctx context.Context, progress chan<- lib.Progress) error {
+	g.startProgress(progress)
+	defer g.finishProgress()
+	if err := g.resolveLabel(ctx); err != nil {
+		return err
+	}
+	lib.Infoln("Refreshing metadata.")
+	g.phase = "refresh-metadata"
+	// Returning early stops the listing and the workers.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t := uint(0)
+	i := uint(0)
+	for o := range g.listMsgs(ctx, g.handleRefreshMsg, nil, nil, &t) {
+		g.report(i, t)
+		i++
+		if o.Error != nil {
+			return o.Error
+		}
+		if o.Operation == NONE {
+			continue
+		}
+		if err := g.writeOperation(ctx, o); err != nil {
 			return err
-		} else {
-			g.labelId = l
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return g.writeThreadIndex()
+}
+
+func (g *Gmail) Sync(ctx context.Context, full bool, progress chan<- lib.Progress) error {
+	g.startProgress(progress)
+	defer g.finishProgress()
+	if err := g.resolveLabel(ctx); err != nil {
+		return err
+	}
+	if err := g.sync(ctx, full); err != nil {
+		return err
+	}
+	if err := g.reconcileLabels(ctx); err != nil {
+		return err
+	}
+	if g.dryRun {
+		return nil
+	}
+	return g.writeThreadIndex()
+}
+
+func (g *Gmail) sync(ctx context.Context, full bool) error {
 	// Get the cached history index.
-	if hidx := g.cache.GetHistoryIdx(); hidx > 0 && !full {
-		if err := g.incremental(hidx); err != nil {
-			if err == fullSyncRequired {
-				log.Println("History token expired--falling back to full sync")
-				return g.full()
+	hidx := g.cache.GetHistoryIdx()
+	if hidx > 0 && !full && !g.forceRedownload {
+		if err := g.incremental(ctx, hidx); err != nil {
+			if err == fullSyncRequired && g.incrementalOnly {
+				return fmt.Errorf("history index %d has expired: %w", hidx, ErrFullSyncNeeded)
+			} else if err == fullSyncRequired {
+				lib.Infoln("History token expired--falling back to full sync")
+				return g.full(ctx)
 			}
 			return err
 		}
+		// An interrupted full sync's checkpoint would only expire from here:
+		// a later one starts over.
+		if g.cache.GetFullSyncIdx() > 0 {
+			g.cache.ClearFullSync()
+		}
 		return nil
+	} else if hidx == 0 && g.incrementalOnly && !full {
+		return fmt.Errorf("no history index to sync from: %w", ErrFullSyncNeeded)
 	}
-	return g.full()
+	// A full sync asked for explicitly runs even in incremental-only mode.
+	return g.full(ctx)
 }
@@ -1,17 +1,39 @@
 package gmail
 
 import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"github.com/danmarg/outtake/lib"
 	"github.com/danmarg/outtake/lib/maildir"
+	"github.com/danmarg/outtake/lib/oauth"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"os"
 	"path"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func newTestCache() gmailCache {
@@ -54,47 +76,334 @@ func TestLabelsChanged(t *testing.T) {
 	}
 }
 
+func TestLabelsChangedLeavesSlices(t *testing.T) {
+	g := Gmail{cache: newTestCache()}
+	g.cache.SetMsgLabels("id", []string{"b", "a"})
+	ls := []string{"c", "b", "a"}
+	if !g.labelsChanged("id", ls) {
+		t.Error(`labelsChanged("id", {"c", "b", "a"}) = false, expected true`)
+	}
+	if g.labelsChanged("id", ls[1:]) {
+		t.Error(`labelsChanged("id", {"b", "a"}) = true, expected false`)
+	}
+	if strings.Join(ls, ",") != "c,b,a" {
+		t.Errorf(`labelsChanged() reordered its argument to %v, expected c,b,a`, ls)
+	}
+	if old, _ := g.cache.GetMsgLabels("id"); strings.Join(old, ",") != "b,a" {
+		t.Errorf(`GetMsgLabels("id") = %v after labelsChanged(), expected b,a`, old)
+	}
+}
+
+// referenceLabelOps is the original, map-based label computation from
+// incremental, kept to check labelOps against.
+func referenceLabelOps(g *Gmail, m *gmail.History, deleted map[string]struct{}) map[string][]string {
+	type lchange struct {
+		Added   []string
+		Removed []string
+	}
+	labels := make(map[string]lchange)
+	for _, l := range m.LabelsAdded {
+		if ls, ok := labels[l.Message.Id]; ok {
+			labels[l.Message.Id] = lchange{
+				Added:   append(ls.Added, l.LabelIds...),
+				Removed: ls.Removed}
+		} else {
+			labels[l.Message.Id] = lchange{Added: append([]string{}, l.LabelIds...), Removed: []string{}}
+		}
+	}
+	for _, l := range m.LabelsRemoved {
+		if ls, ok := labels[l.Message.Id]; ok {
+			labels[l.Message.Id] = lchange{
+				Added:   ls.Added,
+				Removed: append(ls.Removed, l.LabelIds...)}
+		} else {
+			labels[l.Message.Id] = lchange{Removed: l.LabelIds, Added: []string{}}
+		}
+	}
+	r := make(map[string][]string)
+	for id, changes := range labels {
+		if _, ok := deleted[id]; ok {
+			continue
+		}
+		var newLabels []string
+		if old, ok := g.cache.GetMsgLabels(id); ok {
+			nlabels := make(map[string]struct{})
+			for _, l := range old {
+				nlabels[l] = struct{}{}
+			}
+			for _, l := range changes.Added {
+				nlabels[l] = struct{}{}
+			}
+			for _, l := range changes.Removed {
+				delete(nlabels, l)
+			}
+			for l := range nlabels {
+				newLabels = append(newLabels, l)
+			}
+		} else {
+			newLabels = changes.Added
+		}
+		// labelOps returns labels sorted.
+		sort.Strings(newLabels)
+		if g.labelsChanged(id, newLabels) {
+			r[id] = newLabels
+		}
+	}
+	return r
+}
+
+// syntheticHistory returns n history records touching labels on msgs
+// messages, all but the last of which are cached with random labels.
+func syntheticHistory(g *Gmail, n, msgs int) []*gmail.History {
+	rnd := rand.New(rand.NewSource(1))
+	label := func() string { return fmt.Sprintf("Label_%d", rnd.Intn(12)) }
+	labels := func() []string {
+		ls := make([]string, rnd.Intn(4))
+		for i := range ls {
+			ls[i] = label()
+		}
+		return ls
+	}
+	for i := 0; i < msgs-1; i++ {
+		g.cache.SetMsgLabels(strconv.Itoa(i), labels())
+	}
+	hist := make([]*gmail.History, n)
+	for i := range hist {
+		h := &gmail.History{Id: uint64(i + 1)}
+		for j := 0; j < 20; j++ {
+			id := strconv.Itoa(rnd.Intn(msgs))
+			if rnd.Intn(2) == 0 {
+				h.LabelsAdded = append(h.LabelsAdded, &gmail.HistoryLabelAdded{Message: &gmail.Message{Id: id}, LabelIds: labels()})
+			} else {
+				h.LabelsRemoved = append(h.LabelsRemoved, &gmail.HistoryLabelRemoved{Message: &gmail.Message{Id: id}, LabelIds: labels()})
+			}
+		}
+		hist[i] = h
+	}
+	return hist
+}
+
+func TestLabelOpsMatchesReference(t *testing.T) {
+	g := &Gmail{cache: newTestCache()}
+	hist := syntheticHistory(g, 200, 50)
+	deleted := map[string]struct{}{"7": {}}
+	for _, h := range hist {
+		// Each record on its own, as the first of its window.
+		lw := newLabelWindow()
+		lw.deleted = deleted
+		want := referenceLabelOps(g, h, deleted)
+		got := make(map[string][]string)
+		g.labelOps(h, lw, func(o msgOp) {
+			if o.Operation != WRITE_LABELS || o.HistoryId != h.Id {
+				t.Errorf(`labelOps() emitted %+v, expected WRITE_LABELS at %v`, o, h.Id)
+			}
+			got[o.Id] = o.Labels
+		})
+		if len(got) != len(want) {
+			t.Fatalf(`labelOps(%v) changed %v, expected %v`, h.Id, got, want)
+		}
+		for id, ls := range want {
+			if strings.Join(got[id], ",") != strings.Join(ls, ",") {
+				t.Errorf(`labelOps(%v)[%v] = %v, expected %v`, h.Id, id, got[id], ls)
+			}
+		}
+	}
+}
+
+func TestLabelChangesInOneWindow(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	added := func(id string, h uint64, l string) *gmail.History {
+		return &gmail.History{Id: h, LabelsAdded: []*gmail.HistoryLabelAdded{
+			{Message: &gmail.Message{Id: id}, LabelIds: []string{l}}}}
+	}
+	// 0x1 gains two labels in turn, and 0x2 arrives and is then labeled.
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 3, LabelIds: []string{"INBOX", "L1", "L2"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 3, LabelIds: []string{"INBOX", "L2"}}
+	svc.History[""] = &gmail.ListHistoryResponse{History: []*gmail.History{
+		added("0x1", 2, "L1"),
+		{Id: 2, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "0x2"}}}},
+		added("0x1", 3, "L2"),
+		added("0x2", 3, "L2"),
+	}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	for id, want := range map[string]string{"0x1": "INBOX,L1,L2", "0x2": "INBOX,L2"} {
+		if ls, _ := c.cache.GetMsgLabels(id); strings.Join(ls, ",") != want {
+			t.Errorf(`GetMsgLabels(%q) = %v, expected %v`, id, ls, want)
+		}
+	}
+}
+
+func BenchmarkLabelOps(b *testing.B) {
+	g := &Gmail{cache: newTestCache()}
+	hist := syntheticHistory(g, 1000, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lw := newLabelWindow()
+		for _, h := range hist {
+			g.labelOps(h, lw, func(msgOp) {})
+		}
+	}
+}
+
+func BenchmarkReferenceLabelOps(b *testing.B) {
+	g := &Gmail{cache: newTestCache()}
+	hist := syntheticHistory(g, 1000, 1000)
+	deleted := map[string]struct{}{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, h := range hist {
+			referenceLabelOps(g, h, deleted)
+		}
+	}
+}
+
+func TestSetHistoryIdxNeverRegresses(t *testing.T) {
+	c := newTestCache()
+	c.SetHistoryIdx(10)
+	c.SetHistoryIdx(5)
+	if h := c.GetHistoryIdx(); h != 10 {
+		t.Errorf(`GetHistoryIdx() = %v after SetHistoryIdx(5), expected 10`, h)
+	}
+	c.SetHistoryIdx(12)
+	if h := c.GetHistoryIdx(); h != 12 {
+		t.Errorf(`GetHistoryIdx() = %v after SetHistoryIdx(12), expected 12`, h)
+	}
+}
+
 type testService struct {
 	gmailService
 	Msgs     map[string]string
 	Metadata map[string]*gmail.Message
 	Labels   *gmail.ListLabelsResponse
-	History  map[string]*gmail.ListHistoryResponse
-	Messages map[string]*gmail.ListMessagesResponse
+	// If set, returned by GetLabels.
+	LabelsErr error
+	History   map[string]*gmail.ListHistoryResponse
+	Messages  map[string]*gmail.ListMessagesResponse
+	Drafts    map[string]*gmail.ListDraftsResponse
+	// Number of GetRawMessage calls.
+	RawFetches int32
+	// Number of GetRawMessages calls.
+	BatchFetches int32
+	// Number of GetLabels calls.
+	LabelFetches int32
+	// History types passed to the last GetHistory call.
+	HistoryTypes []string
+	// Search query passed to the last GetMessages call.
+	Query string
+	// Returned by GetFullMessage.
+	Full map[string]*gmail.Message
+	// Returned by GetProfile, which counts its calls in ProfileFetches.
+	Profile        *gmail.Profile
+	ProfileFetches int
+}
+
+// GetRawMessage returns Msgs[id] with the labels and such of Metadata[id], if
+// any.
+func (s *testService) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	atomic.AddInt32(&s.RawFetches, 1)
+	return s.rawMessage(id)
+}
+
+// GetRawMessages is GetRawMessage for each of ids, with nil for those not
+// found.
+func (s *testService) GetRawMessages(ctx context.Context, ids []string) ([]*gmail.Message, error) {
+	atomic.AddInt32(&s.BatchFetches, 1)
+	ms := make([]*gmail.Message, len(ids))
+	for i, id := range ids {
+		ms[i], _ = s.rawMessage(id)
+	}
+	return ms, nil
+}
+
+func (s *testService) rawMessage(id string) (*gmail.Message, error) {
+	raw, ok := s.Msgs[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	m := gmail.Message{Id: id}
+	if meta, ok := s.Metadata[id]; ok {
+		m = *meta
+	}
+	m.Raw, m.Payload = raw, nil
+	return &m, nil
 }
 
-func (s *testService) GetRawMessage(id string) (string, error) {
-	if m, ok := s.Msgs[id]; ok {
+func (s *testService) GetFullMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	if m, ok := s.Full[id]; ok {
 		return m, nil
 	}
-	return "", errors.New("not found")
+	return nil, errors.New("not found")
 }
 
-func (s *testService) GetMetadata(id string) (*gmail.Message, error) {
+func (s *testService) GetMetadata(ctx context.Context, id string) (*gmail.Message, error) {
 	if m, ok := s.Metadata[id]; ok {
 		return m, nil
 	}
 	return nil, errors.New("not found")
 }
 
-func (s *testService) GetLabels() (*gmail.ListLabelsResponse, error) {
+func (s *testService) GetLabels(ctx context.Context) (*gmail.ListLabelsResponse, error) {
+	atomic.AddInt32(&s.LabelFetches, 1)
+	if s.LabelsErr != nil {
+		return nil, s.LabelsErr
+	}
 	return s.Labels, nil
 }
 
-func (s *testService) GetHistory(i uint64, label, page string) (*gmail.ListHistoryResponse, error) {
+func (s *testService) GetLabel(ctx context.Context, id string) (*gmail.Label, error) {
+	if s.Labels != nil {
+		for _, l := range s.Labels.Labels {
+			if l.Id == id {
+				return l, nil
+			}
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *testService) GetHistory(ctx context.Context, i uint64, label string, types []string, page string) (*gmail.ListHistoryResponse, error) {
+	s.HistoryTypes = types
 	if m, ok := s.History[page]; ok {
 		return m, nil
 	}
 	return nil, errors.New("not found")
 }
 
-func (s *testService) GetMessages(q, page string) (*gmail.ListMessagesResponse, error) {
+func (s *testService) GetMessages(ctx context.Context, labelId, q, page string) (*gmail.ListMessagesResponse, error) {
+	s.Query = q
 	if m, ok := s.Messages[page]; ok {
 		return m, nil
 	}
 	return nil, errors.New("not found")
 }
 
+func (s *testService) GetDrafts(ctx context.Context, page string) (*gmail.ListDraftsResponse, error) {
+	if d, ok := s.Drafts[page]; ok {
+		return d, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *testService) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	s.ProfileFetches++
+	if s.Profile != nil {
+		return s.Profile, nil
+	}
+	return nil, errors.New("not found")
+}
+
 func getTestClient() (*Gmail, *testService, string) {
 	d, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -113,6 +422,7 @@ func getTestClient() (*Gmail, *testService, string) {
 		Metadata: make(map[string]*gmail.Message),
 		Messages: make(map[string]*gmail.ListMessagesResponse),
 		History:  make(map[string]*gmail.ListHistoryResponse),
+		Drafts:   make(map[string]*gmail.ListDraftsResponse),
 	}
 	g := &Gmail{
 		dir:   md,
@@ -142,7 +452,7 @@ asdf`))
 	svc.Metadata["0x1"] = &gmail.Message{Id: "0x01", HistoryId: 1}
 	svc.Metadata["0x2"] = &gmail.Message{Id: "0x02", HistoryId: 2}
 	svc.Metadata["0x3"] = &gmail.Message{Id: "0x03", HistoryId: 3, LabelIds: []string{"LABEL_3"}}
-	err := c.Sync(false, nil)
+	err := c.Sync(context.Background(), false, nil)
 	if err != nil {
 		t.Errorf(`Sync(false, nil) = %v, expected nil`, err)
 	}
@@ -184,10 +494,10 @@ asdf`))
 		History: []*gmail.History{
 			{
 				Id:              1,
-				MessagesDeleted: []*gmail.HistoryMessageDeleted{{&gmail.Message{Id: "0x1"}}},
+				MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: "0x1"}}},
 				LabelsAdded:     []*gmail.HistoryLabelAdded{{LabelIds: []string{"LABEL_2"}, Message: &gmail.Message{Id: "0x2"}}},
 				LabelsRemoved:   []*gmail.HistoryLabelRemoved{{LabelIds: []string{"LABEL_3"}, Message: &gmail.Message{Id: "0x3"}}},
-				MessagesAdded:   []*gmail.HistoryMessageAdded{{&gmail.Message{Id: "0x4"}}},
+				MessagesAdded:   []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "0x4"}}},
 			},
 		},
 	}
@@ -195,7 +505,7 @@ asdf`))
 	svc.Msgs["0x4"] = m
 	// And metadata.
 	svc.Metadata["0x4"] = &gmail.Message{}
-	err = c.Sync(false, nil)
+	err = c.Sync(context.Background(), false, nil)
 	if err != nil {
 		t.Errorf(`Sync(false, nil) = %v, expected nil`, err)
 	}
@@ -250,3 +560,2405 @@ asdf`))
 		t.Errorf(`Expected %v to contain X-Keywords: LABEL_2`, string(bs))
 	}
 }
+
+func TestThreadIndex(t *testing.T) {
+	c, svc, dir := getTestClient()
+	c.threadIndex = path.Join(dir, "threads.json")
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"], svc.Msgs["0x3"] = m, m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}, {Id: "0x3"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, ThreadId: "t1", InternalDate: 300}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, ThreadId: "t1", InternalDate: 100}
+	svc.Metadata["0x3"] = &gmail.Message{HistoryId: 3, ThreadId: "t2", InternalDate: 200}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	readIndex := func() threadIndex {
+		idx := threadIndex{}
+		bs, err := ioutil.ReadFile(c.threadIndex)
+		if err != nil {
+			t.Fatalf(`ReadFile(%v) = %v, expected no error`, c.threadIndex, err)
+		}
+		if err := json.Unmarshal(bs, &idx); err != nil {
+			t.Fatalf(`Unmarshal(%v) = %v, expected no error`, string(bs), err)
+		}
+		return idx
+	}
+	key := func(id string) maildir.Key {
+		k, ok := c.cache.GetMsgKey(id)
+		if !ok {
+			t.Fatalf(`GetMsgKey(%v) == false, expected true`, id)
+		}
+		return k
+	}
+	expect := func(idx threadIndex, thread string, ids ...string) {
+		ks := idx[thread]
+		if len(ks) != len(ids) {
+			t.Fatalf(`index[%v] = %v, expected %v entries`, thread, ks, len(ids))
+		}
+		for i, id := range ids {
+			if ks[i] != key(id) {
+				t.Errorf(`index[%v][%v] = %v, expected key of %v`, thread, i, ks[i], id)
+			}
+		}
+	}
+	idx := readIndex()
+	if len(idx) != 2 {
+		t.Errorf(`index has %v threads, expected 2`, len(idx))
+	}
+	expect(idx, "t1", "0x2", "0x1")
+	expect(idx, "t2", "0x3")
+	// Incrementally add a message in the middle of t1.
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id:            4,
+			MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "0x4"}}},
+		}},
+	}
+	svc.Msgs["0x4"] = m
+	svc.Metadata["0x4"] = &gmail.Message{HistoryId: 4, ThreadId: "t1", InternalDate: 150}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	idx = readIndex()
+	expect(idx, "t1", "0x2", "0x4", "0x1")
+	expect(idx, "t2", "0x3")
+}
+
+func TestRefreshMetadata(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	k2, _ := c.cache.GetMsgKey("0x2")
+	// Relabel 0x1 on the server.
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 3, LabelIds: []string{"INBOX", "LABEL_9"}}
+	atomic.StoreInt32(&svc.RawFetches, 0)
+	if err := c.RefreshMetadata(context.Background(), nil); err != nil {
+		t.Fatalf(`RefreshMetadata(nil) = %v, expected nil`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 0 {
+		t.Errorf(`RefreshMetadata(nil) fetched %v bodies, expected 0`, n)
+	}
+	k, _ := c.cache.GetMsgKey("0x1")
+	f, err := c.dir.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) == %v, expected no error`, k, err)
+	}
+	bs, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf(`ReadFile(%v) == %v, expected no error`, f, err)
+	}
+	if !strings.Contains(string(bs), "X-Keywords: INBOX,LABEL_9") {
+		t.Errorf(`Expected %v to contain X-Keywords: INBOX,LABEL_9`, string(bs))
+	}
+	// 0x2 is unchanged, so it should not have been rewritten.
+	if k, _ := c.cache.GetMsgKey("0x2"); k != k2 {
+		t.Errorf(`GetMsgKey("0x2") = %v, expected unchanged %v`, k, k2)
+	}
+}
+
+func TestRefreshMetadataMissingFile(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	// Remove the message behind our back, and relabel it on the server.
+	k, _ := c.cache.GetMsgKey("0x1")
+	f, err := c.dir.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected no error`, k, err)
+	}
+	if err := os.Remove(f); err != nil {
+		panic(err)
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX", "LABEL_9"}}
+	atomic.StoreInt32(&svc.RawFetches, 0)
+	if err := c.RefreshMetadata(context.Background(), nil); err != nil {
+		t.Fatalf(`RefreshMetadata(nil) = %v, expected nil`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 0 {
+		t.Errorf(`RefreshMetadata(nil) fetched %v bodies, expected 0`, n)
+	}
+	if _, err := c.dir.GetFile(k); !errors.Is(err, maildir.ErrNotExist) {
+		t.Errorf(`GetFile(%v) = %v, expected ErrNotExist`, k, err)
+	}
+	if ls, _ := c.cache.GetMsgLabels("0x1"); len(ls) != 2 {
+		t.Errorf(`GetMsgLabels("0x1") = %v, expected [INBOX LABEL_9]`, ls)
+	}
+}
+
+func TestReconcileDeletes(t *testing.T) {
+	c, svc, dir := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"], svc.Msgs["0x3"] = m, m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	k2, _ := c.cache.GetMsgKey("0x2")
+	// On the server, 0x1 is deleted, 0x2 relabeled and 0x3 added.
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x2"}, {Id: "0x3"}},
+	}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 4, LabelIds: []string{"LABEL_9"}}
+	svc.Metadata["0x3"] = &gmail.Message{HistoryId: 3}
+	atomic.StoreInt32(&svc.RawFetches, 0)
+	if err := c.ReconcileDeletes(context.Background(), nil); err != nil {
+		t.Fatalf(`ReconcileDeletes(nil) = %v, expected nil`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 0 {
+		t.Errorf(`ReconcileDeletes(nil) fetched %v bodies, expected 0`, n)
+	}
+	if _, ok := c.cache.GetMsgKey("0x1"); ok {
+		t.Error(`GetMsgKey("0x1") == true, expected false`)
+	}
+	if _, ok := c.cache.GetMsgKey("0x3"); ok {
+		t.Error(`GetMsgKey("0x3") == true, expected false`)
+	}
+	if k, _ := c.cache.GetMsgKey("0x2"); k != k2 {
+		t.Errorf(`GetMsgKey("0x2") = %v, expected unchanged %v`, k, k2)
+	}
+	if ls, _ := c.cache.GetMsgLabels("0x2"); len(ls) != 1 || ls[0] != "INBOX" {
+		t.Errorf(`GetMsgLabels("0x2") = %v, expected [INBOX]`, ls)
+	}
+	if h := c.cache.GetHistoryIdx(); h != 2 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 2`, h)
+	}
+	if fs, _ := ioutil.ReadDir(dir + "/new"); len(fs) != 1 {
+		t.Errorf(`ReconcileDeletes() left %v messages, expected 1`, len(fs))
+	}
+}
+
+func TestLabelProgressTotal(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{
+		{Id: "Label_1", Name: "work", MessagesTotal: 42},
+	}}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages:           []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+		ResultSizeEstimate: 201,
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"Label_1"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"Label_1"}}
+	c.label = "work"
+	progress := make(chan lib.Progress, 10)
+	if err := c.Sync(context.Background(), true, progress); err != nil {
+		t.Fatalf(`Sync(true, progress) = %v, expected nil`, err)
+	}
+	n := 0
+	for p := range progress {
+		n++
+		if p.Total != 42 {
+			t.Errorf(`Progress.Total = %v, expected 42`, p.Total)
+		}
+	}
+	// Two messages, then the final update.
+	if n != 3 {
+		t.Errorf(`Sync() sent %v progress updates, expected 3`, n)
+	}
+}
+
+func TestMailboxProgressTotal(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{
+		{Id: "SPAM", Name: "SPAM", MessagesTotal: 7},
+		{Id: "TRASH", Name: "TRASH", MessagesTotal: 3},
+	}}
+	svc.Profile = &gmail.Profile{MessagesTotal: 60}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages:           []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+		ResultSizeEstimate: 201,
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2}
+	progress := make(chan lib.Progress, 10)
+	if err := c.Sync(context.Background(), true, progress); err != nil {
+		t.Fatalf(`Sync(true, progress) = %v, expected nil`, err)
+	}
+	totals := []uint{}
+	for p := range progress {
+		totals = append(totals, p.Total)
+	}
+	// 60 less spam and trash, for two messages and the final update.
+	if fmt.Sprint(totals) != "[50 50 50]" {
+		t.Errorf(`Progress.Total = %v, expected [50 50 50]`, totals)
+	}
+}
+
+func TestIncrementalAccountTotal(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 2}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 3}
+	svc.Profile = &gmail.Profile{MessagesTotal: 12345}
+	svc.History[""] = &gmail.ListHistoryResponse{History: []*gmail.History{
+		{Id: 2, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "0x1"}}}},
+		{Id: 3, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "0x2"}}}},
+	}}
+	c.cache.SetHistoryIdx(1)
+	progress := make(chan lib.Progress, 10)
+	if err := c.Sync(context.Background(), false, progress); err != nil {
+		t.Fatalf(`Sync(false, progress) = %v, expected nil`, err)
+	}
+	n := 0
+	for p := range progress {
+		n++
+		if p.AccountTotal != 12345 {
+			t.Errorf(`Progress.AccountTotal = %v, expected 12345`, p.AccountTotal)
+		}
+	}
+	if n == 0 {
+		t.Errorf(`Sync() sent no progress updates`)
+	}
+	// Within the TTL, the profile is fetched once.
+	if svc.ProfileFetches != 1 {
+		t.Errorf(`Sync() fetched the profile %v times, expected 1`, svc.ProfileFetches)
+	}
+}
+
+func TestEmptyRawSkipped(t *testing.T) {
+	c, svc, dir := getTestClient()
+	svc.Msgs["0x1"] = ""
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 1+emptyRawRetries {
+		t.Errorf(`Sync() fetched the message %v times, expected %v`, n, 1+emptyRawRetries)
+	}
+	if _, ok := c.cache.GetMsgKey("0x1"); ok {
+		t.Errorf(`GetMsgKey("0x1") = true, expected the empty message to be skipped`)
+	}
+	if fs, _ := ioutil.ReadDir(dir + "/new"); len(fs) != 0 {
+		t.Errorf(`Sync() delivered %v messages, expected 0`, len(fs))
+	}
+	// Once the API returns content, the message is delivered.
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if _, ok := c.cache.GetMsgKey("0x1"); !ok {
+		t.Errorf(`GetMsgKey("0x1") = false, expected the message to be delivered`)
+	}
+}
+
+func TestProgressClosed(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages:           []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+		ResultSizeEstimate: 5,
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2}
+	progress := make(chan lib.Progress)
+	updates := make(chan []lib.Progress)
+	go func() {
+		ps := []lib.Progress{}
+		for p := range progress {
+			ps = append(ps, p)
+		}
+		updates <- ps
+	}()
+	if err := c.Sync(context.Background(), true, progress); err != nil {
+		t.Fatalf(`Sync(true, progress) = %v, expected nil`, err)
+	}
+	select {
+	case ps := <-updates:
+		if len(ps) == 0 {
+			t.Fatalf(`Sync() sent no progress updates`)
+		}
+		if last := ps[len(ps)-1]; last.Current != last.Total || last.Total != 5 {
+			t.Errorf(`last Progress = %+v, expected 5 / 5`, last)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf(`Sync() didn't close the progress channel`)
+	}
+}
+
+func TestProgressPhaseAndCounts(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2}
+	last := func(full bool) lib.Progress {
+		progress := make(chan lib.Progress, 10)
+		if err := c.Sync(context.Background(), full, progress); err != nil {
+			t.Fatalf(`Sync(%v, progress) = %v, expected nil`, full, err)
+		}
+		var p lib.Progress
+		for p = range progress {
+		}
+		return p
+	}
+	if p := last(true); p.Phase != "full" || p.Added != 2 || p.Deleted != 0 {
+		t.Errorf(`last Progress = %+v, expected full with 2 added`, p)
+	}
+	svc.History[""] = &gmail.ListHistoryResponse{History: []*gmail.History{{
+		Id:              3,
+		MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: "0x1"}}},
+	}}}
+	// Counts start afresh.
+	if p := last(false); p.Phase != "incremental" || p.Added != 0 || p.Deleted != 1 {
+		t.Errorf(`last Progress = %+v, expected incremental with 1 deleted`, p)
+	}
+}
+
+func TestMaxHistoryPages(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.maxHistoryPages = 3
+	svc.Labels = &gmail.ListLabelsResponse{}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	c.cache.SetHistoryIdx(1)
+	// An endless history: every page points to another.
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("0x%d", i+1)
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{HistoryId: uint64(i + 2)}
+		page := fmt.Sprintf("p%d", i)
+		if i == 0 {
+			page = ""
+		}
+		svc.History[page] = &gmail.ListHistoryResponse{
+			History: []*gmail.History{{
+				Id:            uint64(i + 2),
+				MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: id}}},
+			}},
+			NextPageToken: fmt.Sprintf("p%d", i+1),
+		}
+	}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected a clean stop`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 3 {
+		t.Errorf(`RawFetches = %v, expected 3`, n)
+	}
+	// Checkpointed after the last processed page.
+	if i := c.cache.GetHistoryIdx(); i != 4 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 4`, i)
+	}
+}
+
+func TestIncrementalCheckpointsAppliedChanges(t *testing.T) {
+	c, svc, _ := getTestClient()
+	defer func(n int) { ConcurrentDownloads = n }(ConcurrentDownloads)
+	ConcurrentDownloads = 4
+	c.maxHistoryPages = 3
+	svc.Labels = &gmail.ListLabelsResponse{}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	c.cache.SetHistoryIdx(1)
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("0x%d", i+1)
+		// The second message can't be downloaded.
+		if i != 1 {
+			svc.Msgs[id] = m
+		}
+		svc.Metadata[id] = &gmail.Message{HistoryId: uint64(i + 2)}
+		page := fmt.Sprintf("p%d", i)
+		if i == 0 {
+			page = ""
+		}
+		svc.History[page] = &gmail.ListHistoryResponse{
+			History: []*gmail.History{{
+				Id:            uint64(i + 2),
+				MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: id}}},
+			}},
+			NextPageToken: fmt.Sprintf("p%d", i+1),
+		}
+	}
+	if err := c.Sync(context.Background(), false, nil); err == nil {
+		t.Fatalf(`Sync(false, nil) = nil, expected the download error`)
+	}
+	// Records after the failed one may have been applied, but the
+	// checkpoint can't pass it.
+	if i := c.cache.GetHistoryIdx(); i != 2 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 2, the last record before the failure`, i)
+	}
+}
+
+// cancelingService cancels the sync when asked for message id.
+type cancelingService struct {
+	*testService
+	id     string
+	cancel context.CancelFunc
+}
+
+func (s cancelingService) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	if id == s.id {
+		s.cancel()
+		return nil, ctx.Err()
+	}
+	return s.testService.GetRawMessage(ctx, id)
+}
+
+func TestIncrementalCanceled(t *testing.T) {
+	c, svc, d := getTestClient()
+	defer func(n int) { ConcurrentDownloads = n }(ConcurrentDownloads)
+	ConcurrentDownloads = 1
+	svc.Labels = &gmail.ListLabelsResponse{}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	c.cache.SetHistoryIdx(1)
+	hist := []*gmail.History{}
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("0x%d", i+1)
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{HistoryId: uint64(i + 2)}
+		hist = append(hist, &gmail.History{
+			Id:            uint64(i + 2),
+			MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: id}}},
+		})
+	}
+	svc.History[""] = &gmail.ListHistoryResponse{History: hist}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.svc = cancelingService{svc, "0x3", cancel}
+	if err := c.Sync(ctx, false, nil); err != context.Canceled {
+		t.Fatalf(`Sync(false, nil) = %v, expected %v`, err, context.Canceled)
+	}
+	// The next run resumes after the messages downloaded before the
+	// interruption.
+	if i := c.cache.GetHistoryIdx(); i != 3 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 3`, i)
+	}
+	for _, id := range []string{"0x1", "0x2"} {
+		if _, ok := c.cache.GetMsgKey(id); !ok {
+			t.Errorf(`GetMsgKey(%v) = _, false, expected it to be downloaded`, id)
+		}
+	}
+	// As after exiting: the progress is on disk, and the next run picks up
+	// from there.
+	c.Close()
+	cache, err := lib.NewBoltCache(d + "test_cache")
+	if err != nil {
+		t.Fatalf(`NewBoltCache() = %v, expected nil`, err)
+	}
+	c.cache = gmailCache{cache}
+	defer c.Close()
+	// The server lists history after the saved index.
+	svc.History[""] = &gmail.ListHistoryResponse{History: hist[2:]}
+	s := &fetchCountingService{testService: svc}
+	c.svc = s
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if f := strings.Join(s.fetched, ","); f != "0x3,0x4,0x5" {
+		t.Errorf(`Sync(false, nil) fetched %v, expected only 0x3,0x4,0x5`, f)
+	}
+	if i := c.cache.GetHistoryIdx(); i != 6 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 6`, i)
+	}
+}
+
+// fetchCountingService records the messages fetched in any format.
+type fetchCountingService struct {
+	*testService
+	fetched []string
+}
+
+func (s *fetchCountingService) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	s.fetched = append(s.fetched, id)
+	return s.testService.GetRawMessage(ctx, id)
+}
+
+func (s *fetchCountingService) GetMetadata(ctx context.Context, id string) (*gmail.Message, error) {
+	s.fetched = append(s.fetched, id)
+	return s.testService.GetMetadata(ctx, id)
+}
+
+func TestFullResumes(t *testing.T) {
+	c, svc, _ := getTestClient()
+	defer func(n int) { ConcurrentDownloads = n }(ConcurrentDownloads)
+	ConcurrentDownloads = 1
+	defer func(n int) { fullSyncCheckpointEvery = n }(fullSyncCheckpointEvery)
+	fullSyncCheckpointEvery = 3
+	svc.Labels = &gmail.ListLabelsResponse{}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	list := &gmail.ListMessagesResponse{}
+	for i := 1; i <= 10; i++ {
+		id := fmt.Sprintf("0x%x", i)
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{HistoryId: uint64(i + 1)}
+		list.Messages = append(list.Messages, &gmail.Message{Id: id})
+	}
+	svc.Messages[""] = list
+	// The API has no content for the second, and the sync dies on the eighth.
+	svc.Msgs["0x2"] = ""
+	delete(svc.Msgs, "0x8")
+	if err := c.Sync(context.Background(), false, nil); err == nil {
+		t.Fatalf(`Sync(false, nil) = nil, expected an error`)
+	}
+	if i := c.cache.GetHistoryIdx(); i != 0 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 0 until the full sync completes`, i)
+	}
+	// The first checkpoint, after 0x4: 0x2 wasn't stored, so isn't counted.
+	if i := c.cache.GetFullSyncIdx(); i != 5 {
+		t.Errorf(`GetFullSyncIdx() = %v, expected 5`, i)
+	}
+	svc.Msgs["0x2"], svc.Msgs["0x8"] = m, m
+	s := &fetchCountingService{testService: svc}
+	c.svc = s
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if f := strings.Join(s.fetched, ","); f != "0x2,0x8,0x9,0xa" {
+		t.Errorf(`Sync(false, nil) fetched %v, expected only 0x2,0x8,0x9,0xa`, f)
+	}
+	if i := c.cache.GetHistoryIdx(); i != 5 {
+		t.Errorf(`GetHistoryIdx() = %v, expected the checkpoint 5`, i)
+	}
+	if i := c.cache.GetFullSyncIdx(); i != 0 || c.cache.FullSyncDone("0x1") {
+		t.Errorf(`GetFullSyncIdx() = %v, expected the checkpoint to be cleared`, i)
+	}
+}
+
+func TestSupersededFullSyncDiscarded(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 6}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.History[""] = &gmail.ListHistoryResponse{}
+	// A --full run from history index 5 was interrupted.
+	c.cache.SetHistoryIdx(5)
+	c.cache.SetFullSyncIdx(3, 5)
+	c.cache.SetFullSyncDone([]string{"0x1"})
+	// An incremental sync succeeding drops its progress.
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if i := c.cache.GetFullSyncIdx(); i != 0 || c.cache.FullSyncDone("0x1") {
+		t.Errorf(`GetFullSyncIdx() = %v, expected the checkpoint to be cleared`, i)
+	}
+	// Progress left from before the history index last moved isn't resumed.
+	c.cache.SetFullSyncIdx(3, 4)
+	c.cache.SetFullSyncDone([]string{"0x1"})
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if _, ok := c.cache.GetMsgKey("0x1"); !ok {
+		t.Errorf(`GetMsgKey("0x1") = false, expected the message synced`)
+	}
+	if i := c.cache.GetHistoryIdx(); i != 6 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 6 rather than the old checkpoint`, i)
+	}
+}
+
+// slowDeliverStore records the most deliveries it has seen at once.
+type slowDeliverStore struct {
+	lib.Store
+	mu          sync.Mutex
+	active, max int
+}
+
+func (s *slowDeliverStore) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.max {
+		s.max = s.active
+	}
+	s.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	return s.Store.DeliverWithFlags(m, flags)
+}
+
+func TestDiskParallel(t *testing.T) {
+	c, svc, _ := getTestClient()
+	defer func(n int) { ConcurrentDiskWrites = n }(ConcurrentDiskWrites)
+	ConcurrentDiskWrites = 2
+	slow := &slowDeliverStore{Store: c.dir}
+	c.dir = lib.NewLimitStore(slow, ConcurrentDiskWrites)
+	svc.Labels = &gmail.ListLabelsResponse{}
+	list := &gmail.ListMessagesResponse{}
+	for i := 1; i <= 20; i++ {
+		id := fmt.Sprintf("0x%x", i)
+		svc.Msgs[id] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+		svc.Metadata[id] = &gmail.Message{HistoryId: uint64(i)}
+		list.Messages = append(list.Messages, &gmail.Message{Id: id})
+	}
+	svc.Messages[""] = list
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	// Deliveries overlap, but no more than the limit.
+	if slow.max != 2 {
+		t.Errorf(`Sync(true, nil) delivered %v messages at once, expected 2`, slow.max)
+	}
+	for _, m := range list.Messages {
+		if _, ok := c.cache.GetMsgKey(m.Id); !ok {
+			t.Errorf(`GetMsgKey(%v) = false, expected the message stored`, m.Id)
+		}
+	}
+	if i := c.cache.GetHistoryIdx(); i != 20 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 20`, i)
+	}
+}
+
+// expiredHistoryService fails GetHistory as for an expired history index,
+// and counts listings, which only a full sync makes.
+type expiredHistoryService struct {
+	*testService
+	listings int
+}
+
+func (s *expiredHistoryService) GetHistory(ctx context.Context, i uint64, label string, types []string, page string) (*gmail.ListHistoryResponse, error) {
+	return nil, &googleapi.Error{Code: 404, Message: "Requested entity was not found."}
+}
+
+func (s *expiredHistoryService) GetMessages(ctx context.Context, labelId, q, page string) (*gmail.ListMessagesResponse, error) {
+	s.listings++
+	return s.testService.GetMessages(ctx, labelId, q, page)
+}
+
+func TestIncrementalOnly(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.incrementalOnly = true
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 2}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	s := &expiredHistoryService{testService: svc}
+	c.svc = s
+	// Without a history index, only an explicit full sync runs.
+	if err := c.Sync(context.Background(), false, nil); !errors.Is(err, ErrFullSyncNeeded) {
+		t.Errorf(`Sync(false, nil) = %v, expected ErrFullSyncNeeded`, err)
+	}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	// The history index has expired.
+	s.listings = 0
+	if err := c.Sync(context.Background(), false, nil); !errors.Is(err, ErrFullSyncNeeded) {
+		t.Errorf(`Sync(false, nil) = %v, expected ErrFullSyncNeeded`, err)
+	}
+	if s.listings != 0 {
+		t.Errorf(`Sync(false, nil) listed messages %v times, expected no full sync`, s.listings)
+	}
+	if i := c.cache.GetHistoryIdx(); i != 2 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 2 to be kept`, i)
+	}
+	// Otherwise, sync falls back to a full sync.
+	c.incrementalOnly = false
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Errorf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if s.listings != 1 {
+		t.Errorf(`Sync(false, nil) listed messages %v times, expected a full sync`, s.listings)
+	}
+}
+
+func TestFullSyncReplacesExpiredHistoryIdx(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 2}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	c.svc = &expiredHistoryService{testService: svc}
+	// The index has expired, and is higher than any surviving message's,
+	// as when the last records were deletions.
+	c.cache.SetHistoryIdx(100)
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if i := c.cache.GetHistoryIdx(); i != 2 {
+		t.Errorf(`GetHistoryIdx() = %v, expected the full sync's 2`, i)
+	}
+}
+
+// waitForGoroutines waits for the number of goroutines to drop to n,
+// returning it if it doesn't within a second.
+func waitForGoroutines(n int) int {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if m := runtime.NumGoroutine(); m <= n {
+			return m
+		}
+	}
+	return runtime.NumGoroutine()
+}
+
+func TestIncrementalStopsWorkers(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	c.bufferSize = 1
+	before := runtime.NumGoroutine()
+	// The history index has expired.
+	c.svc = &expiredHistoryService{testService: svc}
+	if err := c.incremental(context.Background(), 2); err != fullSyncRequired {
+		t.Errorf(`incremental() = %v, expected fullSyncRequired`, err)
+	}
+	if n := waitForGoroutines(before); n > before {
+		t.Errorf(`incremental() left %v goroutines running, expected %v`, n, before)
+	}
+	// Downloading the first message fails, with more queued behind it.
+	c.svc = svc
+	h := &gmail.History{Id: 3}
+	for i := 1; i <= 4*ConcurrentDownloads; i++ {
+		id := fmt.Sprintf("0x%x", i)
+		h.MessagesAdded = append(h.MessagesAdded, &gmail.HistoryMessageAdded{Message: &gmail.Message{Id: id}})
+	}
+	svc.History[""] = &gmail.ListHistoryResponse{History: []*gmail.History{h}}
+	if err := c.incremental(context.Background(), 2); err == nil {
+		t.Errorf(`incremental() = nil, expected an error`)
+	}
+	if n := waitForGoroutines(before); n > before {
+		t.Errorf(`incremental() left %v goroutines running, expected %v`, n, before)
+	}
+}
+
+func TestForceRedownload(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 2}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	old, _ := c.cache.GetMsgKey("0x1")
+	f, err := c.dir.GetFile(old)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected nil`, old, err)
+	}
+	// The stored copy goes bad.
+	if err := ioutil.WriteFile(f, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.forceRedownload = true
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 2 {
+		t.Errorf(`Sync(false, nil) made %v fetches in all, expected 0x1 fetched again`, n)
+	}
+	k, _ := c.cache.GetMsgKey("0x1")
+	if k == old {
+		t.Fatalf(`GetMsgKey(0x1) = %v, expected a new key`, k)
+	}
+	if _, err := c.dir.GetFile(old); err == nil {
+		t.Errorf(`GetFile(%v) = nil, expected the replaced copy to be deleted`, old)
+	}
+	f, err = c.dir.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected nil`, k, err)
+	}
+	if bs, _ := ioutil.ReadFile(f); !strings.Contains(string(bs), "Subject: hi") {
+		t.Errorf(`re-downloaded message = %v, expected the message from the server`, string(bs))
+	}
+}
+
+func TestCheckpointFile(t *testing.T) {
+	c, svc, dir := getTestClient()
+	defer func(n int) { ConcurrentDownloads = n }(ConcurrentDownloads)
+	ConcurrentDownloads = 1
+	defer func(n int) { fullSyncCheckpointEvery = n }(fullSyncCheckpointEvery)
+	fullSyncCheckpointEvery = 3
+	c.checkpointFile = path.Join(dir, "checkpoint.json")
+	svc.Labels = &gmail.ListLabelsResponse{}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	first, second := &gmail.ListMessagesResponse{NextPageToken: "p2"}, &gmail.ListMessagesResponse{}
+	for i := 1; i <= 10; i++ {
+		id := fmt.Sprintf("0x%x", i)
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{HistoryId: uint64(i + 1)}
+		if i <= 5 {
+			first.Messages = append(first.Messages, &gmail.Message{Id: id})
+		} else {
+			second.Messages = append(second.Messages, &gmail.Message{Id: id})
+		}
+	}
+	svc.Messages[""], svc.Messages["p2"] = first, second
+	// Read the file on each progress update.
+	progress := make(chan lib.Progress)
+	seen := []Checkpoint{}
+	done := make(chan struct{})
+	go func() {
+		for range progress {
+			if bs, err := ioutil.ReadFile(c.checkpointFile); err == nil {
+				cp := Checkpoint{}
+				json.Unmarshal(bs, &cp)
+				seen = append(seen, cp)
+			}
+		}
+		close(done)
+	}()
+	err := c.Sync(context.Background(), false, progress)
+	<-done
+	if err != nil {
+		t.Fatalf(`Sync(false, progress) = %v, expected nil`, err)
+	}
+	if len(seen) == 0 {
+		t.Fatalf(`checkpoint file not written during sync, expected a write every 3 messages`)
+	}
+	last := uint(0)
+	for _, cp := range seen {
+		if cp.Phase != "full" || cp.Handled < last || cp.Handled > 10 {
+			t.Errorf(`checkpoint during sync = %+v, expected full sync progress past %v`, cp, last)
+		}
+		// The first checkpoint, after 0x3, until the sync completes.
+		if cp.Handled < 10 && cp.HistoryId != 4 {
+			t.Errorf(`checkpoint during sync = %+v, expected history ID 4`, cp)
+		}
+		last = cp.Handled
+	}
+	if len(seen) < 3 {
+		t.Errorf(`checkpoint file read %v times during sync, expected updates after 3, 6 and 9 messages`, len(seen))
+	}
+	bs, err := ioutil.ReadFile(c.checkpointFile)
+	if err != nil {
+		t.Fatalf(`ReadFile(%v) = %v, expected nil`, c.checkpointFile, err)
+	}
+	cp := Checkpoint{}
+	if err := json.Unmarshal(bs, &cp); err != nil {
+		t.Fatalf(`Unmarshal(%v) = %v, expected nil`, string(bs), err)
+	}
+	if cp.Phase != "full" || cp.HistoryId != 11 || cp.Handled != 10 || cp.Added != 10 || cp.PageToken != "" {
+		t.Errorf(`final checkpoint = %+v, expected history ID 11 after 10 messages added`, cp)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	for _, id := range []string{"0x1", "0x2", "0x3"} {
+		svc.Msgs[id] = m
+	}
+	c.cache.SetMsgKey("0x1", "k")
+	// 0x1 is already stored and 0x4 doesn't exist.
+	c.prefetch(context.Background(), []string{"0x1", "0x2", "0x3", "0x4"})
+	if n := atomic.LoadInt32(&svc.BatchFetches); n != 1 {
+		t.Fatalf(`prefetch() made %v batch fetches, expected 1`, n)
+	}
+	for _, id := range []string{"0x2", "0x3"} {
+		if _, _, err := c.getBody(context.Background(), id); err != nil {
+			t.Errorf(`getBody(%v) = %v, expected nil`, id, err)
+		}
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 0 {
+		t.Errorf(`getBody() made %v single fetches, expected 0 after prefetch()`, n)
+	}
+	// Taken once, then fetched again.
+	c.getBody(context.Background(), "0x2")
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 1 {
+		t.Errorf(`getBody() made %v single fetches, expected 1`, n)
+	}
+	// A single new message isn't worth a batch.
+	c.prefetch(context.Background(), []string{"0x1", "0x3"})
+	if n := atomic.LoadInt32(&svc.BatchFetches); n != 1 {
+		t.Errorf(`prefetch() made %v batch fetches, expected still 1`, n)
+	}
+}
+
+func TestTakeBatch(t *testing.T) {
+	q := make(chan listedMsg, 5)
+	for i := 0; i < 4; i++ {
+		q <- listedMsg{id: fmt.Sprint(i)}
+	}
+	if b := takeBatch(q, []listedMsg{{id: "x"}}, 3); len(b) != 3 || b[0].id != "x" || b[2].id != "1" {
+		t.Errorf(`takeBatch() = %v, expected x, 0 and 1`, b)
+	}
+	close(q)
+	if b := takeBatch(q, nil, 3); len(b) != 2 {
+		t.Errorf(`takeBatch() = %v, expected the remaining 2`, b)
+	}
+}
+
+func TestFullFetchBatch(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.fetchBatch = 4
+	svc.Labels = &gmail.ListLabelsResponse{}
+	list := &gmail.ListMessagesResponse{}
+	for i := 1; i <= 10; i++ {
+		id := fmt.Sprintf("0x%x", i)
+		svc.Msgs[id] = base64.URLEncoding.EncodeToString([]byte("Subject: " + id + "\n\nbody"))
+		svc.Metadata[id] = &gmail.Message{HistoryId: 2}
+		list.Messages = append(list.Messages, &gmail.Message{Id: id})
+	}
+	svc.Messages[""] = list
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	for _, x := range list.Messages {
+		k, ok := c.cache.GetMsgKey(x.Id)
+		if !ok {
+			t.Fatalf(`GetMsgKey(%v) = _, false, expected true`, x.Id)
+		}
+		m, cl, err := c.getMaildirMessage(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := m.Header.Get("Subject"); s != x.Id {
+			t.Errorf(`Subject of %v = %v, expected %v`, x.Id, s, x.Id)
+		}
+		cl.Close()
+	}
+}
+
+func TestHistoryWatermark(t *testing.T) {
+	w := newHistoryWatermark()
+	for _, id := range []uint64{2, 3, 4} {
+		w.start(id)
+		w.add(id)
+		w.finish(id)
+	}
+	w.applied(3)
+	if h := w.mark(); h != 0 {
+		t.Errorf(`mark() = %v with record 2 outstanding, expected 0`, h)
+	}
+	w.applied(2)
+	if h := w.mark(); h != 3 {
+		t.Errorf(`mark() = %v, expected 3`, h)
+	}
+	// A record with no operations is done once finished.
+	w.start(5)
+	w.applied(4)
+	if h := w.mark(); h != 4 {
+		t.Errorf(`mark() = %v with record 5 still being enqueued, expected 4`, h)
+	}
+	w.finish(5)
+	if h := w.mark(); h != 5 {
+		t.Errorf(`mark() = %v, expected 5`, h)
+	}
+}
+
+func TestHistoryTypes(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.historyTypes = []string{"messageAdded"}
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.History[""] = &gmail.ListHistoryResponse{}
+	c.cache.SetHistoryIdx(1)
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if len(svc.HistoryTypes) != 1 || svc.HistoryTypes[0] != "messageAdded" {
+		t.Errorf(`GetHistory() got types %v, expected [messageAdded]`, svc.HistoryTypes)
+	}
+}
+
+func testOAuthConfig() *oauth2.Config {
+	cfg, err := oauthConfig(Options{})
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+func TestOAuthConfig(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	f := path.Join(d, "client.json")
+	if err := ioutil.WriteFile(f, []byte(`{"installed": {"client_id": "file-id", "client_secret": "file-secret"}}`), 0600); err != nil {
+		panic(err)
+	}
+	for _, x := range []struct {
+		opts       Options
+		id, secret string
+	}{
+		{Options{}, oauth.ClientId, oauth.Secret},
+		{Options{OAuthClientID: "id", OAuthClientSecret: "secret"}, "id", "secret"},
+		{Options{OAuthClientFile: f}, "file-id", "file-secret"},
+		{Options{OAuthClientFile: f, OAuthClientID: "id", OAuthClientSecret: "secret"}, "id", "secret"},
+	} {
+		cfg, err := oauthConfig(x.opts)
+		if err != nil || cfg.ClientID != x.id || cfg.ClientSecret != x.secret {
+			t.Errorf(`oauthConfig(%+v) = %+v, %v, expected client %v`, x.opts, cfg, err, x.id)
+		}
+	}
+	if _, err := oauthConfig(Options{OAuthClientID: "id"}); err == nil {
+		t.Errorf(`oauthConfig() with no secret = nil, expected an error`)
+	}
+	if cfg, err := oauthConfig(Options{OAuthPort: 8085}); err != nil || cfg.RedirectURL != "http://localhost:8085" {
+		t.Errorf(`oauthConfig() with a port = %+v, %v, expected redirect URL http://localhost:8085`, cfg, err)
+	}
+	if cfg, _ := oauthConfig(Options{}); cfg.RedirectURL != "" {
+		t.Errorf(`oauthConfig() = %+v, expected no redirect URL`, cfg)
+	}
+	if _, err := oauthConfig(Options{OAuthPort: 70000}); err == nil {
+		t.Errorf(`oauthConfig() with port 70000 = nil, expected an error`)
+	}
+}
+
+func TestOAuthClientChanged(t *testing.T) {
+	launched := 0
+	getOAuthToken = func(ctx context.Context, cfg *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+		launched++
+		return &oauth2.Token{AccessToken: "new", RefreshToken: "refresh"}, nil
+	}
+	defer func() { getOAuthToken = oauth.GetOAuthClient }()
+	g := &Gmail{cache: newTestCache()}
+	// A token from before client IDs were recorded is for the built-in one.
+	g.cache.SetOauthToken(&oauth2.Token{AccessToken: "old", RefreshToken: "refresh"})
+	if _, err := newOAuthClient(context.Background(), g, testOAuthConfig()); err != nil || launched != 0 {
+		t.Errorf(`newOAuthClient() = %v, launched %v times, expected the cached token to be used`, err, launched)
+	}
+	cfg, _ := oauthConfig(Options{OAuthClientID: "mine", OAuthClientSecret: "secret"})
+	for i := 0; i < 2; i++ {
+		if _, err := newOAuthClient(context.Background(), g, cfg); err != nil || launched != 1 {
+			t.Errorf(`newOAuthClient() with another client = %v, launched %v times, expected 1`, err, launched)
+		}
+	}
+	if id := g.cache.GetOauthClientId(); id != "mine" {
+		t.Errorf(`GetOauthClientId() = %v, expected mine`, id)
+	}
+}
+
+func TestOAuthTokenFromEnv(t *testing.T) {
+	g := &Gmail{cache: newTestCache()}
+	want := &oauth2.Token{AccessToken: "env-token", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}
+	bs, err := json.Marshal(want)
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(tokenEnv, base64.StdEncoding.EncodeToString(bs))
+	defer os.Unsetenv(tokenEnv)
+	launched := false
+	getOAuthToken = func(context.Context, *oauth2.Config, ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+		launched = true
+		return nil, errors.New("unexpected browser flow")
+	}
+	defer func() { getOAuthToken = oauth.GetOAuthClient }()
+	clt, err := newOAuthClient(context.Background(), g, testOAuthConfig())
+	if err != nil {
+		t.Fatalf(`newOAuthClient() = %v, expected no error`, err)
+	}
+	if launched {
+		t.Errorf(`newOAuthClient() launched the browser flow, expected env token to be used`)
+	}
+	tr, ok := clt.Transport.(*oauth2.Transport)
+	if !ok {
+		t.Fatalf(`newOAuthClient() transport = %T, expected *oauth2.Transport`, clt.Transport)
+	}
+	if tok, err := tr.Source.Token(); err != nil || tok.AccessToken != want.AccessToken {
+		t.Errorf(`Token() = %v, %v, expected %v`, tok, err, want.AccessToken)
+	}
+	if _, ok := g.cache.GetOauthToken(); ok {
+		t.Errorf(`GetOauthToken() = true, expected env token not to be cached`)
+	}
+}
+
+func TestOAuthMissingRefreshToken(t *testing.T) {
+	var authURL string
+	getOAuthToken = func(ctx context.Context, cfg *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+		authURL = cfg.AuthCodeURL("state", opts...)
+		return &oauth2.Token{AccessToken: "new", RefreshToken: "refresh"}, nil
+	}
+	defer func() { getOAuthToken = oauth.GetOAuthClient }()
+	g := &Gmail{cache: newTestCache()}
+	g.cache.SetOauthToken(&oauth2.Token{AccessToken: "old"})
+	if _, err := newOAuthClient(context.Background(), g, testOAuthConfig()); err != nil {
+		t.Fatalf(`newOAuthClient() = %v, expected no error`, err)
+	}
+	for _, p := range []string{"access_type=offline", "prompt=consent"} {
+		if !strings.Contains(authURL, p) {
+			t.Errorf(`auth URL = %v, expected it to contain %v`, authURL, p)
+		}
+	}
+	if tok, _ := g.cache.GetOauthToken(); tok.RefreshToken != "refresh" {
+		t.Errorf(`GetOauthToken() = %+v, expected the new token to be cached`, tok)
+	}
+
+	// A complete token is used as is.
+	authURL = ""
+	if _, err := newOAuthClient(context.Background(), g, testOAuthConfig()); err != nil || authURL != "" {
+		t.Errorf(`newOAuthClient() = %v, auth URL %q, expected the cached token to be used`, err, authURL)
+	}
+}
+
+func TestServiceAccountClient(t *testing.T) {
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	// The token endpoint checks the JWT assertion's claims.
+	var claims struct {
+		Scope string `json:"scope"`
+		Sub   string `json:"sub"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) == 3 {
+			if bs, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+				json.Unmarshal(bs, &claims)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "tok", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer srv.Close()
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	f := path.Join(d, "sa.json")
+	bs, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "sa@project.iam.gserviceaccount.com",
+		"private_key":  string(pemKey),
+		"token_uri":    srv.URL,
+	})
+	if err := ioutil.WriteFile(f, bs, 0600); err != nil {
+		panic(err)
+	}
+	getOAuthToken = func(context.Context, *oauth2.Config, ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+		return nil, errors.New("unexpected browser flow")
+	}
+	defer func() { getOAuthToken = oauth.GetOAuthClient }()
+	g := &Gmail{cache: newTestCache()}
+	clt, err := newClient(context.Background(), g, Options{ServiceAccountJSONFile: f, ToImpersonate: "user@example.com"})
+	if err != nil {
+		t.Fatalf(`newClient() = %v, expected no error`, err)
+	}
+	tr, ok := clt.Transport.(*oauth2.Transport)
+	if !ok {
+		t.Fatalf(`newClient() transport = %T, expected *oauth2.Transport`, clt.Transport)
+	}
+	if _, err := tr.Source.Token(); err != nil {
+		t.Fatalf(`Token() = %v, expected no error`, err)
+	}
+	if claims.Scope != gmail.GmailReadonlyScope || claims.Sub != "user@example.com" {
+		t.Errorf(`JWT claims = %+v, expected scope %v and subject user@example.com`, claims, gmail.GmailReadonlyScope)
+	}
+	if _, ok := g.cache.GetOauthToken(); ok {
+		t.Errorf(`GetOauthToken() = true, expected the OAuth cache to be unused`)
+	}
+}
+
+func TestADCClient(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	f := path.Join(d, "application_default_credentials.json")
+	if err := ioutil.WriteFile(f, []byte(`{
+		"type": "authorized_user",
+		"client_id": "id.apps.googleusercontent.com",
+		"client_secret": "secret",
+		"refresh_token": "refresh"
+	}`), 0600); err != nil {
+		panic(err)
+	}
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", f)
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+	found := false
+	findDefaultCredentials = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		found = true
+		return google.FindDefaultCredentials(ctx, scopes...)
+	}
+	defer func() { findDefaultCredentials = google.FindDefaultCredentials }()
+	getOAuthToken = func(context.Context, *oauth2.Config, ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+		return nil, errors.New("unexpected browser flow")
+	}
+	defer func() { getOAuthToken = oauth.GetOAuthClient }()
+	g := &Gmail{cache: newTestCache()}
+	clt, err := newClient(context.Background(), g, Options{})
+	if err != nil {
+		t.Fatalf(`newClient() = %v, expected no error`, err)
+	}
+	if !found {
+		t.Errorf(`newClient() didn't use application default credentials`)
+	}
+	if _, ok := clt.Transport.(*oauth2.Transport); !ok {
+		t.Errorf(`newClient() transport = %T, expected *oauth2.Transport`, clt.Transport)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.svc = &countingService{svc, &c.stats, nil}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "L1", Name: "work"}}}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2}
+	c.label = "work"
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	// labels.list: 2 calls * 1 unit (label lookup and reconciliation),
+	// labels.get: 1 * 1 (label size), messages.list: 1 * 5,
+	// messages.get: 2 raw * 5, which bring the labels along.
+	if calls, units := c.Usage(); calls != 6 || units != 18 {
+		t.Errorf(`Usage() = %v, %v, expected 6, 18`, calls, units)
+	}
+}
+
+func TestLabelToIdNotFound(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{
+		{Id: "L2", Name: "Work"},
+		{Id: "L1", Name: "Receipts"},
+	}}
+	_, err := c.labelToId(context.Background(), "Wrok")
+	if err == nil {
+		t.Fatalf(`labelToId("Wrok") = nil, expected error`)
+	}
+	if !strings.Contains(err.Error(), "Receipts, Work") {
+		t.Errorf(`labelToId("Wrok") = %v, expected it to list available labels`, err)
+	}
+	if id, err := c.labelToId(context.Background(), "Work"); err != nil || id != "L2" {
+		t.Errorf(`labelToId("Work") = %v, %v, expected L2`, id, err)
+	}
+}
+
+func TestLabelToIdCached(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "L1", Name: "Work"}}}
+	for i := 0; i < 2; i++ {
+		if id, err := c.labelToId(context.Background(), "Work"); err != nil || id != "L1" {
+			t.Errorf(`labelToId("Work") = %v, %v, expected L1`, id, err)
+		}
+	}
+	if n := atomic.LoadInt32(&svc.LabelFetches); n != 1 {
+		t.Errorf(`labelToId() listed labels %v times, expected 1`, n)
+	}
+	if m, _, ok := c.cache.GetLabelMap(); !ok || m["L1"] != "Work" {
+		t.Errorf(`GetLabelMap() = %v, %v, expected L1: Work`, m, ok)
+	}
+	// A label created since is missing from the cache.
+	svc.Labels.Labels = append(svc.Labels.Labels, &gmail.Label{Id: "L2", Name: "New"})
+	if id, err := c.labelToId(context.Background(), "New"); err != nil || id != "L2" {
+		t.Errorf(`labelToId("New") = %v, %v, expected L2`, id, err)
+	}
+	if n := atomic.LoadInt32(&svc.LabelFetches); n != 2 {
+		t.Errorf(`labelToId() listed labels %v times, expected 2 after a miss`, n)
+	}
+	// Once stale, the list is fetched again.
+	defer func(d time.Duration) { labelMapTTL = d }(labelMapTTL)
+	labelMapTTL = 0
+	c.labelToId(context.Background(), "Work")
+	if n := atomic.LoadInt32(&svc.LabelFetches); n != 3 {
+		t.Errorf(`labelToId() listed labels %v times, expected 3 once stale`, n)
+	}
+}
+
+func TestLabelToIdServiceError(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.LabelsErr = errors.New("backend unavailable")
+	_, err := c.labelToId(context.Background(), "Work")
+	if !errors.Is(err, svc.LabelsErr) {
+		t.Errorf(`labelToId("Work") = %v, expected it to wrap %v`, err, svc.LabelsErr)
+	}
+	if strings.Contains(err.Error(), "not found") {
+		t.Errorf(`labelToId("Work") = %v, expected a service error, not "not found"`, err)
+	}
+}
+
+func TestKeepRecent(t *testing.T) {
+	c, svc, dir := getTestClient()
+	c.keepRecent = 7 * 24 * time.Hour
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	old := time.Now().Add(-30*24*time.Hour).UnixNano() / int64(time.Millisecond)
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, ThreadId: "t1", InternalDate: old}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, ThreadId: "t2", InternalDate: now}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	// Both vanish from the listing, but only the old one is deleted.
+	svc.Messages[""] = &gmail.ListMessagesResponse{}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if _, ok := c.cache.GetMsgKey("0x1"); ok {
+		t.Error(`GetMsgKey("0x1") == true, expected false`)
+	}
+	if _, ok := c.cache.GetMsgKey("0x2"); !ok {
+		t.Error(`GetMsgKey("0x2") == false, expected true`)
+	}
+	if fs, _ := ioutil.ReadDir(dir + "/new"); len(fs) != 1 {
+		t.Errorf(`Sync(true, nil) left %v messages, expected 1`, len(fs))
+	}
+}
+
+func TestDeletedLabelReconciliation(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "INBOX"}, {Id: "Label_7"}}}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX", "Label_7"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	k2, _ := c.cache.GetMsgKey("0x2")
+	// Delete Label_7 without any history events.
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "INBOX"}}}
+	svc.History[""] = &gmail.ListHistoryResponse{}
+	// Within labelMapTTL, the cached list is used, and still has it.
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if n := atomic.LoadInt32(&svc.LabelFetches); n != 1 {
+		t.Errorf(`Sync(false, nil) listed labels %v times, expected 1`, n)
+	}
+	if ls, _ := c.cache.GetMsgLabels("0x1"); len(ls) != 2 {
+		t.Errorf(`GetMsgLabels("0x1") = %v, expected Label_7 until the list is stale`, ls)
+	}
+	defer func(d time.Duration) { labelMapTTL = d }(labelMapTTL)
+	labelMapTTL = 0
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	k, _ := c.cache.GetMsgKey("0x1")
+	f, err := c.dir.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) == %v, expected no error`, k, err)
+	}
+	bs, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf(`ReadFile(%v) == %v, expected no error`, f, err)
+	}
+	if strings.Contains(string(bs), "Label_7") {
+		t.Errorf(`Expected %v to not contain Label_7`, string(bs))
+	}
+	if ls, _ := c.cache.GetMsgLabels("0x1"); len(ls) != 1 || ls[0] != "INBOX" {
+		t.Errorf(`GetMsgLabels("0x1") = %v, expected {"INBOX"}`, ls)
+	}
+	// 0x2 never had the label and should not have been rewritten.
+	if k, _ := c.cache.GetMsgKey("0x2"); k != k2 {
+		t.Errorf(`GetMsgKey("0x2") = %v, expected unchanged %v`, k, k2)
+	}
+	// A full sync lists the labels again, however fresh the cached list.
+	labelMapTTL = time.Hour
+	svc.Metadata["0x1"].LabelIds = []string{"INBOX"}
+	n := atomic.LoadInt32(&svc.LabelFetches)
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if m := atomic.LoadInt32(&svc.LabelFetches); m != n+1 {
+		t.Errorf(`Sync(true, nil) listed labels %v times, expected 1`, m-n)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	c, svc, dir := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages:      []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+		NextPageToken: "p2",
+	}
+	svc.Messages["p2"] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x3"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{SizeEstimate: 100}
+	svc.Metadata["0x2"] = &gmail.Message{SizeEstimate: 2000}
+	svc.Metadata["0x3"] = &gmail.Message{SizeEstimate: 30000}
+	n, size, err := c.Estimate(context.Background(), nil)
+	if err != nil {
+		t.Fatalf(`Estimate(nil) = %v, expected nil`, err)
+	}
+	if n != 3 || size != 32100 {
+		t.Errorf(`Estimate(nil) = %v, %v, expected 3, 32100`, n, size)
+	}
+	if f := atomic.LoadInt32(&svc.RawFetches); f != 0 {
+		t.Errorf(`Estimate(nil) fetched %v bodies, expected 0`, f)
+	}
+	if fs, _ := ioutil.ReadDir(dir + "/new"); len(fs) != 0 {
+		t.Errorf(`Estimate(nil) wrote %v messages, expected 0`, len(fs))
+	}
+}
+
+func TestParallelDeletes(t *testing.T) {
+	defer func(n int) { ConcurrentDeletes = n }(ConcurrentDeletes)
+	ConcurrentDeletes = 8
+	c, svc, dir := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	list := &gmail.ListMessagesResponse{}
+	for i := 0; i < 50; i++ {
+		id := strconv.FormatInt(int64(i+1), 16)
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{HistoryId: uint64(i + 1), ThreadId: "t1"}
+		list.Messages = append(list.Messages, &gmail.Message{Id: id})
+	}
+	svc.Messages[""] = list
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	// Everything disappears from the server.
+	svc.Messages[""] = &gmail.ListMessagesResponse{}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if fs, _ := ioutil.ReadDir(dir + "/new"); len(fs) != 0 {
+		t.Errorf(`Sync(true, nil) left %v messages, expected 0`, len(fs))
+	}
+	ms := make(chan string)
+	c.cache.GetMsgs(ms)
+	n := 0
+	for range ms {
+		n++
+	}
+	if n != 0 {
+		t.Errorf(`GetMsgs() returned %v messages, expected 0`, n)
+	}
+	if ms := c.cache.GetThreadMsgs("t1"); len(ms) != 0 {
+		t.Errorf(`GetThreadMsgs("t1") = %v, expected none`, ms)
+	}
+}
+
+// flakyDeleteStore fails deletions of each key in fails that many times, or
+// forever if negative.
+type flakyDeleteStore struct {
+	lib.Store
+	mu    sync.Mutex
+	fails map[maildir.Key]int
+}
+
+func (s *flakyDeleteStore) Delete(k maildir.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := s.fails[k]; n != 0 {
+		s.fails[k] = n - 1
+		return &os.PathError{Op: "unlink", Path: string(k), Err: syscall.EIO}
+	}
+	return s.Store.Delete(k)
+}
+
+func TestDeleteFailuresDontStopSync(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	list := &gmail.ListMessagesResponse{}
+	for i := 1; i <= 10; i++ {
+		id := strconv.FormatInt(int64(i), 16)
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{HistoryId: uint64(i)}
+		list.Messages = append(list.Messages, &gmail.Message{Id: id})
+	}
+	svc.Messages[""] = list
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	k1, _ := c.cache.GetMsgKey("1")
+	k2, _ := c.cache.GetMsgKey("2")
+	// Deleting 1 fails once, which is retried; deleting 2 always fails.
+	c.dir = lib.RetryStore{Store: &flakyDeleteStore{Store: c.dir, fails: map[maildir.Key]int{k1: 1, k2: -1}}, Retries: 2}
+	// Everything but message a, now relabeled, disappears from the server.
+	svc.Metadata["a"] = &gmail.Message{HistoryId: 20, LabelIds: []string{"Work"}}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "a"}}}
+	err := c.Sync(context.Background(), true, nil)
+	if err == nil || !strings.Contains(err.Error(), "could not delete 1 of 9 messages") {
+		t.Fatalf(`Sync(true, nil) = %v, expected 1 failed deletion`, err)
+	}
+	ms := make(chan string)
+	c.cache.GetMsgs(ms)
+	left := []string{}
+	for m := range ms {
+		left = append(left, m)
+	}
+	sort.Strings(left)
+	if strings.Join(left, ",") != "2,a" {
+		t.Errorf(`GetMsgs() = %v, expected the undeletable message 2 and a`, left)
+	}
+	if i := c.cache.GetHistoryIdx(); i != 20 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 20`, i)
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.drafts = true
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0xd"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Drafts[""] = &gmail.ListDraftsResponse{Drafts: []*gmail.Draft{
+		// Already listed as a message; should not be fetched twice.
+		{Id: "r1", Message: &gmail.Message{Id: "0x1"}},
+		{Id: "r2", Message: &gmail.Message{Id: "0xd"}},
+	}}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	svc.Metadata["0xd"] = &gmail.Message{HistoryId: 2}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 2 {
+		t.Errorf(`Sync(false, nil) fetched %v bodies, expected 2`, n)
+	}
+	k, ok := c.cache.GetMsgKey("0xd")
+	if !ok {
+		t.Fatalf(`GetMsgKey("0xd") == false, expected true`)
+	}
+	if ls, _ := c.cache.GetMsgLabels("0xd"); len(ls) != 1 || ls[0] != "DRAFT" {
+		t.Errorf(`GetMsgLabels("0xd") = %v, expected {"DRAFT"}`, ls)
+	}
+	f, err := c.dir.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) == %v, expected no error`, k, err)
+	}
+	bs, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf(`ReadFile(%v) == %v, expected no error`, f, err)
+	}
+	if !strings.Contains(string(bs), "X-Keywords: Drafts") {
+		t.Errorf(`Expected %v to contain X-Keywords: Drafts`, string(bs))
+	}
+	if ls, _ := c.cache.GetMsgLabels("0x1"); len(ls) != 0 {
+		t.Errorf(`GetMsgLabels("0x1") = %v, expected no labels`, ls)
+	}
+}
+
+func TestIncrementalAddThenDelete(t *testing.T) {
+	c, svc, dir := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	c.cache.SetHistoryIdx(1)
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id:            2,
+			MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "0x5"}}},
+			LabelsAdded:   []*gmail.HistoryLabelAdded{{LabelIds: []string{"INBOX"}, Message: &gmail.Message{Id: "0x5"}}},
+		}},
+		NextPageToken: "p2",
+	}
+	svc.History["p2"] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id:              3,
+			MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: "0x5"}}},
+		}},
+	}
+	// The body is still fetchable, but it shouldn't be fetched.
+	svc.Msgs["0x5"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Metadata["0x5"] = &gmail.Message{HistoryId: 2}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 0 {
+		t.Errorf(`Sync(false, nil) fetched %v bodies, expected 0`, n)
+	}
+	if fs, _ := ioutil.ReadDir(dir + "/new"); len(fs) != 0 {
+		t.Errorf(`Sync(false, nil) wrote %v messages, expected 0`, len(fs))
+	}
+	if i := c.cache.GetHistoryIdx(); i != 3 {
+		t.Errorf(`GetHistoryIdx() == %v, expected 3`, i)
+	}
+}
+
+func TestReadStateFlags(t *testing.T) {
+	c, svc, dir := getTestClient()
+	c.readState = true
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX", "UNREAD"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	k1, _ := c.cache.GetMsgKey("0x1")
+	if f, err := c.dir.GetFile(k1); err != nil || f != path.Join(dir, "new", string(k1)) {
+		t.Errorf(`GetFile(%v) = %v, %v, expected unread message in new/`, k1, f, err)
+	}
+	k2, _ := c.cache.GetMsgKey("0x2")
+	if f, err := c.dir.GetFile(k2); err != nil || f != path.Join(dir, "cur", string(k2)+":2,S") {
+		t.Errorf(`GetFile(%v) = %v, %v, expected read message in cur/ with S`, k2, f, err)
+	}
+}
+
+func TestReadStateOnLabelChange(t *testing.T) {
+	c, svc, dir := getTestClient()
+	c.readState = true
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX", "UNREAD"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	// Reading the message in Gmail shows up as a label change.
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id: 2,
+			LabelsRemoved: []*gmail.HistoryLabelRemoved{{
+				Message:  &gmail.Message{Id: "0x1"},
+				LabelIds: []string{"UNREAD"},
+			}},
+		}},
+	}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	k, _ := c.cache.GetMsgKey("0x1")
+	if f, err := c.dir.GetFile(k); err != nil || f != path.Join(dir, "cur", string(k)+":2,S") {
+		t.Errorf(`GetFile(%v) = %v, %v, expected read message in cur/ with S`, k, f, err)
+	}
+}
+
+func TestMarkAllRead(t *testing.T) {
+	c, svc, dir := getTestClient()
+	c.markAllRead = true
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX", "UNREAD"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	for _, id := range []string{"0x1", "0x2"} {
+		k, _ := c.cache.GetMsgKey(id)
+		if f, err := c.dir.GetFile(k); err != nil || f != path.Join(dir, "cur", string(k)+":2,S") {
+			t.Errorf(`GetFile(%v) = %v, %v, expected message in cur/ with S`, k, f, err)
+		}
+	}
+}
+
+func TestOnDeliver(t *testing.T) {
+	c, svc, dir := getTestClient()
+	got := map[string][]string{}
+	c.onDeliver = func(id, f string) {
+		got[id] = append(got[id], f)
+	}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	// Relabeling writes a new file, which is passed too.
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"Work"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	for id, n := range map[string]int{"0x1": 1, "0x2": 2} {
+		k, _ := c.cache.GetMsgKey(id)
+		want := path.Join(dir, "new", string(k))
+		if len(got[id]) != n || got[id][n-1] != want {
+			t.Errorf(`onDeliver(%v) got %v, expected %v calls ending with %v`, id, got[id], n, want)
+		}
+	}
+}
+
+func TestExcludeLabels(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.excludeLabels = []string{"Lists"}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"], svc.Msgs["0x3"] = m, m, m
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "Label_1", Name: "Lists"}}}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}, {Id: "0x3"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	// Excluded despite also being in the inbox.
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX", "Label_1"}}
+	svc.Metadata["0x3"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 2 {
+		t.Errorf(`RawFetches = %v, expected 2`, n)
+	}
+	for id, want := range map[string]bool{"0x1": true, "0x2": false, "0x3": true} {
+		if _, ok := c.cache.GetMsgKey(id); ok != want {
+			t.Errorf(`GetMsgKey(%v) = %v after full sync, expected %v`, id, ok, want)
+		}
+	}
+
+	// 0x1 gains the excluded label and is removed; 0x2 loses it and is
+	// added.
+	svc.Metadata["0x1"].LabelIds = []string{"INBOX", "Label_1"}
+	svc.Metadata["0x2"].LabelIds = []string{"INBOX"}
+	svc.History[""] = &gmail.ListHistoryResponse{History: []*gmail.History{{
+		Id:            2,
+		LabelsAdded:   []*gmail.HistoryLabelAdded{{LabelIds: []string{"Label_1"}, Message: &gmail.Message{Id: "0x1"}}},
+		LabelsRemoved: []*gmail.HistoryLabelRemoved{{LabelIds: []string{"Label_1"}, Message: &gmail.Message{Id: "0x2"}}},
+	}}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	incremental := map[string]bool{"0x1": false, "0x2": true, "0x3": true}
+	for id, want := range incremental {
+		if _, ok := c.cache.GetMsgKey(id); ok != want {
+			t.Errorf(`GetMsgKey(%v) = %v after incremental sync, expected %v`, id, ok, want)
+		}
+	}
+
+	// A full sync reaches the same state.
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	for id, want := range incremental {
+		if _, ok := c.cache.GetMsgKey(id); ok != want {
+			t.Errorf(`GetMsgKey(%v) = %v after second full sync, expected %v`, id, ok, want)
+		}
+	}
+}
+
+func TestLabelFlags(t *testing.T) {
+	c, svc, dir := getTestClient()
+	c.labelFlags = map[string]string{"STARRED": "F", "IMPORTANT": "i"}
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}},
+	}
+	for _, x := range []struct {
+		labels []string
+		file   string
+	}{
+		{[]string{"INBOX", "IMPORTANT", "STARRED"}, "cur/%v:2,Fi"},
+		// Losing the star removes the flag.
+		{[]string{"INBOX", "IMPORTANT"}, "cur/%v:2,i"},
+		{[]string{"INBOX"}, "new/%v"},
+	} {
+		svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: x.labels}
+		if err := c.Sync(context.Background(), true, nil); err != nil {
+			t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+		}
+		k, _ := c.cache.GetMsgKey("0x1")
+		want := path.Join(dir, fmt.Sprintf(x.file, k))
+		if f, err := c.dir.GetFile(k); err != nil || f != want {
+			t.Errorf(`GetFile(%v) with labels %v = %v, %v, expected %v`, k, x.labels, f, err, want)
+		}
+	}
+}
+
+func TestRelabelMissingFile(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	k, _ := c.cache.GetMsgKey("0x1")
+	f, err := c.dir.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected no error`, k, err)
+	}
+	// Remove the message behind outtake's back, then relabel it.
+	if err := os.Remove(f); err != nil {
+		panic(err)
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX", "STARRED"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected the missing message to be re-downloaded`, err)
+	}
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 2 {
+		t.Errorf(`RawFetches = %v, expected 2`, n)
+	}
+	kn, _ := c.cache.GetMsgKey("0x1")
+	m, r, err := c.getMaildirMessage(kn)
+	if err != nil {
+		t.Fatalf(`getMaildirMessage(%v) = %v, expected the re-delivered message`, kn, err)
+	}
+	defer r.Close()
+	if ks := m.Header[labelsHeader]; strings.Join(ks, ",") != "INBOX,Starred" {
+		t.Errorf(`%v = %v, expected INBOX,Starred`, labelsHeader, ks)
+	}
+	if ls, _ := c.cache.GetMsgLabels("0x1"); strings.Join(ls, ",") != "INBOX,STARRED" {
+		t.Errorf(`GetMsgLabels(0x1) = %v, expected INBOX,STARRED`, ls)
+	}
+}
+
+func TestRelabelKeepsFlags(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.labelFlags = map[string]string{"STARRED": "F"}
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX", "STARRED"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	k, _ := c.cache.GetMsgKey("0x1")
+	f, err := c.dir.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected no error`, k, err)
+	}
+	// A mail client marks the message seen and replied.
+	if err := os.Rename(f, f[:strings.LastIndex(f, ":2,")]+":2,FRS"); err != nil {
+		panic(err)
+	}
+	// Unstarring clears F, but the client's flags stay.
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX", "Work"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	kn, _ := c.cache.GetMsgKey("0x1")
+	f, err = c.dir.GetFile(kn)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected no error`, kn, err)
+	}
+	if !strings.HasSuffix(f, ":2,RS") || path.Base(path.Dir(f)) != "cur" {
+		t.Errorf(`GetFile(%v) = %v, expected cur/...:2,RS`, kn, f)
+	}
+}
+
+// renamingStore marks a message seen, as a mail client would, right after
+// GetFile first returns its path.
+type renamingStore struct {
+	lib.Store
+	renamed bool
+}
+
+func (s *renamingStore) GetFile(k maildir.Key) (string, error) {
+	f, err := s.Store.GetFile(k)
+	if err != nil || s.renamed {
+		return f, err
+	}
+	s.renamed = true
+	if err := os.Rename(f, path.Join(path.Dir(path.Dir(f)), "cur", string(k)+":2,S")); err != nil {
+		panic(err)
+	}
+	return f, nil
+}
+
+func TestRelabelRenamedFile(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	s := &renamingStore{Store: c.dir}
+	c.dir = s
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX", "STARRED"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected the renamed message to be found`, err)
+	}
+	if !s.renamed {
+		t.Fatalf(`GetFile() wasn't called`)
+	}
+	// Found where the client moved it, not re-downloaded.
+	if n := atomic.LoadInt32(&svc.RawFetches); n != 1 {
+		t.Errorf(`RawFetches = %v, expected 1`, n)
+	}
+	kn, _ := c.cache.GetMsgKey("0x1")
+	f, err := c.dir.GetFile(kn)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected no error`, kn, err)
+	}
+	// The client's flag is kept.
+	if !strings.HasSuffix(f, ":2,S") {
+		t.Errorf(`GetFile(%v) = %v, expected ...:2,S`, kn, f)
+	}
+	m, r, err := c.getMaildirMessage(kn)
+	if err != nil {
+		t.Fatalf(`getMaildirMessage(%v) = %v, expected no error`, kn, err)
+	}
+	defer r.Close()
+	if ks := m.Header[labelsHeader]; strings.Join(ks, ",") != "INBOX,Starred" {
+		t.Errorf(`%v = %v, expected INBOX,Starred`, labelsHeader, ks)
+	}
+	if fs, _ := ioutil.ReadDir(path.Dir(f)); len(fs) != 1 {
+		t.Errorf(`cur/ has %v messages, expected the old copy deleted`, len(fs))
+	}
+}
+
+// slowService delays fetching the bodies of the messages in slow.
+type slowService struct {
+	*testService
+	slow map[string]bool
+}
+
+func (s slowService) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	if s.slow[id] {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return s.testService.GetRawMessage(ctx, id)
+}
+
+func TestNewestFirst(t *testing.T) {
+	c, svc, _ := getTestClient()
+	defer func(n int) { ConcurrentDownloads = n }(ConcurrentDownloads)
+	ConcurrentDownloads = 4
+	c.newestFirst = true
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	list := &gmail.ListMessagesResponse{}
+	want := []string{}
+	for i := 20; i > 0; i-- {
+		id := strconv.FormatInt(int64(i), 16)
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{HistoryId: uint64(i)}
+		list.Messages = append(list.Messages, &gmail.Message{Id: id})
+		want = append(want, id)
+	}
+	svc.Messages[""] = list
+	// The newest messages take longest to download.
+	c.svc = slowService{svc, map[string]bool{"14": true, "13": true, "12": true}}
+	got := []string{}
+	c.onDeliver = func(id, _ string) { got = append(got, id) }
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf(`Sync(true, nil) delivered %v, expected %v`, got, want)
+	}
+}
+
+func TestThreadOrder(t *testing.T) {
+	c, svc, _ := getTestClient()
+	defer func(n int) { ConcurrentDownloads = n }(ConcurrentDownloads)
+	ConcurrentDownloads = 4
+	c.threadOrder = true
+	threads := map[string]string{"0x1": "0xa", "0x2": "0xb", "0x3": "0xa", "0x4": "0xb", "0x5": "0xa"}
+	svc.Messages[""] = &gmail.ListMessagesResponse{}
+	for _, id := range []string{"0x1", "0x2", "0x3", "0x4", "0x5"} {
+		svc.Messages[""].Messages = append(svc.Messages[""].Messages, &gmail.Message{Id: id, ThreadId: threads[id]})
+	}
+	var mu sync.Mutex
+	handled := map[string][]string{}
+	handle := func(_ context.Context, id string) msgOp {
+		// Stall each thread's first message so that, if another worker
+		// could take the thread's later messages, it would overtake it.
+		if id == "0x1" || id == "0x2" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled[threads[id]] = append(handled[threads[id]], id)
+		return msgOp{Id: id}
+	}
+	n := uint(0)
+	for o := range c.listMsgs(context.Background(), handle, nil, nil, &n) {
+		if o.Error != nil {
+			t.Fatalf(`listMsgs() = %v, expected no error`, o.Error)
+		}
+	}
+	for th, want := range map[string]string{"0xa": "0x1,0x3,0x5", "0xb": "0x2,0x4"} {
+		if got := strings.Join(handled[th], ","); got != want {
+			t.Errorf(`thread %v handled in order %v, expected %v`, th, got, want)
+		}
+	}
+}
+
+func TestDeleteMissingFile(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	k, _ := c.cache.GetMsgKey("0x1")
+	f, err := c.dir.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected no error`, k, err)
+	}
+	// Remove the message behind outtake's back, then delete it in Gmail.
+	if err := os.Remove(f); err != nil {
+		panic(err)
+	}
+	svc.History[""] = &gmail.ListHistoryResponse{History: []*gmail.History{{
+		Id:              2,
+		MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: "0x1"}}},
+	}}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected the missing message to count as deleted`, err)
+	}
+	if _, ok := c.cache.GetMsgKey("0x1"); ok {
+		t.Errorf(`GetMsgKey("0x1") = true, expected it forgotten`)
+	}
+	if i := c.cache.GetHistoryIdx(); i != 2 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 2`, i)
+	}
+}
+
+func TestMessageBufferSize(t *testing.T) {
+	defer func(n int) { ConcurrentDownloads = n }(ConcurrentDownloads)
+	g := &Gmail{}
+	ConcurrentDownloads = 4
+	small := g.messageBuffer()
+	ConcurrentDownloads = 16
+	large := g.messageBuffer()
+	if small < 4 || large != small*4 {
+		t.Errorf(`messageBuffer() = %v for 4 workers and %v for 16, expected at least 4 and scaling with workers`, small, large)
+	}
+	g.bufferSize = 10
+	if n := g.messageBuffer(); n != 10 {
+		t.Errorf(`messageBuffer() = %v, expected explicit size 10`, n)
+	}
+}
+
+func TestShardOrdering(t *testing.T) {
+	c, svc, _ := getTestClient()
+	defer func(n int) { ConcurrentDownloads = n }(ConcurrentDownloads)
+	ConcurrentDownloads = 4
+	// Force both messages onto one shard; other shards stay idle.
+	sharded := map[string]bool{}
+	var mu sync.Mutex
+	c.sharder = func(id string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		sharded[id] = true
+		return 3
+	}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 1}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	b := new(bytes.Buffer)
+	c.events = lib.NewEventLog(b)
+	added := func(id string, h uint64, l string) *gmail.History {
+		return &gmail.History{Id: h, LabelsAdded: []*gmail.HistoryLabelAdded{
+			{Message: &gmail.Message{Id: id}, LabelIds: []string{l}}}}
+	}
+	svc.History[""] = &gmail.ListHistoryResponse{History: []*gmail.History{
+		added("0x2", 2, "L1"),
+		added("0x1", 3, "L2"),
+		added("0x2", 4, "L3"),
+	}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if !sharded["0x1"] || !sharded["0x2"] {
+		t.Errorf(`sharder saw %v, expected 0x1 and 0x2`, sharded)
+	}
+	ids := []string{}
+	for _, l := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var e lib.Event
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf(`Unmarshal(%v) = %v, expected no error`, l, err)
+		}
+		if e.Type == "relabel" {
+			ids = append(ids, e.Id)
+		}
+	}
+	if strings.Join(ids, ",") != "0x2,0x1,0x2" {
+		t.Errorf(`relabels = %v, expected history order 0x2,0x1,0x2`, ids)
+	}
+}
+
+func readEvents(t *testing.T, b *bytes.Buffer) map[string]int {
+	types := make(map[string]int)
+	for _, l := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var e lib.Event
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf(`Unmarshal(%v) = %v, expected no error`, l, err)
+		}
+		types[e.Type]++
+	}
+	return types
+}
+
+func TestEventLog(t *testing.T) {
+	c, svc, _ := getTestClient()
+	b := new(bytes.Buffer)
+	c.events = lib.NewEventLog(b)
+	c.svc = &countingService{svc, &c.stats, c.events}
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id:              2,
+			MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: "0x1"}}},
+		}},
+	}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	types := readEvents(t, b)
+	if types["deliver"] != 1 || types["delete"] != 1 {
+		t.Errorf(`event log = %v, expected one deliver and one delete`, types)
+	}
+	// labels.list, cached for the second sync, messages.list, messages.get,
+	// history.list.
+	if types["rpc"] != 4 {
+		t.Errorf(`event log has %v rpc events, expected 4`, types["rpc"])
+	}
+}
+
+func TestEventLogRateLimit(t *testing.T) {
+	b := new(bytes.Buffer)
+	s := newRestGmailService(nil, nil, lib.NewEventLog(b), nil)
+	defer s.limiter.Stop()
+	s.limiter.BackoffStart = time.Millisecond
+	calls := 0
+	err := s.limiter.DoWithBackoff(context.Background(), func() (error, bool) {
+		calls++
+		if calls == 1 {
+			return isRateLimited(&googleapi.Error{Code: 429})
+		}
+		return nil, false
+	})
+	if err != nil {
+		t.Fatalf(`DoWithBackoff() = %v, expected nil`, err)
+	}
+	if types := readEvents(t, b); types["rate_limit"] != 1 {
+		t.Errorf(`event log = %v, expected one rate_limit event`, types)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	defer func(n uint, d time.Duration) { MaxRetries, MaxBackoff = n, d }(MaxRetries, MaxBackoff)
+	MaxRetries, MaxBackoff = 2, time.Millisecond
+	s := newRestGmailService(nil, nil, nil, nil)
+	defer s.limiter.Stop()
+	calls := 0
+	start := time.Now()
+	s.limiter.DoWithBackoff(context.Background(), func() (error, bool) {
+		calls++
+		return isRateLimited(&googleapi.Error{Code: 429})
+	})
+	if calls != 3 {
+		t.Errorf(`DoWithBackoff() made %v calls, expected 3`, calls)
+	}
+	// Uncapped, the backoff would start at a second.
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf(`DoWithBackoff() took %v, expected backoff capped at 1ms`, d)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	at := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	for _, x := range []struct {
+		err      error
+		min, max time.Duration
+	}{
+		{&googleapi.Error{Code: 429, Header: http.Header{"Retry-After": {"30"}}}, 30 * time.Second, 30 * time.Second},
+		{&googleapi.Error{Code: 403, Header: http.Header{"Retry-After": {at}}}, 59 * time.Minute, time.Hour},
+		{&googleapi.Error{Code: 429}, 0, 0},
+		{&googleapi.Error{Code: 429, Header: http.Header{"Retry-After": {"soon"}}}, 0, 0},
+		{errors.New("not an API error"), 0, 0},
+	} {
+		if d := retryAfter(x.err); d < x.min || d > x.max {
+			t.Errorf(`retryAfter(%v) = %v, expected between %v and %v`, x.err, d, x.min, x.max)
+		}
+	}
+}
+
+func TestOnlyNew(t *testing.T) {
+	c, svc, dir := getTestClient()
+	c.onlyNew = true
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"], svc.Msgs["0x3"] = m, m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2}
+	svc.Metadata["0x3"] = &gmail.Message{HistoryId: 3}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	// 0x1 vanishes from the server list, and 0x2 is deleted incrementally.
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x2"}, {Id: "0x3"}},
+	}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id:              4,
+			MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: "0x2"}}},
+		}},
+	}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if fs, _ := ioutil.ReadDir(dir + "/new"); len(fs) != 3 {
+		t.Errorf(`Sync() left %v messages, expected 3`, len(fs))
+	}
+	for _, id := range []string{"0x1", "0x2", "0x3"} {
+		if _, ok := c.cache.GetMsgKey(id); !ok {
+			t.Errorf(`GetMsgKey(%v) == false, expected true`, id)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	c, svc, dir := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"], svc.Msgs["0x3"] = m, m, m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2}
+	svc.Metadata["0x3"] = &gmail.Message{HistoryId: 3}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	// 0x1 vanishes, 0x2 is relabeled and 0x3 appears.
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x2"}, {Id: "0x3"}},
+	}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 4, LabelIds: []string{"Work"}}
+	c.dryRun = true
+	c.cache = gmailCache{dryRunCache{c.cache.Cache}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if p := c.Planned(); p != (Planned{Adds: 1, Deletes: 1, Relabels: 1}) {
+		t.Errorf(`Planned() = %+v, expected one of each`, p)
+	}
+	if fs, _ := ioutil.ReadDir(dir + "/new"); len(fs) != 2 {
+		t.Errorf(`Sync() left %v messages, expected the original 2`, len(fs))
+	}
+	if _, ok := c.cache.GetMsgKey("0x1"); !ok {
+		t.Errorf(`GetMsgKey(0x1) = _, false, expected it to be kept`)
+	}
+	if ls, _ := c.cache.GetMsgLabels("0x2"); len(ls) != 0 {
+		t.Errorf(`GetMsgLabels(0x2) = %v, expected no labels`, ls)
+	}
+	if _, ok := c.cache.GetMsgKey("0x3"); ok {
+		t.Errorf(`GetMsgKey(0x3) = _, true, expected it not to be added`)
+	}
+	if i := c.cache.GetHistoryIdx(); i != 2 {
+		t.Errorf(`GetHistoryIdx() = %v, expected 2`, i)
+	}
+}
+
+func TestNarrowedFullSyncKeepsMessages(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"], svc.Msgs["0x2"] = m, m
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2}
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	// Only 0x2 matches the search now, but 0x1 still exists.
+	c.search = "newer_than:1d"
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x2"}}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if q := "-in:chats (newer_than:1d)"; svc.Query != q {
+		t.Errorf(`GetMessages() query = %q, expected %q`, svc.Query, q)
+	}
+	if _, ok := c.cache.GetMsgKey("0x1"); !ok {
+		t.Errorf(`GetMsgKey(0x1) = _, false, expected it kept`)
+	}
+	if err := c.ReconcileDeletes(context.Background(), nil); err == nil {
+		t.Errorf(`ReconcileDeletes() = nil, expected an error for a narrowed listing`)
+	}
+}
+
+func TestSenders(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.senders = SenderFilter{Senders: []string{"alice@example.com", "bob@example.com"}}
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	from := func(h uint64, f string) *gmail.Message {
+		return &gmail.Message{HistoryId: h, Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{{Name: "From", Value: f}},
+		}}
+	}
+	svc.Msgs["0x1"], svc.Msgs["0x2"], svc.Msgs["0x3"] = m, m, m
+	svc.Metadata["0x1"] = from(1, "Alice <alice@example.com>")
+	svc.Metadata["0x2"] = from(2, "bob@example.com")
+	svc.Metadata["0x3"] = from(3, "carol@example.com")
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if q := "-in:chats (from:alice@example.com OR from:bob@example.com)"; svc.Query != q {
+		t.Errorf(`GetMessages() query = %q, expected %q`, svc.Query, q)
+	}
+	// History can't be searched, so new messages are checked one by one.
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id:            4,
+			MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "0x3"}}},
+		}},
+	}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	for id, want := range map[string]bool{"0x1": true, "0x2": true, "0x3": false} {
+		if _, ok := c.cache.GetMsgKey(id); ok != want {
+			t.Errorf(`GetMsgKey(%v) = _, %v, expected %v`, id, ok, want)
+		}
+	}
+}
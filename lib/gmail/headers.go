@@ -0,0 +1,75 @@
+package gmail
+
+import (
+	"bytes"
+	"strings"
+)
+
+// HeaderFilter selects which message headers are kept on export. Names are
+// case-insensitive and may end in "*" to match a prefix. Deny takes
+// precedence over Allow; an empty Allow keeps every header not denied.
+type HeaderFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+func matchHeader(pats []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range pats {
+		p = strings.ToLower(p)
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, p[:len(p)-1]) {
+				return true
+			}
+		} else if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f HeaderFilter) empty() bool {
+	return len(f.Allow) == 0 && len(f.Deny) == 0
+}
+
+func (f HeaderFilter) keep(name string) bool {
+	if matchHeader(f.Deny, name) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchHeader(f.Allow, name)
+}
+
+// apply removes filtered header fields, including their folded continuation
+// lines, directly from a raw RFC 822 message. The remaining headers and the
+// body are left byte-for-byte intact and in their original order.
+func (f HeaderFilter) apply(raw []byte) []byte {
+	if f.empty() {
+		return raw
+	}
+	out := make([]byte, 0, len(raw))
+	keep := true
+	rest := raw
+	for len(rest) > 0 {
+		n := bytes.IndexByte(rest, '\n') + 1
+		if n == 0 {
+			n = len(rest)
+		}
+		line := rest[:n]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of headers: copy the separator and body verbatim.
+			return append(out, rest...)
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if i := bytes.IndexByte(line, ':'); i >= 0 {
+				name = line[:i]
+			}
+			keep = f.keep(string(bytes.TrimSpace(name)))
+		}
+		if keep {
+			out = append(out, line...)
+		}
+		rest = rest[n:]
+	}
+	return out
+}
@@ -0,0 +1,41 @@
+package gmail
+
+import (
+	"testing"
+)
+
+func TestHeaderFilter(t *testing.T) {
+	raw := "Received: from a\r\n" +
+		"\tby b\r\n" +
+		"From: alice@example.com\r\n" +
+		"X-GM-THRID: 123\r\n" +
+		"Subject: hello\r\n" +
+		" world\r\n" +
+		"X-Gmail-Labels: Inbox\r\n" +
+		"To: bob@example.com\r\n" +
+		"\r\n" +
+		"Received: in the body stays\r\n"
+	f := HeaderFilter{Deny: []string{"received", "X-GM-*", "x-gmail-labels"}}
+	want := "From: alice@example.com\r\n" +
+		"Subject: hello\r\n" +
+		" world\r\n" +
+		"To: bob@example.com\r\n" +
+		"\r\n" +
+		"Received: in the body stays\r\n"
+	if got := string(f.apply([]byte(raw))); got != want {
+		t.Errorf("apply() = %q, expected %q", got, want)
+	}
+	// Allow lists keep only the named headers.
+	f = HeaderFilter{Allow: []string{"From", "To"}}
+	want = "From: alice@example.com\r\n" +
+		"To: bob@example.com\r\n" +
+		"\r\n" +
+		"Received: in the body stays\r\n"
+	if got := string(f.apply([]byte(raw))); got != want {
+		t.Errorf("apply() = %q, expected %q", got, want)
+	}
+	// The default keeps everything.
+	if got := string(HeaderFilter{}.apply([]byte(raw))); got != raw {
+		t.Errorf("apply() = %q, expected input unchanged", got)
+	}
+}
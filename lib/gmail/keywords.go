@@ -0,0 +1,144 @@
+package gmail
+
+import (
+	"log"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// systemLabelNames are the names written to X-Keywords for Gmail's system
+// labels, whose listed names are just their IDs. INBOX is already what mail
+// clients call it.
+var systemLabelNames = map[string]string{
+	"SENT":                "Sent",
+	"STARRED":             "Starred",
+	"IMPORTANT":           "Important",
+	"UNREAD":              "Unread",
+	"DRAFT":               "Drafts",
+	"SPAM":                "Spam",
+	"TRASH":               "Trash",
+	"CHAT":                "Chats",
+	"CATEGORY_PERSONAL":   "Personal",
+	"CATEGORY_SOCIAL":     "Social",
+	"CATEGORY_PROMOTIONS": "Promotions",
+	"CATEGORY_UPDATES":    "Updates",
+	"CATEGORY_FORUMS":     "Forums",
+}
+
+// keywordsForLabels returns the names of the labels to write to the keywords
+// header. Labels whose names can't be found are written as their IDs.
+func (g *Gmail) keywordsForLabels(ctx context.Context, labels []string) []string {
+	ids, _ := g.labelPolicy.apply(labels)
+	names := make([]string, len(ids))
+	for i, l := range ids {
+		names[i] = g.labelName(ctx, l)
+	}
+	return names
+}
+
+// keywordsHeader returns the keywords header for labels: their names,
+// separated by commas, in a single header line.
+func (g *Gmail) keywordsHeader(ctx context.Context, labels []string) []string {
+	ks := g.keywordsForLabels(ctx, labels)
+	if len(ks) == 0 {
+		return []string{}
+	}
+	return []string{formatKeywords(ks)}
+}
+
+// labelName returns the display name of label id. The label list is loaded
+// from the cache on first use, and fetched again, once per run, if it's
+// missing a label, which may have been created since.
+func (g *Gmail) labelName(ctx context.Context, id string) string {
+	if n, ok := systemLabelNames[id]; ok {
+		return n
+	}
+	g.mu.Lock()
+	m, refreshed := g.labelDisplay, g.labelsRefreshed
+	g.mu.Unlock()
+	if _, ok := m[id]; m == nil || !ok && !refreshed {
+		m = g.loadLabelDisplay(ctx, id)
+	}
+	if n, ok := m[id]; ok && n != "" {
+		return n
+	}
+	return id
+}
+
+// loadLabelDisplay loads the label names, or fetches them again if they're
+// missing id, returning them. The fetch happens under labelFetch rather than
+// g.mu, which other workers need meanwhile; those after a label name wait
+// for it rather than fetch again.
+func (g *Gmail) loadLabelDisplay(ctx context.Context, id string) map[string]string {
+	g.labelFetch.Lock()
+	defer g.labelFetch.Unlock()
+	g.mu.Lock()
+	m, refreshed := g.labelDisplay, g.labelsRefreshed
+	g.mu.Unlock()
+	if m == nil {
+		var err error
+		if m, err = g.labelNames(ctx, false); err != nil {
+			log.Println("could not list labels; writing label IDs to", labelsHeader, err)
+			m, refreshed = map[string]string{}, true
+		}
+	}
+	if _, ok := m[id]; !ok && !refreshed {
+		refreshed = true
+		if fresh, err := g.labelNames(ctx, true); err == nil {
+			m = fresh
+		}
+	}
+	g.mu.Lock()
+	g.labelDisplay, g.labelsRefreshed = m, refreshed
+	g.mu.Unlock()
+	return m
+}
+
+// formatKeywords joins keywords with commas, quoting any that contain a
+// comma, space, quote or backslash, so that parseKeywords recovers them.
+func formatKeywords(ks []string) string {
+	qs := make([]string, len(ks))
+	for i, k := range ks {
+		if strings.ContainsAny(k, ", \t\"\\") {
+			k = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(k) + `"`
+		}
+		qs[i] = k
+	}
+	return strings.Join(qs, ",")
+}
+
+// parseKeywords splits a keywords header written by formatKeywords. Headers
+// written before names were used hold a single unquoted label ID each, and
+// parse as such.
+func parseKeywords(h string) []string {
+	ks := []string{}
+	for h = strings.TrimLeft(h, " \t"); h != ""; h = strings.TrimLeft(h, " \t") {
+		var k string
+		if h[0] == '"' {
+			var b strings.Builder
+			i := 1
+			for ; i < len(h) && h[i] != '"'; i++ {
+				if h[i] == '\\' && i+1 < len(h) {
+					i++
+				}
+				b.WriteByte(h[i])
+			}
+			k, h = b.String(), h[i:]
+			h = strings.TrimPrefix(h, `"`)
+			// Anything up to the next comma isn't part of a keyword we wrote.
+			if i := strings.Index(h, ","); i >= 0 {
+				h = h[i:]
+			} else {
+				h = ""
+			}
+		} else if i := strings.Index(h, ","); i >= 0 {
+			k, h = strings.TrimSpace(h[:i]), h[i:]
+		} else {
+			k, h = strings.TrimSpace(h), ""
+		}
+		ks = append(ks, k)
+		h = strings.TrimPrefix(h, ",")
+	}
+	return ks
+}
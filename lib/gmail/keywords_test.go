@@ -0,0 +1,71 @@
+package gmail
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestFormatKeywords(t *testing.T) {
+	for _, x := range []struct {
+		ks   []string
+		want string
+	}{
+		{[]string{"INBOX"}, "INBOX"},
+		{[]string{"Work", "Receipts"}, "Work,Receipts"},
+		{[]string{"My Label", "a,b"}, `"My Label","a,b"`},
+		{[]string{`say "hi"`, `back\slash`}, `"say \"hi\"","back\\slash"`},
+		{[]string{"Work/Old"}, "Work/Old"},
+	} {
+		got := formatKeywords(x.ks)
+		if got != x.want {
+			t.Errorf(`formatKeywords(%q) = %q, expected %q`, x.ks, got, x.want)
+		}
+		if back := parseKeywords(got); !reflect.DeepEqual(back, x.ks) {
+			t.Errorf(`parseKeywords(%q) = %q, expected %q`, got, back, x.ks)
+		}
+	}
+}
+
+func TestParseKeywords(t *testing.T) {
+	for _, x := range []struct {
+		h    string
+		want []string
+	}{
+		{"", []string{}},
+		{"LABEL_3", []string{"LABEL_3"}},
+		{"INBOX, Work", []string{"INBOX", "Work"}},
+		{` "a, b" ,c`, []string{"a, b", "c"}},
+	} {
+		if got := parseKeywords(x.h); !reflect.DeepEqual(got, x.want) {
+			t.Errorf(`parseKeywords(%q) = %q, expected %q`, x.h, got, x.want)
+		}
+	}
+}
+
+func TestKeywordsHeaderNames(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{
+		{Id: "INBOX", Name: "INBOX"},
+		{Id: "Label_42", Name: "Work"},
+	}}
+	ls := []string{"INBOX", "Label_42", "CATEGORY_PERSONAL"}
+	if h := c.keywordsHeader(context.Background(), ls); strings.Join(h, "\n") != "INBOX,Work,Personal" {
+		t.Errorf(`keywordsHeader(%v) = %q, expected INBOX,Work,Personal`, ls, h)
+	}
+	// A label created since the names were loaded is fetched once.
+	svc.Labels.Labels = append(svc.Labels.Labels, &gmail.Label{Id: "Label_7", Name: "Receipts, 2024"})
+	ls = []string{"Label_7", "Label_8"}
+	if h := c.keywordsHeader(context.Background(), ls); strings.Join(h, "\n") != `"Receipts, 2024",Label_8` {
+		t.Errorf(`keywordsHeader(%v) = %q, expected "Receipts, 2024",Label_8`, ls, h)
+	}
+	if n := svc.LabelFetches; n != 2 {
+		t.Errorf(`keywordsHeader() listed labels %v times, expected 2`, n)
+	}
+	if h := c.keywordsHeader(context.Background(), nil); len(h) != 0 {
+		t.Errorf(`keywordsHeader(nil) = %q, expected no header`, h)
+	}
+}
@@ -0,0 +1,71 @@
+package gmail
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LabelTransition is one entry in a LabelLog: the labels added to and
+// removed from a message by one relabeling.
+type LabelTransition struct {
+	Time      time.Time `json:"time"`
+	Id        string    `json:"id"`
+	HistoryId uint64    `json:"history_id,omitempty"`
+	Added     []string  `json:"added,omitempty"`
+	Removed   []string  `json:"removed,omitempty"`
+}
+
+// LabelLog is an append-only changelog of label transitions, as JSON lines,
+// preserving the history of how messages were categorized that rewriting
+// X-Keywords loses. A nil *LabelLog discards everything. It is safe for
+// concurrent use.
+type LabelLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewLabelLog(w io.Writer) *LabelLog {
+	return &LabelLog{enc: json.NewEncoder(w)}
+}
+
+// Record logs the change of message id's labels from old to new, if there is
+// one. Write errors are ignored, as for lib.EventLog.
+func (l *LabelLog) Record(id string, historyId uint64, old, new []string) {
+	if l == nil {
+		return
+	}
+	added, removed := labelDiff(old, new)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(LabelTransition{
+		Time:      time.Now(),
+		Id:        id,
+		HistoryId: historyId,
+		Added:     added,
+		Removed:   removed,
+	})
+}
+
+// labelDiff returns the labels in new but not old, and in old but not new,
+// sorted.
+func labelDiff(old, new []string) (added, removed []string) {
+	for _, l := range new {
+		if !containsLabel(old, l) {
+			added = append(added, l)
+		}
+	}
+	for _, l := range old {
+		if !containsLabel(new, l) {
+			removed = append(removed, l)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
@@ -0,0 +1,55 @@
+package gmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestLabelLog(t *testing.T) {
+	c, svc, _ := getTestClient()
+	buf := new(bytes.Buffer)
+	c.labelLog = NewLabelLog(buf)
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}},
+	}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	for _, h := range []*gmail.History{{
+		Id:          2,
+		LabelsAdded: []*gmail.HistoryLabelAdded{{LabelIds: []string{"STARRED", "Work"}, Message: &gmail.Message{Id: "0x1"}}},
+	}, {
+		Id:            3,
+		LabelsRemoved: []*gmail.HistoryLabelRemoved{{LabelIds: []string{"INBOX"}, Message: &gmail.Message{Id: "0x1"}}},
+	}} {
+		svc.History[""] = &gmail.ListHistoryResponse{History: []*gmail.History{h}}
+		if err := c.Sync(context.Background(), false, nil); err != nil {
+			t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+		}
+	}
+	var got []string
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e LabelTransition
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf(`Decode() = %v, expected no error`, err)
+		}
+		if e.Time.IsZero() {
+			t.Errorf(`LabelTransition %+v has no time`, e)
+		}
+		got = append(got, e.Id+" "+strings.Join(e.Added, ",")+" -"+strings.Join(e.Removed, ","))
+	}
+	want := []string{"0x1 STARRED,Work -", "0x1  -INBOX"}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf(`label log = %v, expected %v`, got, want)
+	}
+}
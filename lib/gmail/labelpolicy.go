@@ -0,0 +1,87 @@
+package gmail
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Label policy actions. A label can also map to "flag:X", which sets the
+// maildir info flag X (e.g. "flag:F" for flagged) instead.
+const (
+	// Write the label to the X-Keywords header. This is the default.
+	KeywordAction = "keyword"
+	// Drop the label from the exported message.
+	IgnoreAction = "ignore"
+	flagPrefix   = "flag:"
+)
+
+// LabelPolicy maps Gmail label IDs to what becomes of them on export: a
+// keyword, a maildir flag, or nothing. Keys may end in "*" to match a prefix,
+// such as "CATEGORY_*"; exact matches take precedence, then the longest
+// prefix. Labels not covered are keywords, as are all labels under the
+// default, empty policy.
+type LabelPolicy map[string]string
+
+// ParseLabelPolicy parses LABEL=ACTION specs, e.g. "STARRED=flag:F" or
+// "CATEGORY_*=ignore".
+func ParseLabelPolicy(specs []string) (LabelPolicy, error) {
+	p := LabelPolicy{}
+	for _, s := range specs {
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("label policy %q is not LABEL=ACTION", s)
+		}
+		l, a := s[:i], s[i+1:]
+		switch {
+		case a == KeywordAction, a == IgnoreAction:
+		case strings.HasPrefix(a, flagPrefix):
+			if f := a[len(flagPrefix):]; !isFlag(f) {
+				return nil, fmt.Errorf("label policy %q: flag %q is not a single letter", s, f)
+			}
+		default:
+			return nil, fmt.Errorf("label policy %q: action must be %v, %v or %vX", s, KeywordAction, IgnoreAction, flagPrefix)
+		}
+		p[l] = a
+	}
+	return p, nil
+}
+
+// isFlag reports whether f is a single letter, as maildir info flags are.
+func isFlag(f string) bool {
+	return len(f) == 1 && ('A' <= f[0] && f[0] <= 'Z' || 'a' <= f[0] && f[0] <= 'z')
+}
+
+func (p LabelPolicy) action(label string) string {
+	if a, ok := p[label]; ok {
+		return a
+	}
+	best, a := -1, KeywordAction
+	for k, v := range p {
+		if strings.HasSuffix(k, "*") && strings.HasPrefix(label, k[:len(k)-1]) && len(k) > best {
+			best, a = len(k), v
+		}
+	}
+	return a
+}
+
+// apply splits labels into the keywords and the maildir flags to export.
+// Flags are returned sorted and without duplicates.
+func (p LabelPolicy) apply(labels []string) ([]string, string) {
+	if len(p) == 0 {
+		return labels, ""
+	}
+	keywords := make([]string, 0, len(labels))
+	flags := []string{}
+	for _, l := range labels {
+		switch a := p.action(l); {
+		case a == IgnoreAction:
+		case strings.HasPrefix(a, flagPrefix):
+			flags = addLabel(flags, a[len(flagPrefix):])
+		default:
+			keywords = append(keywords, l)
+		}
+	}
+	sort.Strings(flags)
+	return keywords, strings.Join(flags, "")
+}
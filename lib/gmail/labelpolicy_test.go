@@ -0,0 +1,77 @@
+package gmail
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestLabelPolicy(t *testing.T) {
+	p, err := ParseLabelPolicy([]string{
+		"IMPORTANT=keyword",
+		"CATEGORY_*=ignore",
+		"CATEGORY_PERSONAL=keyword",
+		"STARRED=flag:F",
+	})
+	if err != nil {
+		t.Fatalf(`ParseLabelPolicy() = %v, expected no error`, err)
+	}
+	for l, want := range map[string]string{
+		"IMPORTANT":           KeywordAction,
+		"CATEGORY_PROMOTIONS": IgnoreAction,
+		"CATEGORY_PERSONAL":   KeywordAction,
+		"STARRED":             "flag:F",
+		"Label_1":             KeywordAction,
+	} {
+		if a := p.action(l); a != want {
+			t.Errorf(`action(%v) = %v, expected %v`, l, a, want)
+		}
+	}
+	ks, flags := p.apply([]string{"INBOX", "IMPORTANT", "CATEGORY_PROMOTIONS", "STARRED"})
+	if strings.Join(ks, ",") != "INBOX,IMPORTANT" || flags != "F" {
+		t.Errorf(`apply() = %v, %q, expected [INBOX IMPORTANT], "F"`, ks, flags)
+	}
+	// The empty policy keeps every label as a keyword.
+	if ks, flags := LabelPolicy(nil).apply([]string{"STARRED"}); len(ks) != 1 || flags != "" {
+		t.Errorf(`apply() = %v, %q, expected [STARRED], ""`, ks, flags)
+	}
+	for _, bad := range [][]string{{"STARRED"}, {"=keyword"}, {"STARRED=flag:"}, {"STARRED=flag:/"}, {"STARRED=flag:FS"}, {"STARRED=bold"}} {
+		if _, err := ParseLabelPolicy(bad); err == nil {
+			t.Errorf(`ParseLabelPolicy(%v) = nil, expected error`, bad)
+		}
+	}
+}
+
+func TestLabelPolicyDelivery(t *testing.T) {
+	c, svc, dir := getTestClient()
+	c.readState = true
+	c.labelPolicy = LabelPolicy{"STARRED": "flag:F", "CATEGORY_*": IgnoreAction}
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX", "STARRED", "CATEGORY_SOCIAL"}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	k, _ := c.cache.GetMsgKey("0x1")
+	f, err := c.dir.GetFile(k)
+	if err != nil || f != path.Join(dir, "cur", string(k)+":2,FS") {
+		t.Fatalf(`GetFile(%v) = %v, %v, expected message in cur/ with FS`, k, f, err)
+	}
+	bs, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf(`ReadFile(%v) = %v, expected no error`, f, err)
+	}
+	if !strings.Contains(string(bs), labelsHeader+": INBOX\n") {
+		t.Errorf(`Expected %q to have only INBOX in %v`, bs, labelsHeader)
+	}
+	// The cache keeps every label, to detect changes.
+	if ls, _ := c.cache.GetMsgLabels("0x1"); len(ls) != 3 {
+		t.Errorf(`GetMsgLabels("0x1") = %v, expected all 3 labels`, ls)
+	}
+}
@@ -0,0 +1,65 @@
+package gmail
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryOptions are the filters that make up the search query for listing
+// messages. Each adds a clause, and a message must match them all. The label
+// filter isn't among them: it's passed to the API as a label ID, which
+// matches exactly, rather than searched for by name.
+type QueryOptions struct {
+	// Names of labels whose messages aren't listed.
+	ExcludeLabels []string
+	// Only mail from any of these senders.
+	Senders SenderFilter
+	// Only mail received at or after this time. Full sync only:
+	// incremental sync follows the history wherever it leads.
+	Since time.Time
+	// A free-form Gmail search, such as "larger:1M".
+	Search string
+	// List chats too, which are skipped by default as they aren't MIME
+	// messages.
+	IncludeChats bool
+}
+
+// BuildQuery returns the Gmail search query for o: the clauses for chats,
+// excluded labels, senders, time and search, in that order, separated by
+// spaces, which Gmail treats as AND. Alternatives within the sender filter
+// are ORed, and the search is parenthesized so that any OR in it stays
+// within it.
+func BuildQuery(o QueryOptions) string {
+	cs := []string{}
+	if !o.IncludeChats {
+		cs = append(cs, "-in:chats")
+	}
+	for _, l := range o.ExcludeLabels {
+		cs = append(cs, "-label:"+labelSearchName(l))
+	}
+	if q := o.Senders.query(); q != "" {
+		cs = append(cs, q)
+	}
+	if !o.Since.IsZero() {
+		// In seconds, which Gmail takes as an exact time rather than a day
+		// in its own time zone. That's exclusive, so go back a second.
+		cs = append(cs, "after:"+strconv.FormatInt(o.Since.Unix()-1, 10))
+	}
+	if s := strings.TrimSpace(o.Search); s != "" {
+		cs = append(cs, "("+s+")")
+	}
+	return strings.Join(cs, " ")
+}
+
+// narrows reports whether o leaves out messages for reasons other than
+// their labels, so that a listing can't tell those from deleted messages.
+func (o QueryOptions) narrows() bool {
+	return !o.Senders.empty() || !o.Since.IsZero() || strings.TrimSpace(o.Search) != ""
+}
+
+// labelSearchName returns label name l as Gmail search expects it, with
+// spaces and the slashes of nested labels replaced by dashes.
+func labelSearchName(l string) string {
+	return strings.NewReplacer(" ", "-", "/", "-").Replace(l)
+}
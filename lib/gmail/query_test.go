@@ -0,0 +1,61 @@
+package gmail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildQuery(t *testing.T) {
+	since := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	alice := SenderFilter{Senders: []string{"alice@example.com"}}
+	both := SenderFilter{Senders: []string{"alice@example.com"}, Domains: []string{"example.org"}}
+	for _, x := range []struct {
+		o    QueryOptions
+		want string
+	}{
+		{QueryOptions{}, "-in:chats"},
+		{QueryOptions{IncludeChats: true}, ""},
+		{QueryOptions{ExcludeLabels: []string{"Spam-ish"}}, "-in:chats -label:Spam-ish"},
+		{QueryOptions{ExcludeLabels: []string{"My Label", "Work/Old"}}, "-in:chats -label:My-Label -label:Work-Old"},
+		{QueryOptions{Senders: alice}, "-in:chats from:alice@example.com"},
+		{QueryOptions{Senders: both}, "-in:chats (from:alice@example.com OR from:@example.org)"},
+		{QueryOptions{Since: since}, "-in:chats after:1709596799"},
+		{QueryOptions{Search: "larger:1M"}, "-in:chats (larger:1M)"},
+		{QueryOptions{Search: "  "}, "-in:chats"},
+		// Quotes and inner spaces pass through as they are.
+		{QueryOptions{Search: `from:boss@example.com has:attachment subject:"Q3  report"`}, `-in:chats (from:boss@example.com has:attachment subject:"Q3  report")`},
+		// The search's OR stays inside it.
+		{QueryOptions{Search: "from:bob OR from:carol", Since: since}, "-in:chats after:1709596799 (from:bob OR from:carol)"},
+		{QueryOptions{Search: "has:attachment", IncludeChats: true}, "(has:attachment)"},
+		{
+			QueryOptions{ExcludeLabels: []string{"Trips"}, Senders: both, Since: since, Search: "-category:promotions", IncludeChats: true},
+			"-label:Trips (from:alice@example.com OR from:@example.org) after:1709596799 (-category:promotions)",
+		},
+		{
+			QueryOptions{ExcludeLabels: []string{"Trips"}, Senders: alice, Since: since, Search: "is:important"},
+			"-in:chats -label:Trips from:alice@example.com after:1709596799 (is:important)",
+		},
+	} {
+		if got := BuildQuery(x.o); got != x.want {
+			t.Errorf(`BuildQuery(%+v) = %q, expected %q`, x.o, got, x.want)
+		}
+	}
+}
+
+func TestQueryNarrows(t *testing.T) {
+	for _, x := range []struct {
+		o    QueryOptions
+		want bool
+	}{
+		{QueryOptions{}, false},
+		// Excluded messages are deleted anyway, and chats only add messages.
+		{QueryOptions{ExcludeLabels: []string{"Trips"}, IncludeChats: true}, false},
+		{QueryOptions{Senders: SenderFilter{Domains: []string{"example.org"}}}, true},
+		{QueryOptions{Since: time.Now()}, true},
+		{QueryOptions{Search: "larger:1M"}, true},
+	} {
+		if got := x.o.narrows(); got != x.want {
+			t.Errorf(`%+v.narrows() = %v, expected %v`, x.o, got, x.want)
+		}
+	}
+}
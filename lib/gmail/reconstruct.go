@@ -0,0 +1,93 @@
+package gmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// Fetch formats.
+const (
+	// Download the raw RFC 822 message, falling back to FullFormat if that
+	// fails. This is the default.
+	RawFormat = "raw"
+	// Always download the parsed message and reconstruct the RFC 822 form.
+	FullFormat = "full"
+)
+
+// Set on reconstructed parts whose attachment body wasn't downloaded.
+const missingAttachmentHeader = "X-Outtake-Missing-Attachment"
+
+// reconstructMessage rebuilds an RFC 822 message from one fetched with
+// format=full, for when the raw form can't be fetched or parsed. The API
+// returns part bodies decoded, so each leaf part is re-encoded as base64.
+// Large attachments aren't inlined in the response; their parts are kept,
+// empty, and marked with an X-Outtake-Missing-Attachment header.
+func reconstructMessage(m *gmail.Message) ([]byte, error) {
+	if m == nil || m.Payload == nil {
+		return nil, errors.New("message has no payload")
+	}
+	buf := new(bytes.Buffer)
+	if err := writePart(buf, m.Payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writePart(w *bytes.Buffer, p *gmail.MessagePart) error {
+	multipart := strings.HasPrefix(p.MimeType, "multipart/")
+	boundary := ""
+	for _, h := range p.Headers {
+		if strings.EqualFold(h.Name, "Content-Transfer-Encoding") && !multipart {
+			// Replaced below, since the data is re-encoded.
+			continue
+		}
+		if strings.EqualFold(h.Name, "Content-Type") && multipart {
+			if _, ps, err := mime.ParseMediaType(h.Value); err == nil {
+				boundary = ps["boundary"]
+			}
+		}
+		w.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	if multipart {
+		if boundary == "" {
+			return fmt.Errorf("%v part has no boundary", p.MimeType)
+		}
+		w.WriteString("\r\n")
+		for _, c := range p.Parts {
+			w.WriteString("--" + boundary + "\r\n")
+			if err := writePart(w, c); err != nil {
+				return err
+			}
+			w.WriteString("\r\n")
+		}
+		w.WriteString("--" + boundary + "--\r\n")
+		return nil
+	}
+	var data []byte
+	if p.Body != nil {
+		if p.Body.Data == "" && p.Body.AttachmentId != "" {
+			w.WriteString(missingAttachmentHeader + ": " + p.Body.AttachmentId + "\r\n")
+		}
+		var err error
+		// The API's base64url is sometimes unpadded.
+		if data, err = base64.URLEncoding.DecodeString(p.Body.Data); err != nil {
+			if data, err = base64.RawURLEncoding.DecodeString(p.Body.Data); err != nil {
+				return fmt.Errorf("decoding %v part: %v", p.MimeType, err)
+			}
+		}
+	}
+	w.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		w.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	w.WriteString(enc + "\r\n")
+	return nil
+}
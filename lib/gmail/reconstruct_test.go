@@ -0,0 +1,88 @@
+package gmail
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func b64(s string) string {
+	return base64.URLEncoding.EncodeToString([]byte(s))
+}
+
+func TestFullFormatFallback(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Msgs["0x1"] = b64("\xff\xfe not a message")
+	svc.Full = map[string]*gmail.Message{"0x1": {Payload: &gmail.MessagePart{
+		MimeType: "multipart/mixed",
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "Subject", Value: "Recovered"},
+			{Name: "Content-Type", Value: `multipart/mixed; boundary="b1"`},
+		},
+		Parts: []*gmail.MessagePart{{
+			MimeType: "text/plain",
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Content-Type", Value: "text/plain; charset=utf-8"},
+				{Name: "Content-Transfer-Encoding", Value: "quoted-printable"},
+			},
+			Body: &gmail.MessagePartBody{Data: b64("héllo")},
+		}, {
+			MimeType: "application/pdf",
+			Headers:  []*gmail.MessagePartHeader{{Name: "Content-Type", Value: "application/pdf"}},
+			Body:     &gmail.MessagePartBody{AttachmentId: "att1", Size: 1000},
+		}},
+	}}}
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	k, ok := c.cache.GetMsgKey("0x1")
+	if !ok {
+		t.Fatalf(`GetMsgKey("0x1") = false, expected the message to be stored`)
+	}
+	f, err := c.dir.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected no error`, k, err)
+	}
+	r, err := os.Open(f)
+	if err != nil {
+		t.Fatalf(`Open(%v) = %v, expected no error`, f, err)
+	}
+	defer r.Close()
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		t.Fatalf(`ReadMessage(%v) = %v, expected no error`, f, err)
+	}
+	if s := m.Header.Get("Subject"); s != "Recovered" || m.Header.Get(unparsedHeader) != "" {
+		t.Errorf(`Subject = %q, %v = %q, expected the reconstructed message`, s, unparsedHeader, m.Header.Get(unparsedHeader))
+	}
+	_, ps, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf(`ParseMediaType() = %v, expected no error`, err)
+	}
+	mr := multipart.NewReader(m.Body, ps["boundary"])
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf(`NextPart() = %v, expected no error`, err)
+	}
+	bs, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+	if string(bs) != "héllo" || p.Header.Get("Content-Transfer-Encoding") != "base64" {
+		t.Errorf(`first part = %q, encoded %q, expected "héllo" as base64`, bs, p.Header.Get("Content-Transfer-Encoding"))
+	}
+	p, err = mr.NextPart()
+	if err != nil {
+		t.Fatalf(`NextPart() = %v, expected no error`, err)
+	}
+	if a := p.Header.Get(missingAttachmentHeader); a != "att1" {
+		t.Errorf(`%v = %q, expected "att1"`, missingAttachmentHeader, a)
+	}
+}
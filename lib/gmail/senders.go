@@ -0,0 +1,61 @@
+package gmail
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// SenderFilter limits syncing to mail from the given addresses or domains
+// (such as "example.com"), compared case-insensitively. Mail from any of them
+// is synced; an empty filter syncs everything.
+type SenderFilter struct {
+	Senders []string
+	Domains []string
+}
+
+func (f SenderFilter) empty() bool {
+	return len(f.Senders) == 0 && len(f.Domains) == 0
+}
+
+// query returns the Gmail search clause matching mail from any of f's
+// senders or domains, or "" if f is empty.
+func (f SenderFilter) query() string {
+	cs := []string{}
+	for _, s := range f.Senders {
+		cs = append(cs, "from:"+s)
+	}
+	for _, d := range f.Domains {
+		cs = append(cs, "from:@"+strings.TrimPrefix(d, "@"))
+	}
+	if len(cs) <= 1 {
+		return strings.Join(cs, "")
+	}
+	return "(" + strings.Join(cs, " OR ") + ")"
+}
+
+// allows reports whether a message with the From header from passes f.
+// History records can't be searched, so incremental sync checks each new
+// message with this instead of query.
+func (f SenderFilter) allows(from string) bool {
+	if f.empty() {
+		return true
+	}
+	as, err := mail.ParseAddressList(from)
+	if err != nil {
+		return false
+	}
+	for _, a := range as {
+		addr := strings.ToLower(a.Address)
+		for _, s := range f.Senders {
+			if addr == strings.ToLower(s) {
+				return true
+			}
+		}
+		for _, d := range f.Domains {
+			if strings.HasSuffix(addr, "@"+strings.ToLower(strings.TrimPrefix(d, "@"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
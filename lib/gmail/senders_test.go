@@ -0,0 +1,42 @@
+package gmail
+
+import (
+	"testing"
+)
+
+func TestSenderFilterQuery(t *testing.T) {
+	for _, x := range []struct {
+		f    SenderFilter
+		want string
+	}{
+		{SenderFilter{}, ""},
+		{SenderFilter{Senders: []string{"alice@example.com"}}, "from:alice@example.com"},
+		{SenderFilter{Domains: []string{"@example.org"}}, "from:@example.org"},
+		{
+			SenderFilter{Senders: []string{"alice@example.com", "bob@example.net"}, Domains: []string{"example.org"}},
+			"(from:alice@example.com OR from:bob@example.net OR from:@example.org)",
+		},
+	} {
+		if got := x.f.query(); got != x.want {
+			t.Errorf(`%+v.query() = %q, expected %q`, x.f, got, x.want)
+		}
+	}
+}
+
+func TestSenderFilterAllows(t *testing.T) {
+	f := SenderFilter{Senders: []string{"Alice@example.com"}, Domains: []string{"example.org"}}
+	for _, x := range []struct {
+		from string
+		want bool
+	}{
+		{"Alice <alice@example.com>", true},
+		{"bob@example.com", false},
+		{"carol@EXAMPLE.org", true},
+		{"dave@notexample.org", false},
+		{"not an address", false},
+	} {
+		if got := f.allows(x.from); got != x.want {
+			t.Errorf(`allows(%q) = %v, expected %v`, x.from, got, x.want)
+		}
+	}
+}
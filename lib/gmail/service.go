@@ -1,26 +1,165 @@
 package gmail
 
 import (
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/danmarg/outtake/lib"
+	"golang.org/x/net/context"
 	gmail "google.golang.org/api/gmail/v1"
 	"google.golang.org/api/googleapi"
 )
 
 const (
-	maxQps     = 50
-	maxRetries = 8
+	maxQps = 50
 )
 
 // Wrapper for the Gmail REST interface. This abstraction helps with unit testing.
 type gmailService interface {
-	GetRawMessage(id string) (string, error)
-	GetMetadata(id string) (*gmail.Message, error)
-	GetLabels() (*gmail.ListLabelsResponse, error)
-	GetHistory(historyIndex uint64, label, page string) (*gmail.ListHistoryResponse, error)
-	GetMessages(q, page string) (*gmail.ListMessagesResponse, error)
+	// GetRawMessage returns a message in raw format: the body, in Raw, and
+	// its labels and other metadata, but no Payload.
+	GetRawMessage(ctx context.Context, id string) (*gmail.Message, error)
+	// GetRawMessages is like GetRawMessage for several messages at once.
+	// Messages that couldn't be fetched are nil.
+	GetRawMessages(ctx context.Context, ids []string) ([]*gmail.Message, error)
+	GetFullMessage(ctx context.Context, id string) (*gmail.Message, error)
+	GetMetadata(ctx context.Context, id string) (*gmail.Message, error)
+	GetLabels(ctx context.Context) (*gmail.ListLabelsResponse, error)
+	GetLabel(ctx context.Context, id string) (*gmail.Label, error)
+	GetHistory(ctx context.Context, historyIndex uint64, label string, types []string, page string) (*gmail.ListHistoryResponse, error)
+	// GetMessages lists messages with labelId, if set, that match the search
+	// query q, if set.
+	GetMessages(ctx context.Context, labelId, q, page string) (*gmail.ListMessagesResponse, error)
+	GetDrafts(ctx context.Context, page string) (*gmail.ListDraftsResponse, error)
+	GetProfile(ctx context.Context) (*gmail.Profile, error)
+}
+
+// Quota units charged per API method. See
+// https://developers.google.com/gmail/api/reference/quota.
+var quotaCost = map[string]uint{
+	"messages.get":  5,
+	"messages.list": 5,
+	"labels.list":   1,
+	"labels.get":    1,
+	"history.list":  2,
+	"drafts.list":   1,
+	"getProfile":    1,
+}
+
+// rpcStats counts Gmail API calls by method.
+type rpcStats struct {
+	mu    sync.Mutex
+	calls map[string]uint
+}
+
+func (s *rpcStats) add(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.calls == nil {
+		s.calls = make(map[string]uint)
+	}
+	s.calls[method]++
+}
+
+// Calls returns the total number of API calls made.
+func (s *rpcStats) Calls() uint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := uint(0)
+	for _, c := range s.calls {
+		n += c
+	}
+	return n
+}
+
+// QuotaUnits estimates the quota units consumed by the calls made so far.
+func (s *rpcStats) QuotaUnits() uint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := uint(0)
+	for m, c := range s.calls {
+		n += quotaCost[m] * c
+	}
+	return n
+}
+
+// countingService wraps a gmailService, recording each call in stats and in
+// the event log.
+type countingService struct {
+	gmailService
+	stats  *rpcStats
+	events *lib.EventLog
+}
+
+func (s *countingService) record(method string, err error) {
+	s.stats.add(method)
+	s.events.Log(lib.Event{Type: "rpc", Method: method}, err)
+}
+
+func (s *countingService) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	r, err := s.gmailService.GetRawMessage(ctx, id)
+	s.record("messages.get", err)
+	return r, err
+}
+
+func (s *countingService) GetRawMessages(ctx context.Context, ids []string) ([]*gmail.Message, error) {
+	r, err := s.gmailService.GetRawMessages(ctx, ids)
+	// Each message in a batch is charged as a separate call.
+	for range ids {
+		s.record("messages.get", err)
+	}
+	return r, err
+}
+
+func (s *countingService) GetFullMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	r, err := s.gmailService.GetFullMessage(ctx, id)
+	s.record("messages.get", err)
+	return r, err
+}
+
+func (s *countingService) GetMetadata(ctx context.Context, id string) (*gmail.Message, error) {
+	r, err := s.gmailService.GetMetadata(ctx, id)
+	s.record("messages.get", err)
+	return r, err
+}
+
+func (s *countingService) GetLabels(ctx context.Context) (*gmail.ListLabelsResponse, error) {
+	r, err := s.gmailService.GetLabels(ctx)
+	s.record("labels.list", err)
+	return r, err
+}
+
+func (s *countingService) GetLabel(ctx context.Context, id string) (*gmail.Label, error) {
+	r, err := s.gmailService.GetLabel(ctx, id)
+	s.record("labels.get", err)
+	return r, err
+}
+
+func (s *countingService) GetHistory(ctx context.Context, historyIndex uint64, label string, types []string, page string) (*gmail.ListHistoryResponse, error) {
+	r, err := s.gmailService.GetHistory(ctx, historyIndex, label, types, page)
+	s.record("history.list", err)
+	return r, err
+}
+
+func (s *countingService) GetMessages(ctx context.Context, labelId, q, page string) (*gmail.ListMessagesResponse, error) {
+	r, err := s.gmailService.GetMessages(ctx, labelId, q, page)
+	s.record("messages.list", err)
+	return r, err
+}
+
+func (s *countingService) GetDrafts(ctx context.Context, page string) (*gmail.ListDraftsResponse, error) {
+	r, err := s.gmailService.GetDrafts(ctx, page)
+	s.record("drafts.list", err)
+	return r, err
+}
+
+func (s *countingService) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	r, err := s.gmailService.GetProfile(ctx)
+	s.record("getProfile", err)
+	return r, err
 }
 
 type backoff struct {
@@ -31,18 +170,66 @@ type restGmailService struct {
 	gmailService
 	svc     *gmail.UsersService
 	limiter lib.RateLimit
+	// The authorized client and endpoint for batch requests.
+	client   *http.Client
+	batchURL string
+	// Which errors to retry; DefaultRetriable if nil.
+	retriable func(error) bool
+	// Called when the API rejects the credentials, to have them refreshed,
+	// returning whether to retry; may be nil.
+	unauthorized func() bool
 }
 
-func newRestGmailService(svc *gmail.UsersService) *restGmailService {
-	r := &restGmailService{svc: svc,
+func newRestGmailService(svc *gmail.UsersService, client *http.Client, events *lib.EventLog, throttle *lib.Throttle) *restGmailService {
+	r := &restGmailService{svc: svc, client: client, batchURL: batchURL,
 		limiter: lib.RateLimit{Period: time.Second,
 			Rate:         maxQps,
-			BackoffLimit: maxRetries,
-			BackoffStart: time.Second}}
+			BackoffLimit: MaxRetries + 1,
+			BackoffStart: time.Second,
+			BackoffMax:   MaxBackoff,
+			RetryBudget:  RetryBudget,
+			OnBackoff: func(err error, d time.Duration) {
+				events.Log(lib.Event{Type: "rate_limit", Delay: d}, err)
+				throttle.RateLimited()
+			},
+			OnSuccess:  throttle.Succeeded,
+			RetryAfter: retryAfter}}
 	r.limiter.Start()
 	return r
 }
 
+// DefaultRetriable reports whether err is worth retrying after a backoff: it's
+// true for rate limit and quota errors. Options.IsRetriable can extend it.
+func DefaultRetriable(err error) bool {
+	_, fatal := isRateLimited(err)
+	return !fatal
+}
+
+// do calls f with backoff, retrying the errors classify allows. A request
+// refused for its credentials is retried once, right away, if they can be
+// refreshed: that's no reason to slow down.
+func (s *restGmailService) do(ctx context.Context, f func() error) error {
+	return s.limiter.DoWithBackoff(ctx, func() (error, bool) {
+		err := f()
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusUnauthorized && s.unauthorized != nil && s.unauthorized() {
+			if err := s.limiter.Get(ctx); err != nil {
+				return err, true
+			}
+			err = f()
+		}
+		return s.classify(err)
+	})
+}
+
+// classify returns err and whether it's fatal, for DoWithBackoff, according
+// to the service's retry predicate.
+func (s *restGmailService) classify(err error) (error, bool) {
+	if s.retriable == nil {
+		return isRateLimited(err)
+	}
+	return err, !s.retriable(err)
+}
+
 func isRateLimited(err error) (error, bool) {
 	e, ok := err.(*googleapi.Error)
 	return err, !(ok && (e.Code == 429 ||
@@ -51,64 +238,123 @@ func isRateLimited(err error) (error, bool) {
 			strings.Contains(strings.ToLower(e.Message), "quota exceeded")))))
 }
 
-func (s *restGmailService) GetRawMessage(id string) (string, error) {
-	var r *gmail.Message
+// retryAfter returns the wait requested by the Retry-After header of an API
+// error, given either in seconds or as an HTTP date, or 0 if there is none.
+func retryAfter(err error) time.Duration {
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		return 0
+	}
+	v := e.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func (s *restGmailService) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	var m *gmail.Message
 	var err error
-	err = s.limiter.DoWithBackoff(func() (error, bool) {
-		r, err = s.svc.Messages.Get("me", id).Format("raw").Do()
-		return isRateLimited(err)
+	err = s.do(ctx, func() error {
+		m, err = s.svc.Messages.Get("me", id).Format("raw").Context(ctx).Do()
+		return err
 	})
-	if r != nil {
-		return r.Raw, err
-	}
-	return "", err
+	return m, err
 }
 
-func (s *restGmailService) GetMetadata(id string) (*gmail.Message, error) {
+func (s *restGmailService) GetFullMessage(ctx context.Context, id string) (*gmail.Message, error) {
 	var m *gmail.Message
 	var err error
-	err = s.limiter.DoWithBackoff(func() (error, bool) {
-		m, err = s.svc.Messages.Get("me", id).Format("metadata").Do()
-		return isRateLimited(err)
+	err = s.do(ctx, func() error {
+		m, err = s.svc.Messages.Get("me", id).Format("full").Context(ctx).Do()
+		return err
 	})
 	return m, err
 }
 
-func (s *restGmailService) GetLabels() (*gmail.ListLabelsResponse, error) {
+func (s *restGmailService) GetMetadata(ctx context.Context, id string) (*gmail.Message, error) {
+	var m *gmail.Message
+	var err error
+	err = s.do(ctx, func() error {
+		m, err = s.svc.Messages.Get("me", id).Format("metadata").Context(ctx).Do()
+		return err
+	})
+	return m, err
+}
+
+func (s *restGmailService) GetLabels(ctx context.Context) (*gmail.ListLabelsResponse, error) {
 	var r *gmail.ListLabelsResponse
 	var err error
-	err = s.limiter.DoWithBackoff(func() (error, bool) {
-		r, err = s.svc.Labels.List("me").Do()
-		return isRateLimited(err)
+	err = s.do(ctx, func() error {
+		r, err = s.svc.Labels.List("me").Context(ctx).Do()
+		return err
+	})
+	return r, err
+}
+
+func (s *restGmailService) GetLabel(ctx context.Context, id string) (*gmail.Label, error) {
+	var r *gmail.Label
+	var err error
+	err = s.do(ctx, func() error {
+		r, err = s.svc.Labels.Get("me", id).Context(ctx).Do()
+		return err
 	})
 	return r, err
 }
 
-func (s *restGmailService) GetHistory(historyIndex uint64, labelId, page string) (*gmail.ListHistoryResponse, error) {
+func (s *restGmailService) GetHistory(ctx context.Context, historyIndex uint64, labelId string, types []string, page string) (*gmail.ListHistoryResponse, error) {
 	hist := s.svc.History.List("me").StartHistoryId(historyIndex)
 	if labelId != "" {
 		hist.LabelId(labelId)
 	}
+	if len(types) > 0 {
+		hist.HistoryTypes(types...)
+	}
 	var r *gmail.ListHistoryResponse
 	var err error
-	err = s.limiter.DoWithBackoff(func() (error, bool) {
-		r, err = hist.PageToken(page).Do()
-		return isRateLimited(err)
+	err = s.do(ctx, func() error {
+		r, err = hist.PageToken(page).Context(ctx).Do()
+		return err
 	})
 	return r, err
 }
 
-func (s *restGmailService) GetMessages(labelId, page string) (*gmail.ListMessagesResponse, error) {
-	// XXX: -in:chats to skip non-email results that the API returns.
-	msgs := s.svc.Messages.List("me").Q("-in:chats")
+func (s *restGmailService) GetMessages(ctx context.Context, labelId, q, page string) (*gmail.ListMessagesResponse, error) {
+	msgs := s.svc.Messages.List("me").Q(q)
 	if labelId != "" {
 		msgs.LabelIds(labelId)
 	}
 	var r *gmail.ListMessagesResponse
 	var err error
-	err = s.limiter.DoWithBackoff(func() (error, bool) {
-		r, err = msgs.PageToken(page).Do()
-		return isRateLimited(err)
+	err = s.do(ctx, func() error {
+		r, err = msgs.PageToken(page).Context(ctx).Do()
+		return err
+	})
+	return r, err
+}
+
+func (s *restGmailService) GetDrafts(ctx context.Context, page string) (*gmail.ListDraftsResponse, error) {
+	var r *gmail.ListDraftsResponse
+	var err error
+	err = s.do(ctx, func() error {
+		r, err = s.svc.Drafts.List("me").PageToken(page).Context(ctx).Do()
+		return err
+	})
+	return r, err
+}
+
+func (s *restGmailService) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	var r *gmail.Profile
+	var err error
+	err = s.do(ctx, func() error {
+		r, err = s.svc.GetProfile("me").Context(ctx).Do()
+		return err
 	})
 	return r, err
 }
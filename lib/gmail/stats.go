@@ -0,0 +1,64 @@
+package gmail
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// labelCounts returns how many cached messages carry each label, and the
+// total number of messages.
+func (c *gmailCache) labelCounts() (map[string]int, int) {
+	counts := make(map[string]int)
+	total := 0
+	for m := range c.msgSet() {
+		total++
+		ls, _ := c.GetMsgLabels(m)
+		for _, l := range ls {
+			counts[l]++
+		}
+	}
+	return counts, total
+}
+
+// writeLabelStats writes to w a line per label with the number of messages
+// carrying it, most common first, followed by the total. Messages can carry
+// several labels or none, so the counts needn't add up to the total.
+func writeLabelStats(w io.Writer, counts map[string]int, total int) error {
+	ls := make([]string, 0, len(counts))
+	for l := range counts {
+		ls = append(ls, l)
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		if counts[ls[i]] != counts[ls[j]] {
+			return counts[ls[i]] > counts[ls[j]]
+		}
+		return ls[i] < ls[j]
+	})
+	for _, l := range ls {
+		if _, err := fmt.Fprintf(w, "%8d  %v\n", counts[l], l); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%8d  messages in total\n", total)
+	return err
+}
+
+// LabelStats writes to w how many stored messages carry each label, from the
+// cache.
+func (g *Gmail) LabelStats(w io.Writer) error {
+	counts, total := g.cache.labelCounts()
+	return writeLabelStats(w, counts, total)
+}
+
+// CacheLabelStats is LabelStats for the cache file f, opened read-only, so it
+// needs no credentials.
+func CacheLabelStats(f string, w io.Writer) error {
+	c, b, err := openCacheFile(f)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	counts, total := c.labelCounts()
+	return writeLabelStats(w, counts, total)
+}
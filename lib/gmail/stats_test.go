@@ -0,0 +1,48 @@
+package gmail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLabelStats(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	c, f := newTestCacheFile(d, "cache")
+	for id, ls := range map[string][]string{
+		"1": {"INBOX", "STARRED"},
+		"2": {"INBOX"},
+		"3": {"Work", "INBOX"},
+		"4": {"Work"},
+		"5": nil,
+	} {
+		c.SetMsgKey(id, "k")
+		if ls != nil {
+			c.SetMsgLabels(id, ls)
+		}
+	}
+	counts, total := c.labelCounts()
+	for l, n := range map[string]int{"INBOX": 3, "Work": 2, "STARRED": 1} {
+		if counts[l] != n {
+			t.Errorf(`labelCounts()[%v] = %v, expected %v`, l, counts[l], n)
+		}
+	}
+	if len(counts) != 3 || total != 5 {
+		t.Errorf(`labelCounts() = %v, %v, expected 3 labels and 5 messages`, counts, total)
+	}
+	c.Cache.Close()
+
+	out := new(bytes.Buffer)
+	if err := CacheLabelStats(f, out); err != nil {
+		t.Fatalf(`CacheLabelStats() = %v, expected nil`, err)
+	}
+	want := "       3  INBOX\n       2  Work\n       1  STARRED\n       5  messages in total\n"
+	if out.String() != want {
+		t.Errorf(`CacheLabelStats() wrote %q, expected %q`, out.String(), want)
+	}
+}
@@ -0,0 +1,97 @@
+package gmail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+// threadIndex maps a Gmail thread ID to the maildir keys of its messages,
+// oldest first.
+type threadIndex map[string][]maildir.Key
+
+// markThread records that a thread's membership or keys changed during this
+// sync, so its entry in the thread index needs to be recomputed. It must be
+// called with g.mu held.
+func (g *Gmail) markThread(id string) {
+	if g.threadIndex == "" {
+		return
+	}
+	t, _, ok := g.cache.GetMsgThread(id)
+	if !ok {
+		return
+	}
+	if g.dirtyThreads == nil {
+		g.dirtyThreads = make(map[string]struct{})
+	}
+	g.dirtyThreads[t] = struct{}{}
+}
+
+// threadKeys returns the maildir keys of a thread's messages, ordered by date.
+func (g *Gmail) threadKeys(t string) []maildir.Key {
+	type entry struct {
+		key  maildir.Key
+		date int64
+	}
+	es := []entry{}
+	for _, m := range g.cache.GetThreadMsgs(t) {
+		k, ok := g.cache.GetMsgKey(m)
+		if !ok {
+			continue
+		}
+		_, d, _ := g.cache.GetMsgThread(m)
+		es = append(es, entry{k, d})
+	}
+	sort.SliceStable(es, func(i, j int) bool { return es[i].date < es[j].date })
+	ks := make([]maildir.Key, len(es))
+	for i, e := range es {
+		ks[i] = e.key
+	}
+	return ks
+}
+
+// writeThreadIndex updates the thread index file. If the file already exists
+// only the threads touched by this sync are recomputed; otherwise the whole
+// index is built from the cache.
+func (g *Gmail) writeThreadIndex() error {
+	if g.threadIndex == "" {
+		return nil
+	}
+	idx := threadIndex{}
+	dirty := g.dirtyThreads
+	if bs, err := ioutil.ReadFile(g.threadIndex); err == nil {
+		if err := json.Unmarshal(bs, &idx); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		dirty = make(map[string]struct{})
+		ts := make(chan string)
+		g.cache.GetThreads(ts)
+		for t := range ts {
+			dirty[t] = struct{}{}
+		}
+	} else {
+		return err
+	}
+	for t := range dirty {
+		if ks := g.threadKeys(t); len(ks) > 0 {
+			idx[t] = ks
+		} else {
+			delete(idx, t)
+		}
+	}
+	bs, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see a partial index.
+	tmp := g.threadIndex + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	g.dirtyThreads = nil
+	return os.Rename(tmp, g.threadIndex)
+}
@@ -0,0 +1,161 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// How soon after the token was replaced a rejection by the API is put down
+// to a request that was already in flight, rather than the new token.
+const tokenRefreshWindow = 10 * time.Second
+
+// How long signing in again mid-sync may take before the sync gives up.
+const reauthTimeout = 5 * time.Minute
+
+// errReauthNeeded is returned when the refresh token stops working in a run
+// that nobody can sign in to, such as one from cron.
+var errReauthNeeded = errors.New("the stored OAuth token was revoked or has expired; run outtake from a terminal to sign in again")
+
+// cachedTokenSource supplies the interactive flow's OAuth token, refreshing
+// it as it expires and writing each new token back to the cache, so the next
+// run starts with it. If the refresh token has been revoked or has expired,
+// the cached token is cleared and the interactive flow run again.
+type cachedTokenSource struct {
+	ctx   context.Context
+	cfg   *oauth2.Config
+	cache gmailCache
+	// Guards the rest.
+	mu sync.Mutex
+	// Refreshes tok when it expires.
+	src oauth2.TokenSource
+	tok *oauth2.Token
+	// When tok was last replaced.
+	replaced time.Time
+	// The refresh in progress, if any.
+	flight *tokenRefresh
+}
+
+// tokenRefresh is a refresh in progress. Callers that need a new token while
+// it runs wait for its result rather than starting their own, which would
+// race to write the cache, and may revoke the token the first one got.
+type tokenRefresh struct {
+	done chan struct{}
+	tok  *oauth2.Token
+	err  error
+}
+
+func newCachedTokenSource(ctx context.Context, cfg *oauth2.Config, cache gmailCache, tok *oauth2.Token) *cachedTokenSource {
+	return &cachedTokenSource{ctx: ctx, cfg: cfg, cache: cache, tok: tok, src: refreshingSource(cfg, ctx, tok)}
+}
+
+// client returns a client authorized by s, over the context's client.
+func (s *cachedTokenSource) client() *http.Client {
+	// Not oauth2.NewClient(ctx, s), whose own reuse of the token would keep
+	// expire from taking effect.
+	return &http.Client{Transport: &oauth2.Transport{Source: s, Base: oauth2.NewClient(s.ctx, nil).Transport}}
+}
+
+func (s *cachedTokenSource) Token() (*oauth2.Token, error) {
+	return s.refresh(false)
+}
+
+// expire refreshes the token after the API rejected it, as it does once the
+// token is revoked, returning whether retrying the request may now succeed.
+// If the token was replaced just now, it's left be: the rejected request
+// likely used the old one.
+func (s *cachedTokenSource) expire() bool {
+	_, err := s.refresh(true)
+	return err == nil
+}
+
+// refresh returns the token, refreshing it if it has expired, or if force is
+// set and it wasn't replaced within tokenRefreshWindow. Only one refresh runs
+// at a time: callers that come while one does share its result.
+func (s *cachedTokenSource) refresh(force bool) (*oauth2.Token, error) {
+	s.mu.Lock()
+	if f := s.flight; f != nil {
+		s.mu.Unlock()
+		<-f.done
+		return f.tok, f.err
+	}
+	if t := s.tok; !force && t.Valid() || force && time.Since(s.replaced) < tokenRefreshWindow {
+		s.mu.Unlock()
+		return t, nil
+	}
+	src := s.src
+	if force {
+		if s.tok.RefreshToken == "" {
+			s.mu.Unlock()
+			return nil, errors.New("the OAuth token was rejected and can't be refreshed")
+		}
+		// A token without an access token is never valid, so it's refreshed.
+		src = refreshingSource(s.cfg, s.ctx, &oauth2.Token{RefreshToken: s.tok.RefreshToken})
+	}
+	f := &tokenRefresh{done: make(chan struct{})}
+	s.flight = f
+	s.mu.Unlock()
+
+	f.tok, f.err = src.Token()
+	if invalidGrant(f.err) {
+		log.Println("Stored OAuth token can no longer be refreshed; re-authenticating.", f.err)
+		f.tok, src, f.err = s.reauthenticate()
+	}
+	s.mu.Lock()
+	if f.err == nil {
+		s.src = src
+		if f.tok.AccessToken != s.tok.AccessToken {
+			s.tok, s.replaced = f.tok, time.Now()
+			s.cache.SetOauthToken(f.tok)
+		}
+	}
+	s.flight = nil
+	s.mu.Unlock()
+	close(f.done)
+	return f.tok, f.err
+}
+
+// reauthenticate clears the cached token and runs the interactive flow for a
+// new one, returning it and a source to refresh it. Without a terminal, no
+// one is there to sign in, so it fails rather than wait, as it also does if
+// signing in takes longer than reauthTimeout.
+func (s *cachedTokenSource) reauthenticate() (*oauth2.Token, oauth2.TokenSource, error) {
+	if !interactive() {
+		// Keep the token, so that later unattended runs fail the same way
+		// rather than wait for a sign-in.
+		return nil, nil, errReauthNeeded
+	}
+	s.cache.DelOauthToken()
+	ctx, cancel := context.WithTimeout(s.ctx, reauthTimeout)
+	defer cancel()
+	// Without the old grant, Google only issues a refresh token if consent
+	// is given again.
+	t, err := getOAuthToken(ctx, s.cfg, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
+	if err == context.DeadlineExceeded {
+		return nil, nil, fmt.Errorf("signing in again: no response within %v", reauthTimeout)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	s.cache.SetOauthClientId(s.cfg.ClientID)
+	return t, refreshingSource(s.cfg, s.ctx, t), nil
+}
+
+// stdinIsTerminal reports whether standard input is a terminal.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// invalidGrant reports whether err is the token endpoint's refusal of a
+// revoked or expired refresh token.
+func invalidGrant(err error) bool {
+	var e *oauth2.RetrieveError
+	return errors.As(err, &e) && e.ErrorCode == "invalid_grant"
+}
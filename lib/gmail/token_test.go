@@ -0,0 +1,171 @@
+package gmail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danmarg/outtake/lib/oauth"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// fakeTokenSource returns tok, or err if it's set, after delay, counting
+// calls.
+type fakeTokenSource struct {
+	tok   *oauth2.Token
+	err   error
+	delay time.Duration
+	calls int32
+}
+
+func (f *fakeTokenSource) Token() (*oauth2.Token, error) {
+	atomic.AddInt32(&f.calls, 1)
+	time.Sleep(f.delay)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.tok, nil
+}
+
+func TestCachedTokenSource(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	fake := &fakeTokenSource{tok: &oauth2.Token{AccessToken: "refreshed", RefreshToken: "r1", Expiry: expired}}
+	refreshingSource = func(_ *oauth2.Config, _ context.Context, t *oauth2.Token) oauth2.TokenSource {
+		if t.AccessToken == "new" {
+			return oauth2.StaticTokenSource(t)
+		}
+		return fake
+	}
+	defer func() { refreshingSource = (*oauth2.Config).TokenSource }()
+	launched := 0
+	getOAuthToken = func(ctx context.Context, cfg *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+		launched++
+		return &oauth2.Token{AccessToken: "new", RefreshToken: "r2"}, nil
+	}
+	defer func() { getOAuthToken = oauth.GetOAuthClient }()
+	interactive = func() bool { return true }
+	defer func() { interactive = stdinIsTerminal }()
+	c := newTestCache()
+	old := &oauth2.Token{AccessToken: "old", RefreshToken: "r1", Expiry: expired}
+	c.SetOauthToken(old)
+	s := newCachedTokenSource(context.Background(), testOAuthConfig(), c, old)
+	// A refreshed token is written back.
+	if tok, err := s.Token(); err != nil || tok.AccessToken != "refreshed" {
+		t.Errorf(`Token() = %v, %v, expected the refreshed token`, tok, err)
+	}
+	if tok, _ := c.GetOauthToken(); tok.AccessToken != "refreshed" {
+		t.Errorf(`GetOauthToken() = %v, expected the refreshed token`, tok)
+	}
+	// Once the refresh token is revoked, the interactive flow runs again.
+	fake.err = &oauth2.RetrieveError{Response: &http.Response{StatusCode: 400}, ErrorCode: "invalid_grant"}
+	if tok, err := s.Token(); err != nil || tok.AccessToken != "new" || launched != 1 {
+		t.Errorf(`Token() = %v, %v, launched %v times, expected a new token from 1 launch`, tok, err, launched)
+	}
+	if tok, _ := c.GetOauthToken(); tok.AccessToken != "new" || tok.RefreshToken != "r2" {
+		t.Errorf(`GetOauthToken() = %v, expected the new token`, tok)
+	}
+	if tok, err := s.Token(); err != nil || tok.AccessToken != "new" || launched != 1 {
+		t.Errorf(`Token() = %v, %v, launched %v times, expected the new token again`, tok, err, launched)
+	}
+	// Without a terminal, nobody can sign in, so it fails at once.
+	interactive = func() bool { return false }
+	s = newCachedTokenSource(context.Background(), testOAuthConfig(), c, old)
+	if tok, err := s.Token(); err != errReauthNeeded || launched != 1 {
+		t.Errorf(`Token() without a terminal = %v, %v, launched %v times, expected %v`, tok, err, launched, errReauthNeeded)
+	}
+}
+
+func TestExpireToken(t *testing.T) {
+	refreshes := 0
+	refreshingSource = func(_ *oauth2.Config, _ context.Context, t *oauth2.Token) oauth2.TokenSource {
+		if t.AccessToken != "" {
+			return oauth2.StaticTokenSource(t)
+		}
+		refreshes++
+		return &fakeTokenSource{tok: &oauth2.Token{AccessToken: "fresh", RefreshToken: t.RefreshToken}}
+	}
+	defer func() { refreshingSource = (*oauth2.Config).TokenSource }()
+	c := newTestCache()
+	s := newCachedTokenSource(context.Background(), testOAuthConfig(), c, &oauth2.Token{AccessToken: "revoked", RefreshToken: "r1"})
+	// The API rejects the revoked token once, and the request is retried.
+	ok := batchServer(t, map[string]string{"0x1": "one"})
+	defer ok.Close()
+	requests := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, `{"error": {"code": 401, "message": "Invalid Credentials"}}`, http.StatusUnauthorized)
+			return
+		}
+		ok.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	r := newRestGmailService(nil, s.client(), nil, nil)
+	defer r.limiter.Stop()
+	r.batchURL = srv.URL
+	r.limiter.BackoffStart = time.Millisecond
+	r.limiter.OnSuccess = nil
+	// The retry is immediate, not a backoff.
+	r.limiter.OnBackoff = func(err error, _ time.Duration) { t.Errorf(`GetRawMessages() backed off after %v`, err) }
+	r.unauthorized = s.expire
+	if ms, err := r.GetRawMessages(context.Background(), []string{"0x1"}); err != nil || len(ms) != 1 || ms[0] == nil {
+		t.Errorf(`GetRawMessages() = %v, %v, expected the message after a refresh`, ms, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 || refreshes != 1 {
+		t.Errorf(`GetRawMessages() made %v requests and %v refreshes, expected 2 and 1`, n, refreshes)
+	}
+	if tok, _ := c.GetOauthToken(); tok == nil || tok.AccessToken != "fresh" {
+		t.Errorf(`GetOauthToken() = %v, expected the fresh token`, tok)
+	}
+	// Rejections right after a refresh don't refresh again.
+	if !s.expire() || refreshes != 1 {
+		t.Errorf(`expire() refreshed %v times, expected 1`, refreshes)
+	}
+}
+
+func TestConcurrentTokenRefresh(t *testing.T) {
+	fake := &fakeTokenSource{tok: &oauth2.Token{AccessToken: "fresh", RefreshToken: "r1"}, delay: 50 * time.Millisecond}
+	refreshingSource = func(_ *oauth2.Config, _ context.Context, t *oauth2.Token) oauth2.TokenSource {
+		if t.AccessToken != "" {
+			return oauth2.StaticTokenSource(t)
+		}
+		return fake
+	}
+	defer func() { refreshingSource = (*oauth2.Config).TokenSource }()
+	s := newCachedTokenSource(context.Background(), testOAuthConfig(), newTestCache(), &oauth2.Token{AccessToken: "revoked", RefreshToken: "r1"})
+	// Every worker's request is rejected at once.
+	ok := batchServer(t, map[string]string{"0x1": "one"})
+	defer ok.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, `{"error": {"code": 401, "message": "Invalid Credentials"}}`, http.StatusUnauthorized)
+			return
+		}
+		ok.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	r := newRestGmailService(nil, s.client(), nil, nil)
+	defer r.limiter.Stop()
+	r.batchURL = srv.URL
+	r.limiter.BackoffStart = time.Millisecond
+	r.limiter.OnBackoff, r.limiter.OnSuccess = nil, nil
+	r.unauthorized = s.expire
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ms, err := r.GetRawMessages(context.Background(), []string{"0x1"}); err != nil || len(ms) != 1 || ms[0] == nil {
+				t.Errorf(`GetRawMessages() = %v, %v, expected the message after a refresh`, ms, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fake.calls); n != 1 {
+		t.Errorf(`GetRawMessages() refreshed the token %v times, expected 1`, n)
+	}
+}
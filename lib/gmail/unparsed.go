@@ -0,0 +1,62 @@
+package gmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Set on synthetic messages wrapping content that isn't RFC 822, to the
+	// kind of content and why it couldn't be parsed.
+	unparsedHeader = "X-Outtake-Unparsed"
+	chatLabel      = "CHAT"
+)
+
+// classifyRaw guesses what unparseable raw message content is, returning a
+// short kind and a Content-Type for it.
+func classifyRaw(raw []byte) (string, string) {
+	switch {
+	case bytes.Contains(raw, []byte("BEGIN:VCALENDAR")):
+		return "calendar", "text/calendar; charset=utf-8"
+	case utf8.Valid(raw):
+		return "text", "text/plain; charset=utf-8"
+	default:
+		return "binary", "application/octet-stream"
+	}
+}
+
+// wrapUnparsed wraps raw content that mail.ReadMessage rejected, such as a
+// chat or some calendar invitations, in a synthetic message, so that it's
+// stored rather than dropped. The content becomes the body, base64-encoded if
+// it isn't text.
+func wrapUnparsed(id string, raw []byte, err error) *mail.Message {
+	kind, ct := classifyRaw(raw)
+	h := mail.Header{
+		"Content-Type": {ct},
+		"Message-Id":   {"<" + id + "@outtake.invalid>"},
+		"Subject":      {fmt.Sprintf("Unparsed %v message %v", kind, id)},
+		unparsedHeader: {kind + "; " + strings.Join(strings.Fields(err.Error()), " ")},
+	}
+	body := raw
+	if kind == "binary" {
+		h["Content-Transfer-Encoding"] = []string{"base64"}
+		body = []byte(base64.StdEncoding.EncodeToString(raw))
+	}
+	return &mail.Message{Header: h, Body: bytes.NewReader(body)}
+}
+
+// classifyUnparsed refines the kind of a wrapped message from its labels,
+// which aren't known when it's wrapped.
+func classifyUnparsed(m *mail.Message, labels []string) {
+	v := m.Header.Get(unparsedHeader)
+	if v == "" || !containsLabel(labels, chatLabel) {
+		return
+	}
+	if i := strings.Index(v, ";"); i >= 0 {
+		m.Header[unparsedHeader] = []string{"chat" + v[i:]}
+	}
+}
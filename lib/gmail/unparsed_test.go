@@ -0,0 +1,64 @@
+package gmail
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestUnparsedMessagesKept(t *testing.T) {
+	c, svc, _ := getTestClient()
+	cal := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nDTSTART;TZID=Europe/London:20260101T120000\r\nSUMMARY:Lunch\r\nLunch at noon\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	chat := "\xff\xfe not a header"
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte(cal))
+	svc.Msgs["0x2"] = base64.URLEncoding.EncodeToString([]byte(chat))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"CHAT"}}
+	if err := c.Sync(context.Background(), false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	for _, x := range []struct {
+		id, kind, contentType, body string
+	}{
+		{"0x1", "calendar", "text/calendar; charset=utf-8", cal},
+		{"0x2", "chat", "application/octet-stream", base64.StdEncoding.EncodeToString([]byte(chat))},
+	} {
+		k, ok := c.cache.GetMsgKey(x.id)
+		if !ok {
+			t.Errorf(`GetMsgKey(%v) = false, expected the message to be stored`, x.id)
+			continue
+		}
+		f, err := c.dir.GetFile(k)
+		if err != nil {
+			t.Fatalf(`GetFile(%v) = %v, expected no error`, k, err)
+		}
+		r, err := os.Open(f)
+		if err != nil {
+			t.Fatalf(`Open(%v) = %v, expected no error`, f, err)
+		}
+		defer r.Close()
+		m, err := mail.ReadMessage(r)
+		if err != nil {
+			t.Fatalf(`ReadMessage(%v) = %v, expected a valid wrapper`, f, err)
+		}
+		if h := m.Header.Get(unparsedHeader); !strings.HasPrefix(h, x.kind+";") {
+			t.Errorf(`%v header of %v = %q, expected kind %v`, unparsedHeader, x.id, h, x.kind)
+		}
+		if ct := m.Header.Get("Content-Type"); ct != x.contentType {
+			t.Errorf(`Content-Type of %v = %q, expected %q`, x.id, ct, x.contentType)
+		}
+		if bs, _ := ioutil.ReadAll(m.Body); strings.TrimLeft(string(bs), "\r\n") != x.body {
+			t.Errorf(`body of %v = %q, expected %q`, x.id, bs, x.body)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/danmarg/outtake/lib"
+	"github.com/danmarg/outtake/lib/maildir"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// Verify compares the X-Keywords of stored messages with their current labels
+// on the server, writing a line to w for each message that differs, and
+// returns how many do. Such drift means history events were missed. With
+// sample > 0, only that many messages, chosen at random, are checked. With
+// repair, differing messages are relabeled (or deleted, if gone from the
+// server) to match.
+func (g *Gmail) Verify(ctx context.Context, w io.Writer, sample int, repair bool) (int, error) {
+	ms := make(chan string)
+	g.cache.GetMsgs(ms)
+	ids := []string{}
+	for m := range ms {
+		ids = append(ids, m)
+	}
+	if sample > 0 && sample < len(ids) {
+		rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		ids = ids[:sample]
+	}
+	sort.Strings(ids)
+	n := 0
+	for _, id := range ids {
+		local, err := g.storedKeywords(id)
+		if errors.Is(err, lib.ErrAppendOnly) {
+			return n, errors.New("can't verify an append-only store")
+		} else if err != nil && !errors.Is(err, maildir.ErrNotExist) {
+			return n, err
+		}
+		// Copies stored before keywords held names carry label IDs instead:
+		// compare those by name.
+		for i, k := range local {
+			local[i] = g.labelName(ctx, k)
+		}
+		cached, _ := g.cache.GetMsgLabels(id)
+		o := msgOp{Id: id, Draft: containsLabel(cached, draftLabel)}
+		if err := g.getMetaData(ctx, &o); err != nil {
+			if e, ok := err.(*googleapi.Error); !ok || e.Code != 404 {
+				return n, err
+			}
+			n++
+			fmt.Fprintf(w, "%v: deleted on the server\n", id)
+			if repair && !g.onlyNew {
+				if err := g.writeDel(id); err != nil {
+					return n, err
+				}
+			}
+			continue
+		}
+		want := g.keywordsForLabels(ctx, o.Labels)
+		if local == nil {
+			fmt.Fprintf(w, "%v: missing from the Maildir\n", id)
+		} else if sameLabels(local, want) {
+			continue
+		} else {
+			fmt.Fprintf(w, "%v: stored [%v], server [%v]\n", id, strings.Join(local, " "), strings.Join(want, " "))
+		}
+		n++
+		if repair {
+			if err := g.writeLabels(ctx, id, o.Labels, true); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// storedKeywords returns the X-Keywords of the stored copy of message id, or
+// nil and maildir.ErrNotExist if there is none.
+func (g *Gmail) storedKeywords(id string) ([]string, error) {
+	k, ok := g.cache.GetMsgKey(id)
+	if !ok {
+		return nil, maildir.ErrNotExist
+	}
+	m, c, err := g.getMaildirMessage(k)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	ks := []string{}
+	for _, h := range m.Header[labelsHeader] {
+		ks = append(ks, parseKeywords(h)...)
+	}
+	return ks, nil
+}
@@ -0,0 +1,80 @@
+package gmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestVerify(t *testing.T) {
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	svc.Msgs["0x1"] = m
+	svc.Msgs["0x2"] = m
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{
+		Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}},
+	}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	buf := new(bytes.Buffer)
+	if n, err := c.Verify(context.Background(), buf, 0, false); n != 0 || err != nil {
+		t.Fatalf(`Verify() = %v, %v, expected 0, nil; wrote %q`, n, err, buf.String())
+	}
+	// A label change whose history event was missed.
+	svc.Metadata["0x2"] = &gmail.Message{HistoryId: 2, LabelIds: []string{"INBOX", "STARRED"}}
+	n, err := c.Verify(context.Background(), buf, 0, false)
+	if n != 1 || err != nil {
+		t.Fatalf(`Verify() = %v, %v, expected 1, nil`, n, err)
+	}
+	if want := "0x2: stored [INBOX], server [INBOX Starred]\n"; buf.String() != want {
+		t.Errorf(`Verify() wrote %q, expected %q`, buf.String(), want)
+	}
+	// Sampling checks at most that many messages, and without repair the
+	// drift remains.
+	buf.Reset()
+	if n, _ := c.Verify(context.Background(), buf, 1, false); n > 1 {
+		t.Errorf(`Verify() with sample 1 = %v, expected at most 1`, n)
+	}
+	if n, err := c.Verify(context.Background(), buf, 0, true); n != 1 || err != nil {
+		t.Fatalf(`Verify() with repair = %v, %v, expected 1, nil`, n, err)
+	}
+	ks, err := c.storedKeywords("0x2")
+	if err != nil || strings.Join(ks, ",") != "INBOX,Starred" {
+		t.Errorf(`storedKeywords(0x2) = %v, %v, expected INBOX,Starred`, ks, err)
+	}
+	buf.Reset()
+	if n, err := c.Verify(context.Background(), buf, 0, false); n != 0 || err != nil {
+		t.Errorf(`Verify() after repair = %v, %v, expected 0, nil; wrote %q`, n, err, buf.String())
+	}
+}
+
+func TestVerifyLabelIds(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Msgs["0x1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\n\nbody"))
+	// The label's name can't be found, so its ID is stored, as it was
+	// before keywords held names.
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{HistoryId: 1, LabelIds: []string{"INBOX", "Label_42"}}
+	if err := c.Sync(context.Background(), true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if ks, err := c.storedKeywords("0x1"); err != nil || strings.Join(ks, ",") != "INBOX,Label_42" {
+		t.Fatalf(`storedKeywords(0x1) = %v, %v, expected INBOX,Label_42`, ks, err)
+	}
+	// In a later run, the name is known. The stored ID is the same label.
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "INBOX", Name: "INBOX"}, {Id: "Label_42", Name: "Work"}}}
+	c.labelDisplay, c.labelsRefreshed = nil, false
+	buf := new(bytes.Buffer)
+	if n, err := c.Verify(context.Background(), buf, 0, false); n != 0 || err != nil {
+		t.Errorf(`Verify() = %v, %v, expected 0, nil; wrote %q`, n, err, buf.String())
+	}
+}
@@ -0,0 +1,66 @@
+package gmail
+
+import "sync"
+
+// historyWatermark tracks how far through a history window incremental sync
+// has got. Operations from different history records are applied out of
+// order across shards, so the latest record seen isn't a safe checkpoint;
+// the watermark is the latest record for which it and every earlier record
+// have had all their operations applied.
+type historyWatermark struct {
+	mu sync.Mutex
+	// Records not yet fully applied, in history order, and the number of
+	// their operations outstanding.
+	records []uint64
+	pending map[uint64]int
+	done    uint64
+}
+
+func newHistoryWatermark() *historyWatermark {
+	return &historyWatermark{pending: make(map[uint64]int)}
+}
+
+// start registers history record id, which must follow every record already
+// registered. It counts as outstanding until finish is called, so that it
+// isn't passed while its operations are still being enqueued.
+func (w *historyWatermark) start(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.records = append(w.records, id)
+	w.pending[id] = 1
+}
+
+// add records another operation outstanding for record id.
+func (w *historyWatermark) add(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[id]++
+}
+
+// finish marks record id as having had all its operations enqueued.
+func (w *historyWatermark) finish(id uint64) {
+	w.applied(id)
+}
+
+// applied marks one operation of record id as applied.
+func (w *historyWatermark) applied(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.pending[id]; !ok {
+		return
+	}
+	w.pending[id]--
+	for len(w.records) > 0 && w.pending[w.records[0]] == 0 {
+		w.done = w.records[0]
+		delete(w.pending, w.done)
+		w.records = w.records[1:]
+	}
+}
+
+// mark returns the latest record applied along with all before it, or 0 if
+// there is none.
+func (w *historyWatermark) mark() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.done
+}
@@ -0,0 +1,66 @@
+package gmail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// tokenInfoURL describes an OAuth access token; a variable for testing.
+var tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// grantedScopes asks Google which scopes the current access token from ts
+// carries.
+func grantedScopes(clt *http.Client, ts oauth2.TokenSource) ([]string, error) {
+	tok, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := clt.Get(tokenInfoURL + "?" + url.Values{"access_token": {tok.AccessToken}}.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Scope string `json:"scope"`
+		Error string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("decoding token info: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token info: %v %v", resp.Status, info.Error)
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+// WhoAmI writes to w the account the credentials belong to and, if they can
+// be looked up, the OAuth scopes granted, to help diagnose permission errors.
+func (g *Gmail) WhoAmI(ctx context.Context, w io.Writer) error {
+	p, err := g.svc.GetProfile(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Account: %v\n", p.EmailAddress)
+	fmt.Fprintf(w, "Messages: %d, threads: %d\n", p.MessagesTotal, p.ThreadsTotal)
+	if g.tokens == nil {
+		fmt.Fprintln(w, "Scopes: unknown")
+		return nil
+	}
+	clt := g.base
+	if clt == nil {
+		clt = http.DefaultClient
+	}
+	if scopes, err := grantedScopes(clt, g.tokens); err != nil {
+		fmt.Fprintf(w, "Scopes: unknown (%v)\n", err)
+	} else {
+		fmt.Fprintf(w, "Scopes: %v\n", strings.Join(scopes, " "))
+	}
+	return nil
+}
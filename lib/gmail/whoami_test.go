@@ -0,0 +1,62 @@
+package gmail
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestWhoAmI(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Profile = &gmail.Profile{EmailAddress: "me@example.com", MessagesTotal: 12, ThreadsTotal: 7}
+	buf := new(bytes.Buffer)
+	if err := c.WhoAmI(context.Background(), buf); err != nil {
+		t.Fatalf(`WhoAmI() = %v, expected no error`, err)
+	}
+	want := "Account: me@example.com\nMessages: 12, threads: 7\nScopes: unknown\n"
+	if buf.String() != want {
+		t.Errorf(`WhoAmI() wrote %q, expected %q`, buf.String(), want)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_token") != "tok" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error_description": "Invalid Value"}`)
+			return
+		}
+		fmt.Fprint(w, `{"scope": "https://www.googleapis.com/auth/gmail.readonly openid"}`)
+	}))
+	defer srv.Close()
+	defer func(u string) { tokenInfoURL = u }(tokenInfoURL)
+	tokenInfoURL = srv.URL
+	c.base = srv.Client()
+	c.tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "tok"})
+	buf.Reset()
+	if err := c.WhoAmI(context.Background(), buf); err != nil {
+		t.Fatalf(`WhoAmI() = %v, expected no error`, err)
+	}
+	if want := "Scopes: https://www.googleapis.com/auth/gmail.readonly openid\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf(`WhoAmI() wrote %q, expected it to end with %q`, buf.String(), want)
+	}
+
+	c.tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "bad"})
+	buf.Reset()
+	if err := c.WhoAmI(context.Background(), buf); err != nil {
+		t.Fatalf(`WhoAmI() = %v, expected no error`, err)
+	}
+	if !strings.Contains(buf.String(), "Scopes: unknown (token info: 400 Bad Request Invalid Value)") {
+		t.Errorf(`WhoAmI() wrote %q, expected the token info error`, buf.String())
+	}
+
+	svc.Profile = nil
+	if err := c.WhoAmI(context.Background(), buf); err == nil {
+		t.Errorf(`WhoAmI() = nil, expected the profile error`)
+	}
+}
@@ -0,0 +1,21 @@
+package lib
+
+import "log"
+
+// Quiet suppresses informational logging through Infof and Infoln. Warnings
+// and errors, logged directly with the log package, are unaffected.
+var Quiet = false
+
+// Infof logs routine progress, like log.Printf, unless Quiet is set.
+func Infof(format string, v ...interface{}) {
+	if !Quiet {
+		log.Printf(format, v...)
+	}
+}
+
+// Infoln logs routine progress, like log.Println, unless Quiet is set.
+func Infoln(v ...interface{}) {
+	if !Quiet {
+		log.Println(v...)
+	}
+}
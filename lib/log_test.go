@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestQuietInfo(t *testing.T) {
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+	defer func() { Quiet = false }()
+	Quiet = true
+	Infoln("hidden")
+	Infof("hidden %d", 1)
+	if b.Len() > 0 {
+		t.Errorf("Infoln/Infof with Quiet logged %q, expected nothing", b.String())
+	}
+	Quiet = false
+	Infoln("shown")
+	if b.Len() == 0 {
+		t.Errorf("Infoln without Quiet logged nothing")
+	}
+}
@@ -2,14 +2,16 @@
 package maildir
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/mail"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -38,11 +40,88 @@ type Key string
 // Maildir is a single maildir directory.
 type Maildir struct {
 	dir string
+	// Shared by copies of the Maildir.
+	cur *curIndex
+}
+
+// curIndex maps keys to the names of their files in "cur", which carry info
+// flags after the key, so that finding a message needn't scan the directory.
+type curIndex struct {
+	mu sync.Mutex
+	// Nil until loaded, on first use.
+	names map[Key]string
+	// The directory's modification time when loaded, and whether that can
+	// be trusted to change along with the directory.
+	mtime   time.Time
+	settled bool
+}
+
+// How coarse a file system's modification times may be. A change within
+// this long of the last leaves the directory's time as it was.
+const mtimeGranularity = time.Second
+
+// load indexes the files in dir, replacing the current index. It must be
+// called with mu held.
+func (c *curIndex) load(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	c.names = make(map[Key]string, len(fs))
+	for _, f := range fs {
+		if i := strings.Index(f.Name(), ":"); i > 0 {
+			c.names[Key(f.Name()[:i])] = f.Name()
+		}
+	}
+	c.mtime, c.settled = fi.ModTime(), time.Since(fi.ModTime()) > mtimeGranularity
+	return nil
+}
+
+// changed reports whether dir may have changed since it was loaded. It must
+// be called with mu held.
+func (c *curIndex) changed(dir string) bool {
+	if !c.settled {
+		return true
+	}
+	fi, err := os.Stat(dir)
+	return err != nil || !fi.ModTime().Equal(c.mtime)
+}
+
+// get returns the name of k's file in dir. With reload, the index is rebuilt
+// first, if dir changed since it was last loaded.
+func (c *curIndex) get(dir string, k Key, reload bool) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.names == nil || reload && c.changed(dir) {
+		if err := c.load(dir); err != nil {
+			return "", false, err
+		}
+	}
+	n, ok := c.names[k]
+	return n, ok, nil
+}
+
+func (c *curIndex) set(k Key, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.names != nil {
+		c.names[k] = name
+	}
+}
+
+func (c *curIndex) remove(k Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.names, k)
 }
 
 // Create creates a maildir rooted at dir.
 func Create(dir string) (Maildir, error) {
-	m := Maildir{dir}
+	m := Maildir{dir, &curIndex{}}
 	for _, x := range []string{cur, tmp, nw} {
 		if err := os.MkdirAll(path.Join(dir, x), 0766); err != nil {
 			return m, err
@@ -53,6 +132,13 @@ func Create(dir string) (Maildir, error) {
 
 // Deliver delivers the Message to the "new" maildir.
 func (d Maildir) Deliver(m *mail.Message) (Key, error) {
+	return d.DeliverWithFlags(m, "")
+}
+
+// DeliverWithFlags delivers the Message with the given info flags (e.g. "S"
+// for seen). Messages with flags are placed directly in "cur"; messages
+// without are placed in "new".
+func (d Maildir) DeliverWithFlags(m *mail.Message, flags string) (Key, error) {
 	k := strconv.FormatInt(time.Now().Unix(), 10) + "."
 	k += strconv.FormatInt(int64(pid), 10) + "_" + strconv.FormatUint(atomic.AddUint64(&cntr, 1), 10)
 	k += "." + hostname
@@ -75,9 +161,36 @@ func (d Maildir) Deliver(m *mail.Message) (Key, error) {
 	if _, err := io.Copy(f, m.Body); err != nil {
 		return key, err
 	}
-	return key, os.Rename(path.Join(d.dir, tmp, k), path.Join(d.dir, nw, k))
+	if flags == "" {
+		return key, os.Rename(path.Join(d.dir, tmp, k), path.Join(d.dir, nw, k))
+	}
+	name := k + ":2," + sortFlags(flags)
+	if err := os.Rename(path.Join(d.dir, tmp, k), path.Join(d.dir, cur, name)); err != nil {
+		return key, err
+	}
+	d.cur.set(key, name)
+	return key, nil
+}
+
+// sortFlags puts flags in ASCII order, as the maildir spec requires.
+func sortFlags(flags string) string {
+	fs := strings.Split(flags, "")
+	sort.Strings(fs)
+	return strings.Join(fs, "")
 }
 
+// Flags returns the info flags (e.g. "S" for seen) of the message file f, as
+// returned by GetFile. Files in "new" have none.
+func Flags(f string) string {
+	if i := strings.LastIndex(path.Base(f), ":2,"); i >= 0 {
+		return path.Base(f)[i+3:]
+	}
+	return ""
+}
+
+// ErrNotExist is returned by GetFile when no message has the key.
+var ErrNotExist = errors.New("Does not exist")
+
 // GetFile gets the file path for the specified key.
 func (d Maildir) GetFile(k Key) (string, error) {
 	// Check in new.
@@ -85,17 +198,45 @@ func (d Maildir) GetFile(k Key) (string, error) {
 	if _, err := os.Stat(f); err == nil {
 		return f, nil
 	}
-	// Check in cur.
-	fs, err := ioutil.ReadDir(path.Join(d.dir, cur))
+	// Check in cur. Mail clients rename files there to change their flags,
+	// and move them there from new, so if the index is stale, reload it. A
+	// run of misses only rescans the directory if it changed meanwhile.
+	for _, reload := range []bool{false, true} {
+		n, ok, err := d.cur.get(path.Join(d.dir, cur), k, reload)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		f := path.Join(d.dir, cur, n)
+		if _, err := os.Stat(f); err == nil {
+			return f, nil
+		}
+	}
+	return "", ErrNotExist
+}
+
+// SweepTmp removes files in "tmp" last modified more than maxAge ago, as the
+// maildir spec recommends (with 36 hours), returning the number removed. Such
+// files are left by interrupted deliveries. The caller must make sure nothing
+// else is delivering to the maildir with older files in progress.
+func (d Maildir) SweepTmp(maxAge time.Duration) (int, error) {
+	fs, err := ioutil.ReadDir(path.Join(d.dir, tmp))
 	if err != nil {
-		return "", err
+		return 0, err
 	}
+	n := 0
 	for _, f := range fs {
-		if strings.HasPrefix(f.Name(), string(k)+":") {
-			return path.Join(d.dir, cur, f.Name()), nil
+		if f.IsDir() || time.Since(f.ModTime()) <= maxAge {
+			continue
+		}
+		if err := os.Remove(path.Join(d.dir, tmp, f.Name())); err != nil && !os.IsNotExist(err) {
+			return n, err
 		}
+		n++
 	}
-	return "", fmt.Errorf("Does not exist")
+	return n, nil
 }
 
 // Delete removes the message with the specified key from cur/new.
@@ -104,5 +245,9 @@ func (d Maildir) Delete(k Key) error {
 	if err != nil {
 		return err
 	}
-	return os.Remove(f)
+	if err := os.Remove(f); err != nil {
+		return err
+	}
+	d.cur.remove(k)
+	return nil
 }
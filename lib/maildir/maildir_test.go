@@ -0,0 +1,186 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweepTmp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := Create(dir)
+	if err != nil {
+		t.Fatalf(`Create(%v) = %v, expected no error`, dir, err)
+	}
+	old := path.Join(dir, tmp, "old")
+	fresh := path.Join(dir, tmp, "fresh")
+	for _, f := range []string{old, fresh} {
+		if err := ioutil.WriteFile(f, []byte("x"), 0644); err != nil {
+			panic(err)
+		}
+	}
+	then := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(old, then, then); err != nil {
+		panic(err)
+	}
+	n, err := d.SweepTmp(36 * time.Hour)
+	if err != nil || n != 1 {
+		t.Errorf(`SweepTmp(36h) = %v, %v, expected 1, nil`, n, err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf(`Stat(%v) = %v, expected not to exist`, old, err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf(`Stat(%v) = %v, expected to exist`, fresh, err)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	for _, x := range []struct {
+		f, flags string
+	}{
+		{"/mail/new/123.4_5.host", ""},
+		{"/mail/cur/123.4_5.host:2,", ""},
+		{"/mail/cur/123.4_5.host:2,RS", "RS"},
+	} {
+		if flags := Flags(x.f); flags != x.flags {
+			t.Errorf(`Flags(%v) = %q, expected %q`, x.f, flags, x.flags)
+		}
+	}
+}
+
+func newTestMessage() *mail.Message {
+	m, err := mail.ReadMessage(strings.NewReader("Subject: hi\n\nbody"))
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func TestGetFileCur(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := Create(dir)
+	if err != nil {
+		t.Fatalf(`Create(%v) = %v, expected no error`, dir, err)
+	}
+	k, err := d.DeliverWithFlags(newTestMessage(), "S")
+	if err != nil {
+		t.Fatalf(`DeliverWithFlags() = %v, expected no error`, err)
+	}
+	f, err := d.GetFile(k)
+	if want := path.Join(dir, cur, string(k)+":2,S"); err != nil || f != want {
+		t.Errorf(`GetFile(%v) = %v, %v, expected %v`, k, f, err, want)
+	}
+	// A mail client changes its flags behind our back.
+	renamed := path.Join(dir, cur, string(k)+":2,RS")
+	if err := os.Rename(f, renamed); err != nil {
+		panic(err)
+	}
+	if f, err := d.GetFile(k); err != nil || f != renamed {
+		t.Errorf(`GetFile(%v) = %v, %v, expected %v`, k, f, err, renamed)
+	}
+	// Or moves a new message to cur.
+	k2, err := d.Deliver(newTestMessage())
+	if err != nil {
+		t.Fatalf(`Deliver() = %v, expected no error`, err)
+	}
+	moved := path.Join(dir, cur, string(k2)+":2,")
+	if err := os.Rename(path.Join(dir, nw, string(k2)), moved); err != nil {
+		panic(err)
+	}
+	if f, err := d.GetFile(k2); err != nil || f != moved {
+		t.Errorf(`GetFile(%v) = %v, %v, expected %v`, k2, f, err, moved)
+	}
+	if err := d.Delete(k); err != nil {
+		t.Fatalf(`Delete(%v) = %v, expected no error`, k, err)
+	}
+	if _, err := d.GetFile(k); err != ErrNotExist {
+		t.Errorf(`GetFile(%v) after Delete = %v, expected %v`, k, err, ErrNotExist)
+	}
+}
+
+func TestGetFileMissNoRescan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := Create(dir)
+	if err != nil {
+		t.Fatalf(`Create(%v) = %v, expected no error`, dir, err)
+	}
+	c := path.Join(dir, cur)
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(c, old, old); err != nil {
+		panic(err)
+	}
+	if _, err := d.GetFile("missing"); err != ErrNotExist {
+		t.Errorf(`GetFile(missing) = %v, expected %v`, err, ErrNotExist)
+	}
+	// A file appears without the directory's time changing, which only a
+	// rescan would find.
+	if err := ioutil.WriteFile(path.Join(c, "hidden:2,S"), nil, 0600); err != nil {
+		panic(err)
+	}
+	if err := os.Chtimes(c, old, old); err != nil {
+		panic(err)
+	}
+	if _, err := d.GetFile("hidden"); err != ErrNotExist {
+		t.Errorf(`GetFile(hidden) = %v, expected %v without a rescan`, err, ErrNotExist)
+	}
+	// Once the time changes, misses rescan.
+	if err := os.Chtimes(c, time.Now(), time.Now()); err != nil {
+		panic(err)
+	}
+	if f, err := d.GetFile("hidden"); err != nil || f != path.Join(c, "hidden:2,S") {
+		t.Errorf(`GetFile(hidden) = %v, %v, expected the file`, f, err)
+	}
+}
+
+// BenchmarkGetFile looks up messages in a large cur directory, with the
+// index and, for comparison, rescanning the directory each time as GetFile
+// used to.
+func BenchmarkGetFile(b *testing.B) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := Create(dir)
+	if err != nil {
+		panic(err)
+	}
+	ks := make([]Key, 5000)
+	for i := range ks {
+		if ks[i], err = d.DeliverWithFlags(newTestMessage(), "S"); err != nil {
+			panic(err)
+		}
+	}
+	b.Run("indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := d.GetFile(ks[i%len(ks)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fresh := Maildir{dir, &curIndex{}}
+			if _, err := fresh.GetFile(ks[i%len(ks)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
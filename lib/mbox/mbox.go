@@ -0,0 +1,399 @@
+// Package mbox implements a message store in a single mbox file, in the
+// mboxrd variant: lines of a message body matching ">*From " are escaped by
+// one more ">", so that they can be told apart from the "From " lines
+// separating messages and restored exactly.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+// KeyHeader is added to each delivered message to record its key, so that
+// messages can be found again when the file is reopened.
+const KeyHeader = "X-Outtake-Key"
+
+// Maildir flags and the mbox Status and X-Status flags they map to.
+var (
+	statusFlags  = map[rune]rune{'S': 'R'}
+	xStatusFlags = map[rune]rune{'R': 'A', 'F': 'F', 'T': 'D'}
+)
+
+// span is the location of a message in the file, from its "From " line to
+// just past the blank line that ends it.
+type span struct {
+	off, len int64
+}
+
+// Mbox stores messages in an mbox file. New messages are appended; deleted
+// ones are only dropped when Close compacts the file. Until then, their keys
+// are recorded in a file alongside, so that if the run dies first, the next
+// Open picks up the deletions again. GetFile extracts a message to a
+// temporary file, which stays valid until the message is deleted or the Mbox
+// closed.
+type Mbox struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+	msgs map[maildir.Key]span
+	// Spans to drop on Close, and the file their keys are recorded in.
+	deleted []span
+	log     *os.File
+	// Directory of files extracted by GetFile, and the files by key.
+	tmp       string
+	extracted map[maildir.Key]string
+	n         uint64
+}
+
+// deletedSuffix is appended to the mbox file's path to name the file that
+// records deletions not yet compacted away.
+const deletedSuffix = ".deleted"
+
+// Open opens the mbox file at p, creating it if needed, and indexes the
+// messages in it that carry a KeyHeader. Deletions left over from a run that
+// didn't get to compact the file are applied again.
+func Open(p string) (*Mbox, error) {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Mbox{path: p, f: f, msgs: make(map[maildir.Key]span), extracted: make(map[maildir.Key]string)}
+	if err := s.index(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay drops the messages whose keys are in the deletions file.
+func (s *Mbox) replay() error {
+	bs, err := ioutil.ReadFile(s.path + deletedSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// A key cut short by a crash matches no message.
+	for _, k := range strings.Fields(string(bs)) {
+		if sp, ok := s.msgs[maildir.Key(k)]; ok {
+			delete(s.msgs, maildir.Key(k))
+			s.deleted = append(s.deleted, sp)
+		}
+	}
+	return nil
+}
+
+// index scans the file for messages and their keys.
+func (s *Mbox) index() error {
+	r := bufio.NewReader(s.f)
+	var off, start int64
+	var key maildir.Key
+	inHeader := false
+	end := func() {
+		if key != "" {
+			s.msgs[key] = span{start, off - start}
+		}
+		key = ""
+	}
+	for {
+		l, err := r.ReadBytes('\n')
+		if len(l) > 0 {
+			if bytes.HasPrefix(l, []byte("From ")) {
+				end()
+				start, inHeader = off, true
+			} else if inHeader && len(bytes.TrimSpace(l)) == 0 {
+				inHeader = false
+			} else if inHeader && bytes.HasPrefix(l, []byte(KeyHeader+":")) {
+				key = maildir.Key(strings.TrimSpace(string(l[len(KeyHeader)+1:])))
+			}
+			off += int64(len(l))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	end()
+	s.size = off
+	// Start the next message on a line of its own.
+	if off > 0 {
+		last := make([]byte, 1)
+		if _, err := s.f.ReadAt(last, off-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			return s.write([]byte("\n\n"))
+		}
+	}
+	return nil
+}
+
+// write appends bs to the file.
+func (s *Mbox) write(bs []byte) error {
+	n, err := s.f.WriteAt(bs, s.size)
+	s.size += int64(n)
+	return err
+}
+
+func (s *Mbox) Deliver(m *mail.Message) (maildir.Key, error) {
+	return s.DeliverWithFlags(m, "")
+}
+
+// DeliverWithFlags appends m, recording flags, such as "S" (seen), in its
+// Status and X-Status headers.
+func (s *Mbox) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	k := maildir.Key(strconv.FormatInt(time.Now().UnixNano(), 10) + "." + strconv.FormatUint(s.n, 10))
+	buf := new(bytes.Buffer)
+	buf.WriteString("From MAILER-DAEMON " + time.Now().UTC().Format(time.ANSIC) + "\n")
+	hs := make([]string, 0, len(m.Header))
+	for h := range m.Header {
+		if h != KeyHeader && h != "Status" && h != "X-Status" {
+			hs = append(hs, h)
+		}
+	}
+	sort.Strings(hs)
+	for _, h := range hs {
+		for _, v := range m.Header[h] {
+			buf.WriteString(h + ": " + v + "\n")
+		}
+	}
+	buf.WriteString(KeyHeader + ": " + string(k) + "\n")
+	if st := mapFlags(flags, statusFlags); st != "" {
+		buf.WriteString("Status: " + st + "O\n")
+	}
+	if st := mapFlags(flags, xStatusFlags); st != "" {
+		buf.WriteString("X-Status: " + st + "\n")
+	}
+	buf.WriteString("\n")
+	r := bufio.NewReader(m.Body)
+	for {
+		l, err := r.ReadBytes('\n')
+		if isFromLine(l) {
+			buf.WriteByte('>')
+		}
+		buf.Write(l)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	start := s.size
+	// A single write, so that a failure leaves at most one partial message.
+	if err := s.write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	s.msgs[k] = span{start, int64(buf.Len())}
+	return k, nil
+}
+
+// isFromLine reports whether l must be escaped in (or, with one ">" fewer,
+// was escaped from) a message body.
+func isFromLine(l []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(l, ">"), []byte("From "))
+}
+
+// mapFlags returns the flags in m of each of the maildir flags.
+func mapFlags(flags string, m map[rune]rune) string {
+	out := ""
+	for _, f := range flags {
+		if r, ok := m[f]; ok && !strings.ContainsRune(out, r) {
+			out += string(r)
+		}
+	}
+	return out
+}
+
+// unmapFlags returns the maildir flags set by the mbox flags in v.
+func unmapFlags(v string, m map[rune]rune) []string {
+	out := []string{}
+	for f, r := range m {
+		if strings.ContainsRune(v, r) {
+			out = append(out, string(f))
+		}
+	}
+	return out
+}
+
+// Delete drops the message with key k. The file is only compacted on Close,
+// but the deletion is recorded at once.
+func (s *Mbox) Delete(k maildir.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.msgs[k]
+	if !ok {
+		return maildir.ErrNotExist
+	}
+	if s.log == nil {
+		f, err := os.OpenFile(s.path+deletedSuffix, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		s.log = f
+	}
+	if _, err := s.log.WriteString(string(k) + "\n"); err != nil {
+		return err
+	}
+	// The caller forgets the key once this returns.
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	delete(s.msgs, k)
+	s.deleted = append(s.deleted, sp)
+	if f, ok := s.extracted[k]; ok {
+		delete(s.extracted, k)
+		return os.Remove(f)
+	}
+	return nil
+}
+
+// GetFile extracts the message with key k to a temporary file, as it was
+// delivered. The file's name carries the message's flags like a maildir's,
+// for maildir.Flags.
+func (s *Mbox) GetFile(k maildir.Key) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.extracted[k]; ok {
+		return f, nil
+	}
+	sp, ok := s.msgs[k]
+	if !ok {
+		return "", maildir.ErrNotExist
+	}
+	if s.tmp == "" {
+		d, err := ioutil.TempDir("", "outtake-mbox")
+		if err != nil {
+			return "", err
+		}
+		s.tmp = d
+	}
+	bs := make([]byte, sp.len)
+	if _, err := s.f.ReadAt(bs, sp.off); err != nil {
+		return "", err
+	}
+	// Skip the "From " line.
+	if i := bytes.IndexByte(bs, '\n'); i >= 0 {
+		bs = bs[i+1:]
+	}
+	// And the blank line ending the message.
+	bs = bytes.TrimSuffix(bs, []byte("\n"))
+	out := new(bytes.Buffer)
+	flags := []string{}
+	inHeader := true
+	for _, l := range bytes.SplitAfter(bs, []byte("\n")) {
+		if inHeader {
+			if len(bytes.TrimSpace(l)) == 0 {
+				inHeader = false
+			} else if v := headerValue(l, "Status"); v != "" {
+				flags = append(flags, unmapFlags(v, statusFlags)...)
+			} else if v := headerValue(l, "X-Status"); v != "" {
+				flags = append(flags, unmapFlags(v, xStatusFlags)...)
+			}
+		} else if bytes.HasPrefix(l, []byte(">")) && isFromLine(l) {
+			l = l[1:]
+		}
+		out.Write(l)
+	}
+	f := path.Join(s.tmp, string(k))
+	if len(flags) > 0 {
+		// In ASCII order, as in a maildir.
+		sort.Strings(flags)
+		f += ":2," + strings.Join(flags, "")
+	}
+	if err := ioutil.WriteFile(f, out.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	s.extracted[k] = f
+	return f, nil
+}
+
+// headerValue returns the value of header line l if it's the header h.
+func headerValue(l []byte, h string) string {
+	if !bytes.HasPrefix(l, []byte(h+":")) {
+		return ""
+	}
+	return strings.TrimSpace(string(l[len(h)+1:]))
+}
+
+// Close compacts the file, if any messages were deleted, and removes the
+// files extracted by GetFile. Later calls do nothing.
+func (s *Mbox) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	if s.tmp != "" {
+		os.RemoveAll(s.tmp)
+	}
+	var err error
+	if len(s.deleted) > 0 {
+		err = s.compact()
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	if s.log != nil {
+		s.log.Close()
+	}
+	if err == nil {
+		// Everything it records is gone from the file now.
+		if rerr := os.Remove(s.path + deletedSuffix); !os.IsNotExist(rerr) {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// compact rewrites the file without the deleted messages, replacing it only
+// once the new copy is complete.
+func (s *Mbox) compact() error {
+	sort.Slice(s.deleted, func(i, j int) bool { return s.deleted[i].off < s.deleted[j].off })
+	tmp, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	off := int64(0)
+	for _, d := range append(s.deleted, span{s.size, 0}) {
+		if _, err := io.Copy(tmp, io.NewSectionReader(s.f, off, d.off-off)); err != nil {
+			tmp.Close()
+			return err
+		}
+		off = d.off + d.len
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	s.deleted = nil
+	return os.Rename(s.path+".tmp", s.path)
+}
@@ -0,0 +1,199 @@
+package mbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+const testBody = "Hi,\nFrom here on,\n>From there.\nBye\n"
+
+func testMessage() *mail.Message {
+	return &mail.Message{
+		Header: mail.Header{"Subject": {"hi"}},
+		Body:   strings.NewReader(testBody),
+	}
+}
+
+func readFile(t *testing.T, s *Mbox, k maildir.Key) (string, *mail.Message) {
+	f, err := s.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected nil`, k, err)
+	}
+	fh, err := os.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	m, err := mail.ReadMessage(fh)
+	if err != nil {
+		t.Fatalf(`ReadMessage(%v) = %v, expected nil`, f, err)
+	}
+	return f, m
+}
+
+func TestMbox(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	p := path.Join(d, "mbox")
+	s, err := Open(p)
+	if err != nil {
+		t.Fatalf(`Open() = %v, expected nil`, err)
+	}
+	k1, err := s.Deliver(testMessage())
+	if err != nil {
+		t.Fatalf(`Deliver() = %v, expected nil`, err)
+	}
+	k2, err := s.DeliverWithFlags(testMessage(), "FS")
+	if err != nil {
+		t.Fatalf(`DeliverWithFlags() = %v, expected nil`, err)
+	}
+	if k1 == k2 {
+		t.Errorf(`Deliver() returned duplicate key %v`, k1)
+	}
+	bs, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(bs), "\nFrom "); !strings.HasPrefix(string(bs), "From ") || n != 1 {
+		t.Errorf(`mbox has %v "From " lines after the first, expected 1:\n%s`, n, bs)
+	}
+	if !strings.Contains(string(bs), "\n>From here on,\n>>From there.\n") {
+		t.Errorf(`mbox = %s, expected "From " lines in the body escaped`, bs)
+	}
+	if !strings.Contains(string(bs), "Status: RO\nX-Status: F\n") {
+		t.Errorf(`mbox = %s, expected the second message's flags`, bs)
+	}
+	// Messages read back as delivered, with their flags.
+	f, m := readFile(t, s, k2)
+	if b, _ := ioutil.ReadAll(m.Body); string(b) != testBody {
+		t.Errorf(`GetFile(%v) body = %q, expected %q`, k2, b, testBody)
+	}
+	if fl := maildir.Flags(f); fl != "FS" {
+		t.Errorf(`Flags(GetFile(%v)) = %v, expected FS`, k2, fl)
+	}
+	if err := s.Delete(k1); err != nil {
+		t.Fatalf(`Delete(%v) = %v, expected nil`, k1, err)
+	}
+	if _, err := s.GetFile(k1); err != maildir.ErrNotExist {
+		t.Errorf(`GetFile(%v) = %v, expected ErrNotExist`, k1, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf(`Close() = %v, expected nil`, err)
+	}
+	if _, err := os.Stat(f); !os.IsNotExist(err) {
+		t.Errorf(`Stat(%v) = %v, expected extracted files removed by Close()`, f, err)
+	}
+
+	// Reopened, only the second message is left.
+	s, err = Open(p)
+	if err != nil {
+		t.Fatalf(`Open() = %v, expected nil`, err)
+	}
+	defer s.Close()
+	if _, err := s.GetFile(k1); err != maildir.ErrNotExist {
+		t.Errorf(`GetFile(%v) = %v, expected ErrNotExist after compaction`, k1, err)
+	}
+	if _, m := readFile(t, s, k2); m.Header.Get("Subject") != "hi" {
+		t.Errorf(`GetFile(%v) Subject = %v, expected hi`, k2, m.Header.Get("Subject"))
+	}
+	if bs, _ := ioutil.ReadFile(p); bytes.Count(bs, []byte("From MAILER-DAEMON")) != 1 {
+		t.Errorf(`mbox = %s, expected one message`, bs)
+	}
+	// New messages go after it.
+	k3, err := s.Deliver(testMessage())
+	if err != nil {
+		t.Fatalf(`Deliver() = %v, expected nil`, err)
+	}
+	if _, m := readFile(t, s, k3); m.Header.Get(KeyHeader) != string(k3) {
+		t.Errorf(`GetFile(%v) %v = %v, expected the key`, k3, KeyHeader, m.Header.Get(KeyHeader))
+	}
+}
+
+func TestOpenForeignMbox(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	p := path.Join(d, "mbox")
+	// A message from elsewhere, without a key or a final newline.
+	if err := ioutil.WriteFile(p, []byte("From someone Mon Jan  1 00:00:00 2024\nSubject: old\n\nbody"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(p)
+	if err != nil {
+		t.Fatalf(`Open() = %v, expected nil`, err)
+	}
+	k, err := s.Deliver(testMessage())
+	if err != nil {
+		t.Fatalf(`Deliver() = %v, expected nil`, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf(`Close() = %v, expected nil`, err)
+	}
+	bs, _ := ioutil.ReadFile(p)
+	if !strings.HasPrefix(string(bs), "From someone Mon Jan  1 00:00:00 2024\nSubject: old\n\nbody\n\nFrom MAILER-DAEMON") {
+		t.Errorf(`mbox = %q, expected the old message kept and the new one on its own line`, bs)
+	}
+	s, err = Open(p)
+	if err != nil {
+		t.Fatalf(`Open() = %v, expected nil`, err)
+	}
+	defer s.Close()
+	if _, m := readFile(t, s, k); m.Header.Get("Subject") != "hi" {
+		t.Errorf(`GetFile(%v) Subject = %v, expected hi`, k, m.Header.Get("Subject"))
+	}
+}
+
+func TestDeleteSurvivesCrash(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	p := path.Join(d, "mbox")
+	s, err := Open(p)
+	if err != nil {
+		t.Fatalf(`Open() = %v, expected nil`, err)
+	}
+	k1, _ := s.Deliver(testMessage())
+	k2, _ := s.Deliver(testMessage())
+	if err := s.Delete(k1); err != nil {
+		t.Fatalf(`Delete(%v) = %v, expected nil`, k1, err)
+	}
+	// The run dies without compacting.
+	s.f.Close()
+	s.log.Close()
+	s, err = Open(p)
+	if err != nil {
+		t.Fatalf(`Open() = %v, expected nil`, err)
+	}
+	if _, err := s.GetFile(k1); err != maildir.ErrNotExist {
+		t.Errorf(`GetFile(%v) = %v, expected ErrNotExist after reopening`, k1, err)
+	}
+	if _, err := s.GetFile(k2); err != nil {
+		t.Errorf(`GetFile(%v) = %v, expected nil`, k2, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf(`Close() = %v, expected nil`, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf(`Close() again = %v, expected nil`, err)
+	}
+	if bs, _ := ioutil.ReadFile(p); bytes.Count(bs, []byte("From MAILER-DAEMON")) != 1 {
+		t.Errorf(`mbox = %s, expected one message`, bs)
+	}
+	if _, err := os.Stat(p + deletedSuffix); !os.IsNotExist(err) {
+		t.Errorf(`Stat(%v) = %v, expected the deletions file removed by Close()`, p+deletedSuffix, err)
+	}
+}
@@ -2,11 +2,18 @@
 package oauth
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"os/exec"
+	"strconv"
 	"time"
 
 	"golang.org/x/net/context"
@@ -20,26 +27,136 @@ const (
 	Secret = "GOylH6-BUUQFm_lzrhXKpdac"
 )
 
-func GetOAuthClient(ctx context.Context, cfg *oauth2.Config) (*oauth2.Token, error) {
-	tok := new(oauth2.Token)
-	// Have to get a new token.
-	print("Launching browser for OAuth exchange. To skip, rerun with environment variable 'OAUTH' set to 'NOBROWSER'.\n")
-	code, err := tokenFromWeb(ctx, cfg)
-	if err == nil {
-		tok, err = cfg.Exchange(ctx, code)
+// ClientFromFile returns the client ID and secret in a client secrets JSON
+// file, as downloaded from the Google Cloud console for a desktop or web
+// application.
+func ClientFromFile(f string) (id, secret string, err error) {
+	bs, err := ioutil.ReadFile(f)
+	if err != nil {
+		return "", "", err
 	}
-	return tok, err
+	var cs map[string]struct {
+		ClientId     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	if err := json.Unmarshal(bs, &cs); err != nil {
+		return "", "", fmt.Errorf("reading OAuth client from %v: %v", f, err)
+	}
+	for _, k := range []string{"installed", "web"} {
+		if c, ok := cs[k]; ok && c.ClientId != "" {
+			return c.ClientId, c.ClientSecret, nil
+		}
+	}
+	return "", "", fmt.Errorf("reading OAuth client from %v: no installed or web client_id", f)
 }
 
-func tokenFromWeb(ctx context.Context, config *oauth2.Config) (string, error) {
-	ch := make(chan string)
+// Where the authorization code is read from when there's no browser;
+// replaced in tests.
+var stdin io.Reader = os.Stdin
+
+// RedirectURL returns the redirect URI for a callback server on loopback
+// port port, to set as a Config's RedirectURL, and register with the OAuth
+// client, when the port must be known in advance.
+func RedirectURL(port int) string {
+	return fmt.Sprintf("http://localhost:%d", port)
+}
+
+// GetOAuthClient runs the interactive OAuth flow, passing opts (such as
+// oauth2.AccessTypeOffline) when building the authorization URL. The
+// callback server listens on the port of cfg's RedirectURL, if it has one
+// (see RedirectURL), or else on a random one. With the environment variable
+// OAUTH set to NOBROWSER, it prints the URL rather than opening it, and
+// reads the code from standard input.
+func GetOAuthClient(ctx context.Context, cfg *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	// The redirect URL is set for this run only, and must be the same for
+	// the exchange.
+	c := *cfg
+	code, err := tokenFromWeb(ctx, &c, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.Exchange(ctx, code)
+}
+
+func tokenFromWeb(ctx context.Context, config *oauth2.Config, opts ...oauth2.AuthCodeOption) (string, error) {
+	port := 0
+	if config.RedirectURL != "" {
+		u, err := url.Parse(config.RedirectURL)
+		if err != nil {
+			return "", err
+		}
+		if port, err = strconv.Atoi(u.Port()); err != nil {
+			return "", fmt.Errorf("redirect URL %v has no port to listen on", config.RedirectURL)
+		}
+	}
+	ch := make(chan string, 1)
 	randState := fmt.Sprintf("st%d", time.Now().UnixNano())
-	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	ts, err := callbackServer(randState, port, ch)
+	if err != nil {
+		return "", err
+	}
+	defer ts.Close()
+	if port == 0 {
+		config.RedirectURL = ts.URL
+	}
+	authURL := config.AuthCodeURL(randState, opts...)
+	errs := make(chan error, 1)
+	if os.Getenv("OAUTH") == "NOBROWSER" {
+		fmt.Printf("Open %v in a browser. Once authorized, it redirects to %v, which may fail to load there: enter the code parameter from its address here.\n", authURL, ts.URL)
+		// The callback may still come first, if the browser is local.
+		go func() {
+			var code string
+			if _, err := fmt.Fscanln(stdin, &code); err != nil {
+				errs <- fmt.Errorf("reading OAuth code: %v", err)
+				return
+			}
+			select {
+			case ch <- code:
+			default:
+			}
+		}()
+	} else {
+		print("Launching browser for OAuth exchange. To skip, rerun with environment variable 'OAUTH' set to 'NOBROWSER'.\n")
+		if err := openURL(authURL); err != nil {
+			return "", err
+		}
+	}
+	select {
+	case code := <-ch:
+		return code, nil
+	case err := <-errs:
+		return "", err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// callbackServer starts a server for the OAuth redirect, sending the code of
+// a request with the given state to ch. It listens on loopback only, on port
+// or, if that's 0, a random one, and rejects requests for any other host, so
+// that a web page can't reach it via DNS rebinding.
+func callbackServer(state string, port int, ch chan<- string) (*httptest.Server, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("starting the OAuth callback server: %v", err)
+	}
+	_, p, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	hosts := map[string]bool{"127.0.0.1:" + p: true, "localhost:" + p: true}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !hosts[req.Host] {
+			log.Printf("Rejecting OAuth callback for host %q", req.Host)
+			http.Error(rw, "", 403)
+			return
+		}
 		if req.URL.Path == "/favicon.ico" {
 			http.Error(rw, "", 404)
 			return
 		}
-		if req.FormValue("state") != randState {
+		if req.FormValue("state") != state {
 			log.Printf("State doesn't match: req = %#v", req)
 			http.Error(rw, "", 500)
 			return
@@ -47,26 +164,20 @@ func tokenFromWeb(ctx context.Context, config *oauth2.Config) (string, error) {
 		if code := req.FormValue("code"); code != "" {
 			fmt.Fprintf(rw, "<h1>Success</h1>Authorized.")
 			rw.(http.Flusher).Flush()
-			ch <- code
+			// Only the first code is wanted; a repeated request mustn't block.
+			select {
+			case ch <- code:
+			default:
+			}
 			return
 		}
 		http.Error(rw, "", 500)
 	}))
-	defer ts.Close()
-	config.RedirectURL = ts.URL
-	authURL := config.AuthCodeURL(randState)
-	errs := make(chan error)
-	go func() {
-		err := openURL(authURL)
-		errs <- err
-	}()
-	err := <-errs
-	if err == nil {
-		code := <-ch
-		return code, nil
-	} else {
-		return "", err
-	}
+	// Replace the default listener, to be sure of the address.
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.Start()
+	return ts, nil
 }
 
 func openURL(url string) error {
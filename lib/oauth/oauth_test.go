@@ -0,0 +1,168 @@
+package oauth
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func TestCallbackServer(t *testing.T) {
+	ch := make(chan string, 1)
+	ts, err := callbackServer("st1", 0, ch)
+	if err != nil {
+		t.Fatalf(`callbackServer() = %v, expected nil`, err)
+	}
+	defer ts.Close()
+	if a := ts.Listener.Addr().(*net.TCPAddr); !a.IP.IsLoopback() {
+		t.Errorf(`callbackServer() listens on %v, expected loopback`, a)
+	}
+	get := func(host string) int {
+		req, err := http.NewRequest("GET", ts.URL+"/?state=st1&code=c1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf(`GET for host %v = %v, expected no error`, host, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	for _, h := range []string{"evil.example.com", "evil.example.com:" + port, "localhost:1"} {
+		if c := get(h); c != 403 {
+			t.Errorf(`GET for host %v = %v, expected 403`, h, c)
+		}
+	}
+	select {
+	case c := <-ch:
+		t.Fatalf(`callback sent code %v for a foreign host`, c)
+	default:
+	}
+	for _, h := range []string{"127.0.0.1:" + port, "localhost:" + port} {
+		if c := get(h); c != 200 {
+			t.Errorf(`GET for host %v = %v, expected 200`, h, c)
+		}
+		select {
+		case c := <-ch:
+			if c != "c1" {
+				t.Errorf(`callback sent code %v, expected c1`, c)
+			}
+		case <-time.After(time.Second):
+			t.Errorf(`callback sent no code for host %v`, h)
+		}
+	}
+	// A repeated callback, with the first code unread, mustn't block the
+	// handler.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("GET", "/?state=st1&code=c1", nil)
+			req.Host = "127.0.0.1:" + port
+			ts.Config.Handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf(`callback handler blocked on a repeated code`)
+	}
+}
+
+func TestCallbackServerPort(t *testing.T) {
+	// Find a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	ch := make(chan string, 1)
+	ts, err := callbackServer("st1", port, ch)
+	if err != nil {
+		t.Fatalf(`callbackServer(%v) = %v, expected nil`, port, err)
+	}
+	defer ts.Close()
+	if a := ts.Listener.Addr().(*net.TCPAddr); a.Port != port {
+		t.Errorf(`callbackServer(%v) listens on %v, expected port %v`, port, a, port)
+	}
+	resp, err := http.Get(RedirectURL(port) + "/?state=st1&code=c1")
+	if err != nil {
+		t.Fatalf(`GET %v = %v, expected no error`, RedirectURL(port), err)
+	}
+	resp.Body.Close()
+	if c := <-ch; c != "c1" {
+		t.Errorf(`callback sent code %v, expected c1`, c)
+	}
+	// The port is taken now.
+	if ts, err := callbackServer("st2", port, ch); err == nil {
+		ts.Close()
+		t.Errorf(`callbackServer(%v) on a busy port = nil, expected an error`, port)
+	}
+}
+
+func TestGetOAuthClientErrors(t *testing.T) {
+	os.Setenv("OAUTH", "NOBROWSER")
+	defer os.Unsetenv("OAUTH")
+	defer func() { stdin = os.Stdin }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+	}))
+	defer srv.Close()
+	cfg := &oauth2.Config{ClientID: "id", ClientSecret: "secret", Endpoint: oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"}}
+	for _, x := range []struct {
+		input string
+		why   string
+	}{
+		{"", "no code was entered"},
+		{"bad-code\n", "the exchange failed"},
+	} {
+		stdin = strings.NewReader(x.input)
+		if tok, err := GetOAuthClient(context.Background(), cfg); err == nil || tok != nil {
+			t.Errorf(`GetOAuthClient() when %v = %v, %v, expected an error`, x.why, tok, err)
+		}
+	}
+}
+
+func TestClientFromFile(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	f := path.Join(d, "client.json")
+	for _, x := range []struct {
+		json       string
+		id, secret string
+		ok         bool
+	}{
+		{`{"installed": {"client_id": "id1", "client_secret": "s1", "redirect_uris": ["http://localhost"]}}`, "id1", "s1", true},
+		{`{"web": {"client_id": "id2", "client_secret": "s2"}}`, "id2", "s2", true},
+		{`{"other": {"client_id": "id3"}}`, "", "", false},
+		{`not json`, "", "", false},
+	} {
+		if err := ioutil.WriteFile(f, []byte(x.json), 0600); err != nil {
+			panic(err)
+		}
+		id, secret, err := ClientFromFile(f)
+		if (err == nil) != x.ok || id != x.id || secret != x.secret {
+			t.Errorf(`ClientFromFile(%v) = %v, %v, %v, expected %v, %v, ok %v`, x.json, id, secret, err, x.id, x.secret, x.ok)
+		}
+	}
+	if _, _, err := ClientFromFile(path.Join(d, "missing.json")); err == nil {
+		t.Errorf(`ClientFromFile(missing) = nil, expected an error`)
+	}
+}
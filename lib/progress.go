@@ -4,4 +4,12 @@ package lib
 type Progress struct {
 	Current uint
 	Total   uint
+	// Approximate number of messages in the whole account, for context when
+	// Total is just a small delta. Zero if unknown.
+	AccountTotal uint
+	// What's in progress, such as "full" or "incremental" sync.
+	Phase string
+	// Messages added and deleted so far.
+	Added   uint
+	Deleted uint
 }
@@ -1,24 +1,60 @@
 package lib
 
 import (
-	"log"
-	"math"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 const windows = 1
 
+// Longest backoff sleep if RateLimit.BackoffMax is unset.
+const defaultBackoffMax = time.Minute
+
+// ErrRetryBudgetExhausted is returned by DoWithBackoff once the RateLimit's
+// RetryBudget has been used up.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
 type RateLimit struct {
 	Period       time.Duration
 	Rate         uint
 	BackoffLimit uint
+	// Retries sleep BackoffStart, doubling each time up to BackoffMax (or
+	// defaultBackoffMax, if 0).
 	BackoffStart time.Duration
-	toks         chan struct{}
-	paused       bool
+	BackoffMax   time.Duration
+	// Maximum total retries across all calls; 0 means unlimited. This lets a
+	// run fail fast under systemic trouble instead of retrying every call to
+	// BackoffLimit.
+	RetryBudget uint
+	retries     uint
+	// If set, called with the error and delay before each backoff sleep.
+	OnBackoff func(err error, d time.Duration)
+	// If set, called whenever f succeeds.
+	OnSuccess func()
+	// If set, returns how long the server asked callers to wait after err
+	// (e.g. from a Retry-After header), or 0. Backoff sleeps at least that
+	// long, even past BackoffMax.
+	RetryAfter func(err error) time.Duration
+	toks       chan struct{}
+	paused     bool
+	// sleepFunc is used to sleep between retries. Defaults to time.Sleep;
+	// tests replace it to observe backoff without real delays.
+	sleepFunc func(time.Duration)
+	// mu guards paused, retries, the count of outstanding Pause calls, and a
+	// channel closed when they have all been resumed.
+	mu      sync.Mutex
+	pauses  int
+	resumed chan struct{}
 }
 
 func (r *RateLimit) Start() {
+	r.mu.Lock()
 	r.paused = false
+	r.mu.Unlock()
 	if r.toks == nil {
 		r.toks = make(chan struct{}, windows*r.Rate)
 	}
@@ -28,7 +64,10 @@ func (r *RateLimit) Start() {
 				r.toks <- struct{}{}
 			}
 			time.Sleep(r.Period)
-			if r.paused {
+			r.mu.Lock()
+			stopped := r.paused
+			r.mu.Unlock()
+			if stopped {
 				break
 			}
 		}
@@ -36,6 +75,8 @@ func (r *RateLimit) Start() {
 }
 
 func (r *RateLimit) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.paused = true
 }
 
@@ -48,22 +89,141 @@ func (r *RateLimit) TryGet() bool {
 	}
 }
 
-func (r *RateLimit) DoWithBackoff(f func() (err error, fatal bool)) error {
+// DoWithBackoff calls f until it succeeds or fails fatally, backing off
+// between attempts. It gives up with ctx's error once ctx is done.
+func (r *RateLimit) DoWithBackoff(ctx context.Context, f func() (err error, fatal bool)) error {
 	var err error
 	var fatal bool
 	for i := uint(0); i < r.BackoffLimit; i++ {
-		r.Get()
+		if err := r.Get(ctx); err != nil {
+			return err
+		}
 		err, fatal = f()
-		if err == nil || fatal {
+		if err == nil && r.OnSuccess != nil {
+			r.OnSuccess()
+		}
+		if err == nil || fatal || i+1 == r.BackoffLimit {
+			// Don't back off after the last attempt: nothing follows it.
 			return err
 		}
-		s := time.Duration(math.Pow(float64(r.BackoffStart.Nanoseconds()), float64(i)))
-		log.Println("DoWithBackoff error: sleeping for", s)
-		time.Sleep(s)
+		if !r.takeRetry() {
+			return fmt.Errorf("%w: %v", ErrRetryBudgetExhausted, err)
+		}
+		s := r.backoff(i)
+		if r.RetryAfter != nil {
+			if d := r.RetryAfter(err); d > s {
+				s = d
+			}
+		}
+		Infoln("DoWithBackoff error: sleeping for", s)
+		if r.OnBackoff != nil {
+			r.OnBackoff(err, s)
+		}
+		// Hold off every other caller too, so backoff slows the whole fleet
+		// rather than letting other workers keep draining tokens.
+		r.Pause()
+		r.sleep(ctx, s)
+		r.Resume()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 	}
 	return err
 }
 
-func (r *RateLimit) Get() {
-	_ = <-r.toks
+// backoff returns the sleep before retry i (from 0): BackoffStart * 2^i,
+// capped at BackoffMax.
+func (r *RateLimit) backoff(i uint) time.Duration {
+	max := r.BackoffMax
+	if max == 0 {
+		max = defaultBackoffMax
+	}
+	d := r.BackoffStart
+	// Doubling stops at the cap, so d can't overflow.
+	for ; i > 0 && d < max; i-- {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// takeRetry consumes one retry from the budget, returning false if none are
+// left.
+func (r *RateLimit) takeRetry() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.RetryBudget == 0 {
+		return true
+	}
+	if r.retries >= r.RetryBudget {
+		return false
+	}
+	r.retries++
+	return true
+}
+
+// sleep sleeps for d, or until ctx is done.
+func (r *RateLimit) sleep(ctx context.Context, d time.Duration) {
+	if r.sleepFunc != nil {
+		r.sleepFunc(d)
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// Pause stops Get from handing out tokens until a matching Resume. Pauses
+// nest.
+func (r *RateLimit) Pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pauses == 0 {
+		r.resumed = make(chan struct{})
+	}
+	r.pauses++
+}
+
+// Resume undoes one Pause.
+func (r *RateLimit) Resume() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pauses--
+	if r.pauses == 0 {
+		close(r.resumed)
+	}
+}
+
+func (r *RateLimit) waitResumed(ctx context.Context) error {
+	r.mu.Lock()
+	for r.pauses > 0 {
+		ch := r.resumed
+		r.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		r.mu.Lock()
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// Get waits for a token, returning ctx's error if ctx is done first.
+func (r *RateLimit) Get(ctx context.Context) error {
+	if err := r.waitResumed(ctx); err != nil {
+		return err
+	}
+	select {
+	case <-r.toks:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func newTestRateLimit(limit uint, start time.Duration) (*RateLimit, *[]time.Duration) {
+	sleeps := []time.Duration{}
+	r := &RateLimit{
+		Period:       time.Millisecond,
+		Rate:         100,
+		BackoffLimit: limit,
+		BackoffStart: start,
+		sleepFunc:    func(d time.Duration) { sleeps = append(sleeps, d) },
+	}
+	r.Start()
+	return r, &sleeps
+}
+
+func TestDoWithBackoffSleeps(t *testing.T) {
+	// Not 2ns, whose powers are also its doublings: this tells them apart.
+	r, sleeps := newTestRateLimit(3, time.Second)
+	defer r.Stop()
+	e := errors.New("transient")
+	calls := 0
+	err := r.DoWithBackoff(context.Background(), func() (error, bool) {
+		calls++
+		return e, false
+	})
+	if err != e {
+		t.Errorf(`DoWithBackoff() = %v, expected %v`, err, e)
+	}
+	if calls != 3 {
+		t.Errorf(`DoWithBackoff() made %v calls, expected 3`, calls)
+	}
+	// No sleep after the last attempt.
+	want := []time.Duration{time.Second, 2 * time.Second}
+	if len(*sleeps) != len(want) {
+		t.Fatalf(`DoWithBackoff() slept %v, expected %v`, *sleeps, want)
+	}
+	for i := range want {
+		if (*sleeps)[i] != want[i] {
+			t.Errorf(`DoWithBackoff() slept %v, expected %v`, *sleeps, want)
+			break
+		}
+	}
+}
+
+func TestBackoffSequence(t *testing.T) {
+	r := &RateLimit{BackoffStart: time.Second}
+	want := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+		32 * time.Second, time.Minute, time.Minute,
+	}
+	for i, w := range want {
+		if d := r.backoff(uint(i)); d != w {
+			t.Errorf(`backoff(%v) = %v, expected %v`, i, d, w)
+		}
+	}
+	// Even many retries stay at the cap rather than overflowing.
+	r.BackoffMax = 5 * time.Second
+	for _, i := range []uint{3, 64, 1000} {
+		if d := r.backoff(i); d != 5*time.Second {
+			t.Errorf(`backoff(%v) = %v with a 5s cap, expected 5s`, i, d)
+		}
+	}
+}
+
+func TestBackoffLimitAndMax(t *testing.T) {
+	// Many attempts, with the delay capped early.
+	r, sleeps := newTestRateLimit(10, time.Nanosecond)
+	defer r.Stop()
+	r.BackoffMax = 4 * time.Nanosecond
+	calls := 0
+	r.DoWithBackoff(context.Background(), func() (error, bool) {
+		calls++
+		return errors.New("transient"), false
+	})
+	if calls != 10 {
+		t.Errorf(`DoWithBackoff() made %v calls, expected 10`, calls)
+	}
+	want := []time.Duration{1, 2, 4, 4, 4, 4, 4, 4, 4}
+	if len(*sleeps) != len(want) {
+		t.Fatalf(`DoWithBackoff() slept %v, expected %v`, *sleeps, want)
+	}
+	for i := range want {
+		if (*sleeps)[i] != want[i] {
+			t.Errorf(`DoWithBackoff() slept %v, expected %v`, *sleeps, want)
+			break
+		}
+	}
+}
+
+func TestDoWithBackoffRetryAfter(t *testing.T) {
+	r, sleeps := newTestRateLimit(3, time.Second)
+	defer r.Stop()
+	hint := errors.New("slow down")
+	r.RetryAfter = func(err error) time.Duration {
+		if err == hint {
+			return 90 * time.Second
+		}
+		return 0
+	}
+	calls := 0
+	r.DoWithBackoff(context.Background(), func() (error, bool) {
+		calls++
+		if calls == 1 {
+			return hint, false
+		} else if calls == 2 {
+			return errors.New("transient"), false
+		}
+		return nil, false
+	})
+	// The hint beats both the backoff and its cap; without one, the backoff
+	// applies.
+	want := []time.Duration{90 * time.Second, 2 * time.Second}
+	if len(*sleeps) != len(want) || (*sleeps)[0] != want[0] || (*sleeps)[1] != want[1] {
+		t.Errorf(`DoWithBackoff() slept %v, expected %v`, *sleeps, want)
+	}
+}
+
+func TestDoWithBackoffSuccess(t *testing.T) {
+	r, sleeps := newTestRateLimit(5, 2*time.Nanosecond)
+	defer r.Stop()
+	calls := 0
+	err := r.DoWithBackoff(context.Background(), func() (error, bool) {
+		calls++
+		if calls < 3 {
+			return errors.New("transient"), false
+		}
+		return nil, false
+	})
+	if err != nil {
+		t.Errorf(`DoWithBackoff() = %v, expected nil`, err)
+	}
+	if len(*sleeps) != 2 {
+		t.Errorf(`DoWithBackoff() slept %v times, expected 2`, len(*sleeps))
+	}
+}
+
+func TestDoWithBackoffFatal(t *testing.T) {
+	r, sleeps := newTestRateLimit(5, 2*time.Nanosecond)
+	defer r.Stop()
+	e := errors.New("fatal")
+	calls := 0
+	if err := r.DoWithBackoff(context.Background(), func() (error, bool) {
+		calls++
+		return e, true
+	}); err != e {
+		t.Errorf(`DoWithBackoff() = %v, expected %v`, err, e)
+	}
+	if calls != 1 || len(*sleeps) != 0 {
+		t.Errorf(`DoWithBackoff() made %v calls and %v sleeps, expected 1 and 0`, calls, len(*sleeps))
+	}
+}
+
+func TestBackoffPausesOtherWorkers(t *testing.T) {
+	sleeping := make(chan struct{})
+	wake := make(chan struct{})
+	r := &RateLimit{
+		Period:       time.Millisecond,
+		Rate:         100,
+		BackoffLimit: 2,
+		BackoffStart: time.Second,
+		sleepFunc: func(time.Duration) {
+			sleeping <- struct{}{}
+			<-wake
+		},
+	}
+	r.Start()
+	defer r.Stop()
+	calls := 0
+	go r.DoWithBackoff(context.Background(), func() (error, bool) {
+		calls++
+		if calls == 1 {
+			return errors.New("rate limited"), false
+		}
+		return nil, false
+	})
+	<-sleeping
+	// Another worker asking for a token must block while the first backs off.
+	got := make(chan struct{})
+	go func() {
+		r.Get(context.Background())
+		close(got)
+	}()
+	select {
+	case <-got:
+		t.Fatal(`Get() returned during backoff, expected it to block`)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(wake)
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Error(`Get() still blocked after backoff ended`)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	r, sleeps := newTestRateLimit(5, time.Nanosecond)
+	defer r.Stop()
+	r.RetryBudget = 3
+	calls := 0
+	for i := 0; i < 5; i++ {
+		err := r.DoWithBackoff(context.Background(), func() (error, bool) {
+			calls++
+			return errors.New("transient"), false
+		})
+		if !errors.Is(err, ErrRetryBudgetExhausted) {
+			t.Errorf(`DoWithBackoff() = %v, expected %v`, err, ErrRetryBudgetExhausted)
+		}
+	}
+	// Five first attempts plus the three budgeted retries.
+	if calls != 8 {
+		t.Errorf(`DoWithBackoff() made %v calls, expected 8`, calls)
+	}
+	if len(*sleeps) != 3 {
+		t.Errorf(`DoWithBackoff() slept %v times, expected 3`, len(*sleeps))
+	}
+	// The last attempt isn't followed by a retry, so takes none of the
+	// budget.
+	r, sleeps = newTestRateLimit(2, time.Nanosecond)
+	defer r.Stop()
+	r.RetryBudget = 1
+	e := errors.New("transient")
+	if err := r.DoWithBackoff(context.Background(), func() (error, bool) { return e, false }); err != e {
+		t.Errorf(`DoWithBackoff() = %v, expected %v`, err, e)
+	}
+	if len(*sleeps) != 1 {
+		t.Errorf(`DoWithBackoff() slept %v times, expected 1`, len(*sleeps))
+	}
+}
+
+func TestGetCanceled(t *testing.T) {
+	// No tokens are ever handed out, as the limiter isn't started.
+	r := &RateLimit{toks: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan error)
+	go func() { got <- r.Get(ctx) }()
+	cancel()
+	select {
+	case err := <-got:
+		if err != context.Canceled {
+			t.Errorf(`Get() = %v, expected %v`, err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Error(`Get() still blocked after cancellation`)
+	}
+}
+
+func TestDoWithBackoffCanceled(t *testing.T) {
+	r, _ := newTestRateLimit(5, time.Nanosecond)
+	defer r.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := r.DoWithBackoff(ctx, func() (error, bool) {
+		calls++
+		cancel()
+		return errors.New("transient"), false
+	})
+	if err != context.Canceled {
+		t.Errorf(`DoWithBackoff() = %v, expected %v`, err, context.Canceled)
+	}
+	if calls != 1 {
+		t.Errorf(`DoWithBackoff() made %v calls, expected 1`, calls)
+	}
+}
@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/mail"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+// Separates a ShardedStore key's shard from the shard's own key.
+const shardKeySep = "/"
+
+// ShardedStore spreads messages across n Maildir++ style subfolders of a
+// Maildir (".00", ".01", ...), chosen by a hash of each message's
+// Message-Id, so that no single directory grows to millions of files. Keys
+// record the shard, so lookups never scan other shards. Keys without a shard,
+// from before sharding was enabled, refer to the root Maildir.
+type ShardedStore struct {
+	dir    string
+	root   maildir.Maildir
+	shards []maildir.Maildir
+	// Spreads messages without a Message-Id.
+	next uint64
+	// Shards beyond this run's count, opened as keys refer to them.
+	mu    sync.Mutex
+	extra map[int]maildir.Maildir
+}
+
+// NewShardedStore creates a Maildir at dir with n shards.
+func NewShardedStore(dir string, n int) (*ShardedStore, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid shard count %d", n)
+	}
+	root, err := maildir.Create(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &ShardedStore{dir: dir, root: root, extra: make(map[int]maildir.Maildir)}
+	for i := 0; i < n; i++ {
+		m, err := maildir.Create(s.shardDir(i))
+		if err != nil {
+			return nil, err
+		}
+		s.shards = append(s.shards, m)
+	}
+	return s, nil
+}
+
+func (s *ShardedStore) shardDir(i int) string {
+	return path.Join(s.dir, fmt.Sprintf(".%02d", i))
+}
+
+func (s *ShardedStore) shardFor(m *mail.Message) int {
+	id := m.Header.Get("Message-Id")
+	if id == "" {
+		return int(atomic.AddUint64(&s.next, 1) % uint64(len(s.shards)))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *ShardedStore) Deliver(m *mail.Message) (maildir.Key, error) {
+	return s.DeliverWithFlags(m, "")
+}
+
+func (s *ShardedStore) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	i := s.shardFor(m)
+	k, err := s.shards[i].DeliverWithFlags(m, flags)
+	if err != nil {
+		return "", err
+	}
+	return maildir.Key(fmt.Sprintf("%02d", i) + shardKeySep + string(k)), nil
+}
+
+// split returns the Maildir holding k, and k's key within it.
+func (s *ShardedStore) split(k maildir.Key) (maildir.Maildir, maildir.Key, error) {
+	ks := strings.SplitN(string(k), shardKeySep, 2)
+	if len(ks) == 1 {
+		return s.root, k, nil
+	}
+	i, err := strconv.Atoi(ks[0])
+	if err != nil || i < 0 {
+		return maildir.Maildir{}, "", fmt.Errorf("invalid shard in key %q", k)
+	}
+	if i < len(s.shards) {
+		return s.shards[i], maildir.Key(ks[1]), nil
+	}
+	m, err := s.extraShard(i)
+	return m, maildir.Key(ks[1]), err
+}
+
+// extraShard returns shard i, delivered to with more shards than this run
+// has. Its folder should still exist; if not, its messages are gone.
+func (s *ShardedStore) extraShard(i int) (maildir.Maildir, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.extra[i]; ok {
+		return m, nil
+	}
+	if _, err := os.Stat(s.shardDir(i)); os.IsNotExist(err) {
+		return maildir.Maildir{}, maildir.ErrNotExist
+	} else if err != nil {
+		return maildir.Maildir{}, err
+	}
+	m, err := maildir.Create(s.shardDir(i))
+	if err != nil {
+		return m, err
+	}
+	s.extra[i] = m
+	return m, nil
+}
+
+func (s *ShardedStore) Delete(k maildir.Key) error {
+	m, sk, err := s.split(k)
+	if err != nil {
+		return err
+	}
+	return m.Delete(sk)
+}
+
+func (s *ShardedStore) GetFile(k maildir.Key) (string, error) {
+	m, sk, err := s.split(k)
+	if err != nil {
+		return "", err
+	}
+	return m.GetFile(sk)
+}
+
+// SweepTmp runs maildir.SweepTmp on the root Maildir and every shard.
+func (s *ShardedStore) SweepTmp(maxAge time.Duration) (int, error) {
+	total := 0
+	for _, m := range append([]maildir.Maildir{s.root}, s.shards...) {
+		n, err := m.SweepTmp(maxAge)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
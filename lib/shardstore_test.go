@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+func TestShardedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewShardedStore(dir, 4)
+	if err != nil {
+		t.Fatalf(`NewShardedStore(%v, 4) = %v, expected no error`, dir, err)
+	}
+	counts := make(map[string]int)
+	keys := []maildir.Key{}
+	for i := 0; i < 40; i++ {
+		m := &mail.Message{
+			Header: mail.Header{"Message-Id": {fmt.Sprintf("<%d@example.com>", i)}},
+			Body:   strings.NewReader("body"),
+		}
+		k, err := s.Deliver(m)
+		if err != nil {
+			t.Fatalf(`Deliver() = %v, expected no error`, err)
+		}
+		keys = append(keys, k)
+		f, err := s.GetFile(k)
+		if err != nil {
+			t.Fatalf(`GetFile(%v) = %v, expected no error`, k, err)
+		}
+		shard := path.Base(path.Dir(path.Dir(f)))
+		if !strings.HasPrefix(string(k), strings.TrimPrefix(shard, ".")+"/") {
+			t.Errorf(`GetFile(%v) = %v, expected a file in the key's shard`, k, f)
+		}
+		counts[shard]++
+	}
+	for i := 0; i < 4; i++ {
+		if d := fmt.Sprintf(".%02d", i); counts[d] == 0 {
+			t.Errorf(`shard %v has no messages, expected them spread across all shards: %v`, d, counts)
+		}
+	}
+	if err := s.Delete(keys[0]); err != nil {
+		t.Errorf(`Delete(%v) = %v, expected no error`, keys[0], err)
+	}
+	if _, err := s.GetFile(keys[0]); err != maildir.ErrNotExist {
+		t.Errorf(`GetFile(%v) = %v, expected ErrNotExist after Delete`, keys[0], err)
+	}
+}
+
+func TestShardedStoreUnshardedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	// A message delivered before sharding was enabled.
+	root, err := maildir.Create(dir)
+	if err != nil {
+		panic(err)
+	}
+	k, err := root.Deliver(testMessage())
+	if err != nil {
+		panic(err)
+	}
+	s, err := NewShardedStore(dir, 2)
+	if err != nil {
+		t.Fatalf(`NewShardedStore(%v, 2) = %v, expected no error`, dir, err)
+	}
+	if f, err := s.GetFile(k); err != nil || f != path.Join(dir, "new", string(k)) {
+		t.Errorf(`GetFile(%v) = %v, %v, expected the root Maildir's copy`, k, f, err)
+	}
+}
+
+func TestShardedStoreExtraShard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	// Delivered when there were four shards.
+	s4, err := NewShardedStore(dir, 4)
+	if err != nil {
+		panic(err)
+	}
+	k, err := s4.shards[3].Deliver(testMessage())
+	if err != nil {
+		panic(err)
+	}
+	k = "03/" + k
+	s, err := NewShardedStore(dir, 2)
+	if err != nil {
+		t.Fatalf(`NewShardedStore(%v, 2) = %v, expected no error`, dir, err)
+	}
+	if f, err := s.GetFile(k); err != nil || !strings.HasPrefix(f, path.Join(dir, ".03")) {
+		t.Errorf(`GetFile(%v) = %v, %v, expected the copy in .03`, k, f, err)
+	}
+	if len(s.extra) != 1 {
+		t.Errorf(`GetFile(%v) opened %v extra shards, expected 1`, k, len(s.extra))
+	}
+	if err := s.Delete(k); err != nil {
+		t.Errorf(`Delete(%v) = %v, expected no error`, k, err)
+	}
+	// A shard that never existed is not created.
+	if _, err := s.GetFile("09/bogus"); err != maildir.ErrNotExist {
+		t.Errorf(`GetFile("09/bogus") = %v, expected ErrNotExist`, err)
+	}
+	if _, err := os.Stat(path.Join(dir, ".09")); !os.IsNotExist(err) {
+		t.Errorf(`Stat(.09) = %v, expected the shard not to be created`, err)
+	}
+}
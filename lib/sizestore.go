@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+// Rewrite maildirsize once it grows past this many bytes, as the Maildir++
+// spec recommends.
+const maildirsizeMax = 5120
+
+// SizeStore keeps the Maildir++ maildirsize file of the Maildir at dir up to
+// date as messages are delivered to and deleted from an underlying Store, so
+// that quota-aware servers such as Dovecot needn't scan the Maildir. Each
+// change appends a line of size and count deltas; when the file gets long,
+// it's rewritten with just the totals.
+type SizeStore struct {
+	Store
+	file string
+	// mu guards the totals and the file.
+	mu    sync.Mutex
+	size  int64
+	count int64
+}
+
+// NewSizeStore wraps s, which stores messages in the Maildir at dir. The
+// totals are counted afresh, in case anything else changed the Maildir since
+// the file was last written.
+func NewSizeStore(s Store, dir string) (*SizeStore, error) {
+	st := &SizeStore{Store: s, file: path.Join(dir, "maildirsize")}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if d := filepath.Base(filepath.Dir(p)); !fi.IsDir() && (d == "cur" || d == "new") {
+			st.size += fi.Size()
+			st.count++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, st.rewrite()
+}
+
+func (s *SizeStore) Deliver(m *mail.Message) (maildir.Key, error) {
+	return s.DeliverWithFlags(m, "")
+}
+
+func (s *SizeStore) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	k, err := s.Store.DeliverWithFlags(m, flags)
+	if err != nil {
+		return k, err
+	}
+	size, err := s.fileSize(k)
+	if err != nil {
+		return k, err
+	}
+	return k, s.add(size, 1)
+}
+
+func (s *SizeStore) Delete(k maildir.Key) error {
+	size, err := s.fileSize(k)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Delete(k); err != nil {
+		return err
+	}
+	return s.add(-size, -1)
+}
+
+func (s *SizeStore) fileSize(k maildir.Key) (int64, error) {
+	f, err := s.GetFile(k)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(f)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// add records a change in the totals.
+func (s *SizeStore) add(size, count int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size += size
+	s.count += count
+	if fi, err := os.Stat(s.file); err != nil || fi.Size() > maildirsizeMax {
+		return s.rewrite()
+	}
+	f, err := os.OpenFile(s.file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// A single write, so concurrent readers never see half a line.
+	if _, err := fmt.Fprintf(f, "%d %d\n", size, count); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rewrite replaces the file with one holding just the totals. The first line
+// is the quota definition, empty for no quota.
+func (s *SizeStore) rewrite() error {
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("\n%d %d\n", s.size, s.count)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
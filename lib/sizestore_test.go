@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+// readMaildirsize sums the lines of a maildirsize file after the quota.
+func readMaildirsize(t *testing.T, dir string) (size, count int64) {
+	bs, err := ioutil.ReadFile(path.Join(dir, "maildirsize"))
+	if err != nil {
+		t.Fatalf(`ReadFile(maildirsize) = %v, expected no error`, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(bs), "\n"), "\n")
+	for _, l := range lines[1:] {
+		var s, c int64
+		if _, err := fmt.Sscanf(l, "%d %d", &s, &c); err != nil {
+			t.Fatalf(`maildirsize line %q: %v`, l, err)
+		}
+		size += s
+		count += c
+	}
+	return size, count
+}
+
+// maildirTotals returns the total size and number of messages in dir.
+func maildirTotals(dir string) (size, count int64) {
+	for _, d := range []string{"cur", "new"} {
+		fs, err := ioutil.ReadDir(path.Join(dir, d))
+		if err != nil {
+			panic(err)
+		}
+		for _, f := range fs {
+			size += f.Size()
+			count++
+		}
+	}
+	return size, count
+}
+
+func TestSizeStore(t *testing.T) {
+	md, d := newTestMaildir()
+	defer os.RemoveAll(d)
+	// A message from before the store was opened is counted too.
+	if _, err := md.Deliver(testMessage()); err != nil {
+		panic(err)
+	}
+	s, err := NewSizeStore(md, d)
+	if err != nil {
+		t.Fatalf(`NewSizeStore() = %v, expected no error`, err)
+	}
+	ks := []maildir.Key{}
+	// Enough operations to make the file be rewritten at least once.
+	for i := 0; i < 500; i++ {
+		k, err := s.DeliverWithFlags(testMessage(), "S")
+		if err != nil {
+			t.Fatalf(`DeliverWithFlags() = %v, expected no error`, err)
+		}
+		ks = append(ks, k)
+		if i%3 == 0 {
+			if err := s.Delete(ks[0]); err != nil {
+				t.Fatalf(`Delete(%v) = %v, expected no error`, ks[0], err)
+			}
+			ks = ks[1:]
+		}
+	}
+	wantSize, wantCount := maildirTotals(d)
+	if size, count := readMaildirsize(t, d); size != wantSize || count != wantCount {
+		t.Errorf(`maildirsize totals = %v, %v, expected %v, %v`, size, count, wantSize, wantCount)
+	}
+	if fi, _ := os.Stat(path.Join(d, "maildirsize")); fi.Size() > maildirsizeMax+100 {
+		t.Errorf(`maildirsize is %v bytes, expected it to be rewritten`, fi.Size())
+	}
+}
@@ -0,0 +1,177 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+// Store is a destination for synced messages, such as a Maildir.
+type Store interface {
+	// Deliver writes a new message, returning a key by which to refer to it.
+	Deliver(m *mail.Message) (maildir.Key, error)
+	// DeliverWithFlags is like Deliver, but marks the message with maildir
+	// info flags such as "S" (seen).
+	DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error)
+	// Delete removes the message with the given key.
+	Delete(k maildir.Key) error
+	// GetFile returns the path of a file containing the message.
+	GetFile(k maildir.Key) (string, error)
+}
+
+// Separates the per-backend parts of a MultiStore key.
+const multiKeySep = "|"
+
+// MultiStore fans every operation out to several Stores. The first Store is
+// the primary, used to read messages back. Keys returned by Deliver combine
+// the keys of every backend, so a MultiStore must always be opened with the
+// same backends in the same order.
+type MultiStore []Store
+
+func (s MultiStore) Deliver(m *mail.Message) (maildir.Key, error) {
+	return s.DeliverWithFlags(m, "")
+}
+
+func (s MultiStore) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	// The body can only be read once, so buffer it for each backend.
+	body, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return "", err
+	}
+	ks := make([]string, 0, len(s))
+	for i, st := range s {
+		k, err := st.DeliverWithFlags(&mail.Message{Header: m.Header, Body: bytes.NewReader(body)}, flags)
+		if err != nil {
+			// Roll back so that a failed delivery leaves no partial copies.
+			for j, k := range ks {
+				s[j].Delete(maildir.Key(k))
+			}
+			return "", fmt.Errorf("store %d: %w", i, err)
+		}
+		ks = append(ks, string(k))
+	}
+	return maildir.Key(strings.Join(ks, multiKeySep)), nil
+}
+
+func (s MultiStore) split(k maildir.Key) ([]string, error) {
+	ks := strings.Split(string(k), multiKeySep)
+	if len(ks) != len(s) {
+		return nil, fmt.Errorf("key %v has %d parts, expected %d", k, len(ks), len(s))
+	}
+	return ks, nil
+}
+
+// Delete removes the message from every backend, even if some fail, and
+// returns the first error.
+func (s MultiStore) Delete(k maildir.Key) error {
+	ks, err := s.split(k)
+	if err != nil {
+		return err
+	}
+	var first error
+	for i, st := range s {
+		if err := st.Delete(maildir.Key(ks[i])); err != nil && first == nil {
+			first = fmt.Errorf("store %d: %w", i, err)
+		}
+	}
+	return first
+}
+
+func (s MultiStore) GetFile(k maildir.Key) (string, error) {
+	ks, err := s.split(k)
+	if err != nil {
+		return "", err
+	}
+	return s[0].GetFile(maildir.Key(ks[0]))
+}
+
+// RetryStore retries transient filesystem errors (such as NFS ESTALE or EIO)
+// from an underlying Store, sleeping Delay, doubled each time, between up to
+// Retries retries. Permanent errors are returned immediately.
+type RetryStore struct {
+	Store
+	Retries int
+	Delay   time.Duration
+}
+
+// IsTransientFSError reports whether a filesystem error is worth retrying.
+func IsTransientFSError(err error) bool {
+	for _, e := range []error{syscall.ESTALE, syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.EBUSY} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s RetryStore) retry(f func() error) error {
+	d := s.Delay
+	err := f()
+	for i := 0; i < s.Retries && err != nil && IsTransientFSError(err); i++ {
+		log.Println("Transient filesystem error, retrying:", err)
+		time.Sleep(d)
+		d *= 2
+		err = f()
+	}
+	return err
+}
+
+func (s RetryStore) Deliver(m *mail.Message) (maildir.Key, error) {
+	return s.DeliverWithFlags(m, "")
+}
+
+func (s RetryStore) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	// Buffer the body so that it can be replayed on retry.
+	body, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return "", err
+	}
+	var k maildir.Key
+	err = s.retry(func() error {
+		var err error
+		k, err = s.Store.DeliverWithFlags(&mail.Message{Header: m.Header, Body: bytes.NewReader(body)}, flags)
+		return err
+	})
+	return k, err
+}
+
+func (s RetryStore) Delete(k maildir.Key) error {
+	return s.retry(func() error { return s.Store.Delete(k) })
+}
+
+// LimitStore bounds how many deliveries and deletions run at once on an
+// underlying Store, so that on slow disks writes don't thrash while downloads
+// carry on ahead of them.
+type LimitStore struct {
+	Store
+	sem chan struct{}
+}
+
+// NewLimitStore returns a LimitStore allowing n concurrent writes to s.
+func NewLimitStore(s Store, n int) LimitStore {
+	return LimitStore{Store: s, sem: make(chan struct{}, n)}
+}
+
+func (s LimitStore) Deliver(m *mail.Message) (maildir.Key, error) {
+	return s.DeliverWithFlags(m, "")
+}
+
+func (s LimitStore) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	s.sem <- struct{}{}
+	defer func() { <-s.sem }()
+	return s.Store.DeliverWithFlags(m, flags)
+}
+
+func (s LimitStore) Delete(k maildir.Key) error {
+	s.sem <- struct{}{}
+	defer func() { <-s.sem }()
+	return s.Store.Delete(k)
+}
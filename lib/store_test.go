@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+func newTestMaildir() (maildir.Maildir, string) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	md, err := maildir.Create(d)
+	if err != nil {
+		panic(err)
+	}
+	return md, d
+}
+
+func testMessage() *mail.Message {
+	m, err := mail.ReadMessage(strings.NewReader("Subject: hi\n\nbody"))
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+type failingStore struct {
+	Store
+}
+
+func (failingStore) Deliver(*mail.Message) (maildir.Key, error) {
+	return "", errors.New("disk full")
+}
+
+func (failingStore) DeliverWithFlags(*mail.Message, string) (maildir.Key, error) {
+	return "", errors.New("disk full")
+}
+
+func TestMultiStore(t *testing.T) {
+	a, da := newTestMaildir()
+	defer os.RemoveAll(da)
+	b, db := newTestMaildir()
+	defer os.RemoveAll(db)
+	s := MultiStore{a, b}
+	k, err := s.Deliver(testMessage())
+	if err != nil {
+		t.Fatalf(`Deliver() = %v, expected no error`, err)
+	}
+	for _, d := range []string{da, db} {
+		fs, _ := ioutil.ReadDir(d + "/new")
+		if len(fs) != 1 {
+			t.Fatalf(`Deliver() wrote %v messages to %v, expected 1`, len(fs), d)
+		}
+		bs, _ := ioutil.ReadFile(d + "/new/" + fs[0].Name())
+		if !strings.Contains(string(bs), "body") {
+			t.Errorf(`Delivered message %v = %v, expected it to contain the body`, fs[0].Name(), string(bs))
+		}
+	}
+	if f, err := s.GetFile(k); err != nil || !strings.HasPrefix(f, da) {
+		t.Errorf(`GetFile(%v) = %v, %v, expected a file in %v`, k, f, err, da)
+	}
+	if err := s.Delete(k); err != nil {
+		t.Errorf(`Delete(%v) = %v, expected no error`, k, err)
+	}
+	for _, d := range []string{da, db} {
+		if fs, _ := ioutil.ReadDir(d + "/new"); len(fs) != 0 {
+			t.Errorf(`Delete(%v) left %v messages in %v, expected 0`, k, len(fs), d)
+		}
+	}
+}
+
+func TestMultiStoreMissingKey(t *testing.T) {
+	a, da := newTestMaildir()
+	defer os.RemoveAll(da)
+	b, db := newTestMaildir()
+	defer os.RemoveAll(db)
+	s := MultiStore{a, b}
+	k, err := s.Deliver(testMessage())
+	if err != nil {
+		t.Fatalf(`Deliver() = %v, expected no error`, err)
+	}
+	// The mirror's copy is removed behind our back.
+	fs, _ := ioutil.ReadDir(db + "/new")
+	if err := os.Remove(db + "/new/" + fs[0].Name()); err != nil {
+		panic(err)
+	}
+	if err := s.Delete(k); !errors.Is(err, maildir.ErrNotExist) {
+		t.Errorf(`Delete(%v) = %v, expected ErrNotExist`, k, err)
+	}
+	if fs, _ := ioutil.ReadDir(da + "/new"); len(fs) != 0 {
+		t.Errorf(`Delete(%v) left %v messages in %v, expected 0`, k, len(fs), da)
+	}
+}
+
+func TestMultiStorePartialFailure(t *testing.T) {
+	a, da := newTestMaildir()
+	defer os.RemoveAll(da)
+	s := MultiStore{a, failingStore{}}
+	if _, err := s.Deliver(testMessage()); err == nil {
+		t.Errorf(`Deliver() = nil, expected error`)
+	}
+	// The successful delivery to the first store should be rolled back.
+	if fs, _ := ioutil.ReadDir(da + "/new"); len(fs) != 0 {
+		t.Errorf(`Deliver() left %v messages after failure, expected 0`, len(fs))
+	}
+}
+
+// flakyStore returns err from its first `fails` deliveries.
+type flakyStore struct {
+	Store
+	fails int
+	err   error
+	calls int
+}
+
+func (s *flakyStore) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	s.calls++
+	if s.calls <= s.fails {
+		ioutil.ReadAll(m.Body)
+		return "", s.err
+	}
+	return s.Store.DeliverWithFlags(m, flags)
+}
+
+func TestRetryStoreTransient(t *testing.T) {
+	md, d := newTestMaildir()
+	defer os.RemoveAll(d)
+	f := &flakyStore{Store: md, fails: 2, err: &os.PathError{Op: "rename", Path: d, Err: syscall.ESTALE}}
+	s := RetryStore{Store: f, Retries: 3}
+	k, err := s.Deliver(testMessage())
+	if err != nil {
+		t.Fatalf(`Deliver() = %v, expected no error after retries`, err)
+	}
+	if f.calls != 3 {
+		t.Errorf(`Deliver() made %v attempts, expected 3`, f.calls)
+	}
+	fn, err := md.GetFile(k)
+	if err != nil {
+		t.Fatalf(`GetFile(%v) = %v, expected no error`, k, err)
+	}
+	if bs, _ := ioutil.ReadFile(fn); !strings.Contains(string(bs), "body") {
+		t.Errorf(`Delivered message = %v, expected it to contain the body`, string(bs))
+	}
+}
+
+func TestRetryStorePermanent(t *testing.T) {
+	md, d := newTestMaildir()
+	defer os.RemoveAll(d)
+	f := &flakyStore{Store: md, fails: 1, err: &os.PathError{Op: "open", Path: d, Err: syscall.EACCES}}
+	s := RetryStore{Store: f, Retries: 3}
+	if _, err := s.Deliver(testMessage()); !errors.Is(err, syscall.EACCES) {
+		t.Errorf(`Deliver() = %v, expected %v`, err, syscall.EACCES)
+	}
+	if f.calls != 1 {
+		t.Errorf(`Deliver() made %v attempts, expected 1`, f.calls)
+	}
+}
+
+// slowStore records the most deliveries it has seen at once.
+type slowStore struct {
+	Store
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func (s *slowStore) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.max {
+		s.max = s.active
+	}
+	s.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	return s.Store.DeliverWithFlags(m, flags)
+}
+
+func TestLimitStore(t *testing.T) {
+	md, d := newTestMaildir()
+	defer os.RemoveAll(d)
+	slow := &slowStore{Store: md}
+	s := NewLimitStore(slow, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Deliver(testMessage()); err != nil {
+				t.Errorf(`Deliver() = %v, expected no error`, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if slow.max != 2 {
+		t.Errorf(`Deliver() ran %v at once, expected 2`, slow.max)
+	}
+}
@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/mail"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+// ErrAppendOnly is returned for operations an append-only Store can't do.
+var ErrAppendOnly = errors.New("store is append-only")
+
+// TarIndexEntry describes one message in a TarStore archive. It's written as
+// <key>.json immediately after the message itself, <key>.eml.
+type TarIndexEntry struct {
+	Key       string    `json:"key"`
+	File      string    `json:"file"`
+	Flags     string    `json:"flags,omitempty"`
+	Size      int64     `json:"size"`
+	Time      time.Time `json:"time"`
+	MessageId string    `json:"message_id,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+}
+
+// TarStore writes messages into a tar stream, e.g. to pipe a backup to
+// another host. Tar archives are append-only: Delete does nothing, and
+// GetFile, which relabeling needs to rewrite a message, returns
+// ErrAppendOnly. Messages deleted in Gmail thus stay in the archive, and
+// label changes aren't reflected. Close must be called to finish the archive.
+type TarStore struct {
+	mu sync.Mutex
+	w  *tar.Writer
+	n  uint64
+}
+
+// NewTarStore returns a TarStore writing to w.
+func NewTarStore(w io.Writer) *TarStore {
+	return &TarStore{w: tar.NewWriter(w)}
+}
+
+func (s *TarStore) Deliver(m *mail.Message) (maildir.Key, error) {
+	return s.DeliverWithFlags(m, "")
+}
+
+func (s *TarStore) DeliverWithFlags(m *mail.Message, flags string) (maildir.Key, error) {
+	// Tar headers carry the size, so the message must be buffered.
+	buf := new(bytes.Buffer)
+	for h, vs := range m.Header {
+		for _, v := range vs {
+			buf.WriteString(h + ": " + v + "\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	if _, err := io.Copy(buf, m.Body); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.n++
+	k := strconv.FormatInt(now.Unix(), 10) + "." + strconv.FormatUint(s.n, 10)
+	idx, err := json.Marshal(TarIndexEntry{
+		Key:       k,
+		File:      k + ".eml",
+		Flags:     flags,
+		Size:      int64(buf.Len()),
+		Time:      now,
+		MessageId: m.Header.Get("Message-Id"),
+		Subject:   m.Header.Get("Subject"),
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := s.writeFile(k+".eml", buf.Bytes(), now); err != nil {
+		return "", err
+	}
+	if err := s.writeFile(k+".json", idx, now); err != nil {
+		return "", err
+	}
+	return maildir.Key(k), nil
+}
+
+func (s *TarStore) writeFile(name string, bs []byte, t time.Time) error {
+	if err := s.w.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(bs)),
+		ModTime: t,
+	}); err != nil {
+		return err
+	}
+	_, err := s.w.Write(bs)
+	return err
+}
+
+// Delete does nothing; the message stays in the archive.
+func (s *TarStore) Delete(k maildir.Key) error {
+	return nil
+}
+
+// GetFile always returns ErrAppendOnly, since messages can't be read back.
+func (s *TarStore) GetFile(k maildir.Key) (string, error) {
+	return "", ErrAppendOnly
+}
+
+// Close finishes the archive. It doesn't close the underlying writer.
+func (s *TarStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
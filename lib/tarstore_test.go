@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/danmarg/outtake/lib/maildir"
+)
+
+func TestTarStore(t *testing.T) {
+	buf := new(bytes.Buffer)
+	s := NewTarStore(buf)
+	k1, err := s.Deliver(testMessage())
+	if err != nil {
+		t.Fatalf(`Deliver() = %v, expected no error`, err)
+	}
+	k2, err := s.DeliverWithFlags(testMessage(), "S")
+	if err != nil {
+		t.Fatalf(`DeliverWithFlags() = %v, expected no error`, err)
+	}
+	if k1 == k2 {
+		t.Errorf(`Deliver() returned duplicate key %v`, k1)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf(`Close() = %v, expected no error`, err)
+	}
+
+	files := make(map[string][]byte)
+	names := []string{}
+	r := tar.NewReader(buf)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf(`Next() = %v, expected no error`, err)
+		}
+		bs, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf(`ReadAll(%v) = %v, expected no error`, h.Name, err)
+		}
+		names = append(names, h.Name)
+		files[h.Name] = bs
+	}
+	want := []string{string(k1) + ".eml", string(k1) + ".json", string(k2) + ".eml", string(k2) + ".json"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf(`tar entries = %v, expected %v`, names, want)
+	}
+	for _, c := range []struct {
+		k     maildir.Key
+		flags string
+	}{{k1, ""}, {k2, "S"}} {
+		body := files[string(c.k)+".eml"]
+		if !strings.HasPrefix(string(body), "Subject: hi\n") || !strings.HasSuffix(string(body), "body") {
+			t.Errorf(`%v.eml = %q, expected the message`, c.k, body)
+		}
+		var e TarIndexEntry
+		if err := json.Unmarshal(files[string(c.k)+".json"], &e); err != nil {
+			t.Fatalf(`Unmarshal(%v.json) = %v, expected no error`, c.k, err)
+		}
+		if e.Key != string(c.k) || e.File != string(c.k)+".eml" || e.Flags != c.flags ||
+			e.Size != int64(len(body)) || e.Subject != "hi" {
+			t.Errorf(`%v.json = %+v, expected key %v, flags %q, size %v`, c.k, e, c.k, c.flags, len(body))
+		}
+	}
+}
+
+func TestTarStoreAppendOnly(t *testing.T) {
+	s := NewTarStore(ioutil.Discard)
+	k, err := s.Deliver(testMessage())
+	if err != nil {
+		t.Fatalf(`Deliver() = %v, expected no error`, err)
+	}
+	if err := s.Delete(k); err != nil {
+		t.Errorf(`Delete(%v) = %v, expected no error`, k, err)
+	}
+	if _, err := s.GetFile(k); !errors.Is(err, ErrAppendOnly) {
+		t.Errorf(`GetFile(%v) = %v, expected ErrAppendOnly`, k, err)
+	}
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Throttle limits how many workers may be active at once. The target starts
+// at the pool size and is halved when rate limiting persists despite backoff,
+// so that fewer concurrent requests hit the quota, then ramps back up by one
+// worker per RecoverAfter consecutive successes. A nil Throttle never limits.
+type Throttle struct {
+	max    int32
+	target int32 // Accessed atomically.
+	// Successive rate-limit errors, and successes since the last change.
+	streak    int32
+	successes int32
+	// RecoverAfter is the number of consecutive successes needed to add back
+	// one worker.
+	RecoverAfter int32
+	mu           sync.Mutex
+	cond         *sync.Cond
+	active       int32
+}
+
+// NewThrottle returns a Throttle for a pool of max workers.
+func NewThrottle(max int) *Throttle {
+	t := &Throttle{max: int32(max), target: int32(max), RecoverAfter: 20}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// Target returns the number of workers currently allowed to be active.
+func (t *Throttle) Target() int {
+	if t == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&t.target))
+}
+
+// Active returns the number of workers currently active.
+func (t *Throttle) Active() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return int(t.active)
+}
+
+// Acquire blocks until fewer than Target workers are active, then counts the
+// caller as active until Release.
+func (t *Throttle) Acquire() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.active >= atomic.LoadInt32(&t.target) {
+		t.cond.Wait()
+	}
+	t.active++
+}
+
+// Release undoes Acquire.
+func (t *Throttle) Release() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	t.cond.Broadcast()
+}
+
+// RateLimited records a rate-limit error. A second one in a row, i.e. when
+// backing off didn't help, halves the target.
+func (t *Throttle) RateLimited() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.successes = 0
+	t.streak++
+	if t.streak < 2 {
+		return
+	}
+	t.streak = 0
+	if n := atomic.LoadInt32(&t.target) / 2; n >= 1 {
+		atomic.StoreInt32(&t.target, n)
+	}
+}
+
+// Succeeded records a successful request, adding back a worker after
+// RecoverAfter in a row.
+func (t *Throttle) Succeeded() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.streak = 0
+	if atomic.LoadInt32(&t.target) >= t.max {
+		return
+	}
+	t.successes++
+	if t.successes >= t.RecoverAfter {
+		t.successes = 0
+		atomic.AddInt32(&t.target, 1)
+		t.cond.Broadcast()
+	}
+}
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestThrottleDropsAndRecovers(t *testing.T) {
+	th := NewThrottle(8)
+	th.RecoverAfter = 2
+	r, _ := newTestRateLimit(5, time.Nanosecond)
+	defer r.Stop()
+	r.OnBackoff = func(error, time.Duration) { th.RateLimited() }
+	r.OnSuccess = th.Succeeded
+	// Each call is rate limited four times before succeeding: two halvings.
+	calls := 0
+	r.DoWithBackoff(context.Background(), func() (error, bool) {
+		calls++
+		if calls <= 4 {
+			return errors.New("429"), false
+		}
+		return nil, false
+	})
+	if n := th.Target(); n != 2 {
+		t.Fatalf(`Target() = %v after repeated 429s, expected 2`, n)
+	}
+	// Only two of eight workers may now be active at once.
+	var mu sync.Mutex
+	max := 0
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			th.Acquire()
+			mu.Lock()
+			if a := th.Active(); a > max {
+				max = a
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			th.Release()
+		}()
+	}
+	wg.Wait()
+	if max > 2 {
+		t.Errorf(`Active() reached %v, expected at most 2`, max)
+	}
+	// Successes ramp back up, one worker per RecoverAfter.
+	for i := 0; i < 20; i++ {
+		r.DoWithBackoff(context.Background(), func() (error, bool) { return nil, false })
+	}
+	if n := th.Target(); n != 8 {
+		t.Errorf(`Target() = %v after successes, expected 8`, n)
+	}
+}
+
+func TestThrottleSingleRateLimit(t *testing.T) {
+	th := NewThrottle(4)
+	// One 429 that backoff resolves doesn't shrink the pool.
+	th.RateLimited()
+	th.Succeeded()
+	th.RateLimited()
+	if n := th.Target(); n != 4 {
+		t.Errorf(`Target() = %v, expected 4`, n)
+	}
+	// Nor does the pool drop below one worker.
+	for i := 0; i < 10; i++ {
+		th.RateLimited()
+	}
+	if n := th.Target(); n != 1 {
+		t.Errorf(`Target() = %v, expected 1`, n)
+	}
+}
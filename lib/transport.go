@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// NewHTTPClient returns an HTTP client suitable for talking to Google APIs.
+// If caFile is set, the PEM certificates it contains are trusted in addition
+// to the system roots (useful behind TLS-inspecting proxies). If insecure is
+// set, certificate verification is disabled entirely; this is dangerous and
+// meant only for testing.
+func NewHTTPClient(caFile string, insecure bool) (*http.Client, error) {
+	if caFile == "" && !insecure {
+		return http.DefaultClient, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	return &http.Client{Transport: t}, nil
+}
+
+// DeprecationWarner is an http.RoundTripper that watches responses for
+// notice that the API is going away: the Deprecation and Sunset headers, and
+// Warning headers with code 299 ("miscellaneous persistent warning"), which
+// Google uses for deprecations. Each distinct notice is logged once, however
+// many responses carry it.
+type DeprecationWarner struct {
+	// The transport making requests; http.DefaultTransport if nil.
+	Base http.RoundTripper
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func (d *DeprecationWarner) RoundTrip(r *http.Request) (*http.Response, error) {
+	b := d.Base
+	if b == nil {
+		b = http.DefaultTransport
+	}
+	resp, err := b.RoundTrip(r)
+	if err == nil {
+		d.check(r, resp.Header)
+	}
+	return resp, err
+}
+
+// check logs any notices in h that haven't been logged yet.
+func (d *DeprecationWarner) check(r *http.Request, h http.Header) {
+	notices := []string{}
+	for _, k := range []string{"Deprecation", "Sunset"} {
+		if v := h.Get(k); v != "" {
+			notices = append(notices, k+": "+v)
+		}
+	}
+	for _, v := range h.Values("Warning") {
+		if strings.HasPrefix(v, "299 ") {
+			notices = append(notices, "Warning: "+v)
+		}
+	}
+	if len(notices) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[string]struct{})
+	}
+	for _, n := range notices {
+		if _, ok := d.seen[n]; ok {
+			continue
+		}
+		d.seen[n] = struct{}{}
+		log.Printf("Deprecation notice from %v (outtake may need updating): %v", r.URL.Host, n)
+	}
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestCA(dir string) (string, []byte) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "outtake test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		panic(err)
+	}
+	bs := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	f := path.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(f, bs, 0600); err != nil {
+		panic(err)
+	}
+	return f, bs
+}
+
+func TestNewHTTPClientCACert(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(d)
+	f, bs := writeTestCA(d)
+	c, err := NewHTTPClient(f, false)
+	if err != nil {
+		t.Fatalf(`NewHTTPClient(%v, false) = %v, expected no error`, f, err)
+	}
+	tr, ok := c.Transport.(*http.Transport)
+	if !ok || tr.TLSClientConfig == nil || tr.TLSClientConfig.RootCAs == nil {
+		t.Fatalf(`NewHTTPClient(%v, false) did not install a root CA pool`, f)
+	}
+	want, err := x509.SystemCertPool()
+	if err != nil || want == nil {
+		want = x509.NewCertPool()
+	}
+	want.AppendCertsFromPEM(bs)
+	if !tr.TLSClientConfig.RootCAs.Equal(want) {
+		t.Errorf(`NewHTTPClient(%v, false) RootCAs does not contain the custom CA`, f)
+	}
+	if tr.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf(`NewHTTPClient(%v, false) InsecureSkipVerify = true, expected false`, f)
+	}
+}
+
+func TestNewHTTPClientInsecure(t *testing.T) {
+	c, err := NewHTTPClient("", true)
+	if err != nil {
+		t.Fatalf(`NewHTTPClient("", true) = %v, expected no error`, err)
+	}
+	tr, ok := c.Transport.(*http.Transport)
+	if !ok || tr.TLSClientConfig == nil || !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf(`NewHTTPClient("", true) did not set InsecureSkipVerify`)
+	}
+}
+
+func TestNewHTTPClientDefault(t *testing.T) {
+	if c, err := NewHTTPClient("", false); err != nil || c != http.DefaultClient {
+		t.Errorf(`NewHTTPClient("", false) = %v, %v, expected http.DefaultClient`, c, err)
+	}
+}
+
+func TestDeprecationWarner(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Sunset", "Sat, 31 Oct 2026 00:00:00 GMT")
+	}))
+	defer srv.Close()
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+	c := &http.Client{Transport: &DeprecationWarner{}}
+	for i := 0; i < 3; i++ {
+		r, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatalf(`Get(%v) = %v, expected nil`, srv.URL, err)
+		}
+		r.Body.Close()
+	}
+	if n := strings.Count(b.String(), "Sunset: Sat, 31 Oct 2026"); n != 1 {
+		t.Errorf(`DeprecationWarner logged %q, expected the Sunset header once`, b.String())
+	}
+}
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/danmarg/outtake/lib"
 	"github.com/danmarg/outtake/lib/gmail"
+	"github.com/danmarg/outtake/lib/mbox"
 	"github.com/urfave/cli/v2"
+	"io"
+	"log"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -30,6 +43,30 @@ func main() {
 			Name:  "full",
 			Usage: "Force a full sync",
 		},
+		&cli.BoolFlag{
+			Name:  "estimate",
+			Usage: "Print the number and total size of messages to download, without syncing",
+		},
+		&cli.BoolFlag{
+			Name:  "refresh-metadata",
+			Usage: "Re-fetch labels for all messages without re-downloading bodies",
+		},
+		&cli.BoolFlag{
+			Name:  "reconcile-deletes",
+			Usage: "Only delete local messages no longer on the server, without downloading or relabeling",
+		},
+		&cli.BoolFlag{
+			Name:  "check",
+			Usage: "Verify connectivity and credentials, print the account and estimated quota cost of a full sync, and exit",
+		},
+		&cli.BoolFlag{
+			Name:  "whoami",
+			Usage: "Print the account and OAuth scopes of the stored credentials and exit",
+		},
+		&cli.BoolFlag{
+			Name:  "use-adc",
+			Usage: "Authenticate with Application Default Credentials (e.g. from gcloud); implied by GOOGLE_APPLICATION_CREDENTIALS",
+		},
 		&cli.StringFlag{
 			Name:  "to-impersonate",
 			Usage: "The domain user that must be impersonated.",
@@ -38,20 +75,266 @@ func main() {
 			Name:  "service-account-json-file",
 			Usage: "The JWT service account JSON file to use for authentication.",
 		},
+		&cli.StringFlag{
+			Name:    "oauth-client-file",
+			Usage:   "Client secrets JSON file of your own OAuth client, for its own API quota instead of the shared built-in client's.",
+			EnvVars: []string{"OUTTAKE_OAUTH_CLIENT_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "oauth-client-id",
+			Usage:   "ID of your own OAuth client; needs --oauth-client-secret.",
+			EnvVars: []string{"OUTTAKE_OAUTH_CLIENT_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "oauth-client-secret",
+			Usage:   "Secret of your own OAuth client.",
+			EnvVars: []string{"OUTTAKE_OAUTH_CLIENT_SECRET"},
+		},
+		&cli.IntFlag{
+			Name:    "oauth-port",
+			Usage:   "Loopback port for the OAuth redirect, http://localhost:<port>, instead of a random one; register it with your OAuth client",
+			EnvVars: []string{"OUTTAKE_OAUTH_PORT"},
+		},
+		&cli.StringFlag{
+			Name:  "ca-cert",
+			Usage: "PEM file of extra CA certificates to trust (e.g. for a TLS-inspecting proxy).",
+		},
+		&cli.BoolFlag{
+			Name:  "insecure-skip-verify",
+			Usage: "DANGEROUS: disable TLS certificate verification. For testing only.",
+		},
+		&cli.BoolFlag{
+			Name:  "recover-cache",
+			Usage: "If the cache is corrupt, move it aside and start afresh; messages already in the Maildir are downloaded again",
+		},
+		&cli.DurationFlag{
+			Name:  "tmp-max-age",
+			Value: 36 * time.Hour,
+			Usage: "Remove files in the Maildir's tmp/ older than this on startup; 0 to disable",
+		},
+		&cli.IntFlag{
+			Name:  "shards",
+			Usage: "Spread messages across this many subfolders of the Maildir, for very large mailboxes",
+		},
+		&cli.BoolFlag{
+			Name:  "maildirsize",
+			Usage: "Keep a Maildir++ maildirsize file up to date, for quota-aware servers such as Dovecot",
+		},
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "Compare stored messages' labels with the server's, print the differences and exit",
+		},
+		&cli.IntFlag{
+			Name:  "verify-sample",
+			Usage: "With --verify, check only this many messages, chosen at random (0 for all)",
+		},
+		&cli.BoolFlag{
+			Name:  "repair",
+			Usage: "With --verify, update stored messages to match the server",
+		},
+		&cli.StringFlag{
+			Name:  "diff-cache",
+			Usage: "Compare the cache in --directory with this cache file, print the differences and exit",
+		},
+		&cli.StringFlag{
+			Name:  "stats",
+			Usage: "After the run, write how many stored messages carry each label to this file (\"-\" for stdout)",
+		},
+		&cli.BoolFlag{
+			Name:  "stats-only",
+			Usage: "Print how many stored messages carry each label, from the cache in --directory, and exit",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Value: "maildir",
+			Usage: "How to store messages: maildir, or mbox to append them to outtake.mbox in --directory",
+		},
+		&cli.StringFlag{
+			Name:  "tar",
+			Usage: "Write messages to this tar file (\"-\" for stdout) instead of the Maildir. Append-only: deletions and label changes aren't reflected",
+		},
+		&cli.BoolFlag{
+			Name:  "only-new",
+			Usage: "Only add and relabel messages; never delete local copies of messages deleted on the server",
+		},
+		&cli.IntFlag{
+			Name:  "max-age",
+			Usage: "Never delete local messages received within this many days for missing from a full listing, as a safeguard against inconsistent listings (0 to disable)",
+		},
+		&cli.BoolFlag{
+			Name:  "incremental-only",
+			Usage: "Exit with status 2 instead of falling back to a full sync when the history has expired (or there is none); --full still runs one",
+		},
+		&cli.BoolFlag{
+			Name:  "force-redownload",
+			Usage: "Download every matched message again, replacing stored copies (implies --full; narrow with --query or --since)",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Log the changes a sync would make to the Maildir, without making them or advancing the history index",
+		},
+		&cli.BoolFlag{
+			Name:  "thread-order",
+			Usage: "On full sync, deliver each thread's messages in the order Gmail lists them",
+		},
+		&cli.BoolFlag{
+			Name:  "newest-first",
+			Usage: "On full sync, deliver all messages strictly newest first, as Gmail lists them",
+		},
+		&cli.BoolFlag{
+			Name:  "drafts",
+			Usage: "Also enumerate drafts explicitly on full sync",
+		},
+		&cli.BoolFlag{
+			Name:  "read-state",
+			Usage: "Deliver messages already read in Gmail into cur/ with the Seen flag",
+		},
+		&cli.BoolFlag{
+			Name:  "mark-all-read",
+			Usage: "Deliver all messages into cur/ with the Seen flag, even if unread in Gmail",
+		},
 		&cli.StringFlag{
 			Name:  "label",
 			Usage: "Label to sync",
 		},
+		&cli.StringSliceFlag{
+			Name:  "exclude-label",
+			Usage: "Don't sync messages with these labels (comma-separated or repeatable), even if they have other labels; local copies are removed",
+		},
+		&cli.StringSliceFlag{
+			Name:  "from",
+			Usage: "Only sync mail from these addresses (comma-separated or repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "from-domain",
+			Usage: "Only sync mail from these domains (comma-separated or repeatable); combines with --from",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "On full sync, only list mail received on or after this date (YYYY/MM/DD or RFC 3339). Older messages already stored are kept; incremental sync is unaffected",
+		},
+		&cli.StringFlag{
+			Name:  "query",
+			Usage: "On full sync, only list mail matching this Gmail search too, e.g. \"-category:promotions\". Messages already stored are kept; incremental sync still adds all new mail",
+		},
+		&cli.BoolFlag{
+			Name:  "include-chats",
+			Usage: "Also sync chats, which are stored wrapped since they aren't email",
+		},
+		&cli.StringSliceFlag{
+			Name:  "mirror",
+			Usage: "Additional Maildir to also write every message to (repeatable). Must be given identically on every run.",
+		},
+		&cli.StringFlag{
+			Name:  "fetch-format",
+			Value: "raw",
+			Usage: "How to download messages: raw, falling back to full for messages that fail, or always full (reconstructing each message from its parts)",
+		},
+		&cli.IntFlag{
+			Name:  "fetch-batch",
+			Usage: fmt.Sprintf("Fetch new messages during a full sync in batch requests of up to this many (at most %d), rather than one request each", gmail.MaxFetchBatch),
+		},
+		&cli.StringSliceFlag{
+			Name:  "history-types",
+			Usage: "Only fetch these history change types on incremental sync: messageAdded, messageDeleted, labelAdded, labelRemoved (repeatable). Changes of other types are missed until the next --full sync",
+		},
+		&cli.BoolFlag{
+			Name:  "flag-starred",
+			Value: true,
+			Usage: "Set the maildir F (flagged) flag on starred messages",
+		},
+		&cli.StringFlag{
+			Name:  "important-flag",
+			Usage: "Maildir flag letter to set on messages marked important, e.g. a custom lowercase flag",
+		},
+		&cli.IntFlag{
+			Name:  "max-history-pages",
+			Value: 1000,
+			Usage: "Most pages of history to process per incremental sync; later changes are picked up by the next run (0 for no limit)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "label-policy",
+			Usage: "LABEL=ACTION, where ACTION is keyword (the default), ignore, or flag:X to set maildir flag X. LABEL may end in * to match a prefix (repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "strip-header",
+			Usage: "Header to remove from exported messages (repeatable; a trailing * matches a prefix)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "keep-header",
+			Usage: "If given, only keep these headers in exported messages (repeatable; a trailing * matches a prefix)",
+		},
+		&cli.BoolFlag{
+			Name:  "quiet",
+			Usage: "Print nothing but warnings and errors (e.g. for cron); a failed run also prints its API usage",
+		},
+		&cli.StringFlag{
+			Name:  "progress-format",
+			Value: "bar",
+			Usage: "How to show progress: bar, or json to print each update to stderr as a line of JSON",
+		},
+		&cli.StringFlag{
+			Name:  "event-log",
+			Usage: "Append a JSON-lines log of every API call and filesystem operation to this file",
+		},
+		&cli.StringFlag{
+			Name:  "label-log",
+			Usage: "Append a JSON-lines changelog of every message's label additions and removals to this file",
+		},
+		&cli.StringFlag{
+			Name:  "on-deliver",
+			Usage: "Command to run for each message written, with the message's path as its last argument (e.g. to index it for search)",
+		},
+		&cli.StringFlag{
+			Name:  "thread-index",
+			Usage: "Write a JSON index of thread ID to message keys to this file after syncing.",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-url",
+			Usage: "POST a JSON summary of the run (counts, duration, error) to this URL when done, retrying on failure",
+		},
+		&cli.StringFlag{
+			Name:  "checkpoint-file",
+			Usage: "Keep a JSON summary of sync progress (history ID, page token, counts) in this file, for monitoring",
+		},
 		&cli.IntFlag{
 			Name:  "buffer",
-			Usage: "Download buffer size",
-			Value: 128,
+			Usage: "Download buffer size; 0 to scale it with --parallel",
+			Value: 0,
 		},
 		&cli.IntFlag{
 			Name:  "parallel",
 			Usage: "Max parallel downloads",
 			Value: 8,
 		},
+		&cli.UintFlag{
+			Name:  "max-retries",
+			Usage: "Times to retry each rate-limited API call",
+			Value: 7,
+		},
+		&cli.DurationFlag{
+			Name:  "max-backoff",
+			Usage: "Longest wait between retries of an API call; the wait doubles from 1s up to this",
+			Value: time.Minute,
+		},
+		&cli.UintFlag{
+			Name:  "retry-budget",
+			Usage: "Max total API retries per run before giving up (0 for unlimited)",
+		},
+		&cli.IntFlag{
+			Name:  "fs-retries",
+			Usage: "Times to retry transient filesystem errors when writing messages",
+			Value: 3,
+		},
+		&cli.IntFlag{
+			Name:  "delete-parallel",
+			Usage: "Max parallel deletes",
+			Value: 8,
+		},
+		&cli.IntFlag{
+			Name:  "disk-parallel",
+			Usage: "Have full sync write new messages in parallel, at most this many at once (0 to write them one at a time)",
+		},
 	}
 	app.Action = func(ctx *cli.Context) error {
 		d := ctx.String("directory")
@@ -67,34 +350,424 @@ func main() {
 		} else if !s.IsDir() {
 			return fmt.Errorf("Error: %v exists and is not a directory\n", d)
 		}
-		g, err := gmail.NewGmail(d, ctx.String("label"), ctx.String("service-account-json-file"), ctx.String("to-impersonate"))
+		if f := ctx.String("diff-cache"); f != "" {
+			n, err := gmail.DiffCaches(gmail.CachePath(d), f, os.Stdout)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				// Like diff(1).
+				os.Exit(1)
+			}
+			return nil
+		}
+		if ctx.Bool("stats-only") {
+			return gmail.CacheLabelStats(gmail.CachePath(d), os.Stdout)
+		}
+		quiet := ctx.Bool("quiet")
+		progressFormat := ctx.String("progress-format")
+		if progressFormat != "bar" && progressFormat != "json" {
+			return fmt.Errorf("unknown --progress-format %q", progressFormat)
+		}
+		lib.Quiet = quiet
+		gmail.RetryBudget = ctx.Uint("retry-budget")
+		gmail.MaxRetries = ctx.Uint("max-retries")
+		gmail.MaxBackoff = ctx.Duration("max-backoff")
+		gmail.ConcurrentDownloads = ctx.Int("parallel")
+		gmail.ConcurrentDeletes = ctx.Int("delete-parallel")
+		gmail.ConcurrentDiskWrites = ctx.Int("disk-parallel")
+		var events *lib.EventLog
+		if f := ctx.String("event-log"); f != "" {
+			w, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+			events = lib.NewEventLog(w)
+		}
+		var labelLog *gmail.LabelLog
+		if f := ctx.String("label-log"); f != "" {
+			w, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+			labelLog = gmail.NewLabelLog(w)
+		}
+		var onDeliver func(id, path string)
+		if c := strings.Fields(ctx.String("on-deliver")); len(c) > 0 {
+			onDeliver = func(id, path string) {
+				if out, err := exec.Command(c[0], append(c[1:], path)...).CombinedOutput(); err != nil {
+					log.Printf("--on-deliver for %v failed: %v: %s", path, err, out)
+				}
+			}
+		}
+		// Progress goes to stderr when the archive goes to stdout.
+		out := os.Stdout
+		var store lib.Store
+		if f := ctx.String("tar"); f != "" {
+			var w io.Writer = os.Stdout
+			if f == "-" {
+				out = os.Stderr
+			} else {
+				fh, err := os.Create(f)
+				if err != nil {
+					return err
+				}
+				defer fh.Close()
+				w = fh
+			}
+			t := lib.NewTarStore(w)
+			defer t.Close()
+			store = t
+		}
+		closeStore := func() error { return nil }
+		switch ctx.String("format") {
+		case "maildir":
+		case "mbox":
+			if store != nil {
+				return fmt.Errorf("--format mbox can't be used with --tar")
+			} else if ctx.String("on-deliver") != "" {
+				return fmt.Errorf("--on-deliver can't be used with --format mbox")
+			}
+			p := path.Join(d, "outtake.mbox")
+			mb, err := mbox.Open(p)
+			if err != nil {
+				return err
+			}
+			// Compacts away deleted messages, so it must happen even when
+			// exiting early.
+			defer func() {
+				if err := mb.Close(); err != nil {
+					log.Println("could not compact", p, err)
+				}
+			}()
+			closeStore = mb.Close
+			store = mb
+		default:
+			return fmt.Errorf("unknown --format %q", ctx.String("format"))
+		}
+		var since time.Time
+		if s := ctx.String("since"); s != "" {
+			t, err := parseSince(s)
+			if err != nil {
+				return err
+			}
+			since = t
+		}
+		policy, err := gmail.ParseLabelPolicy(ctx.StringSlice("label-policy"))
 		if err != nil {
 			return err
 		}
-		gmail.MessageBufferSize = ctx.Int("buffer")
-		gmail.ConcurrentDownloads = ctx.Int("parallel")
+		flags := map[string]string{}
+		if ctx.Bool("flag-starred") {
+			flags["STARRED"] = "F"
+		}
+		if f := ctx.String("important-flag"); f != "" {
+			flags["IMPORTANT"] = f
+		}
+		g, err := gmail.NewGmail(d, gmail.Options{
+			Label:                  ctx.String("label"),
+			ExcludeLabels:          ctx.StringSlice("exclude-label"),
+			ServiceAccountJSONFile: ctx.String("service-account-json-file"),
+			ToImpersonate:          ctx.String("to-impersonate"),
+			OAuthClientFile:        ctx.String("oauth-client-file"),
+			OAuthClientID:          ctx.String("oauth-client-id"),
+			OAuthClientSecret:      ctx.String("oauth-client-secret"),
+			OAuthPort:              ctx.Int("oauth-port"),
+			UseADC:                 ctx.Bool("use-adc"),
+			CACertFile:             ctx.String("ca-cert"),
+			InsecureSkipVerify:     ctx.Bool("insecure-skip-verify"),
+			RecoverCache:           ctx.Bool("recover-cache"),
+			ThreadIndexFile:        ctx.String("thread-index"),
+			CheckpointFile:         ctx.String("checkpoint-file"),
+			MirrorDirs:             ctx.StringSlice("mirror"),
+			Drafts:                 ctx.Bool("drafts"),
+			ReadState:              ctx.Bool("read-state"),
+			MarkAllRead:            ctx.Bool("mark-all-read"),
+			LabelPolicy:            policy,
+			LabelFlags:             flags,
+			HistoryTypes:           ctx.StringSlice("history-types"),
+			MaxHistoryPages:        ctx.Int("max-history-pages"),
+			FetchFormat:            ctx.String("fetch-format"),
+			FetchBatch:             ctx.Int("fetch-batch"),
+			MessageBufferSize:      ctx.Int("buffer"),
+			FSRetries:              ctx.Int("fs-retries"),
+			Events:                 events,
+			LabelLog:               labelLog,
+			OnDeliver:              onDeliver,
+			OnlyNew:                ctx.Bool("only-new"),
+			KeepRecent:             time.Duration(ctx.Int("max-age")) * 24 * time.Hour,
+			ForceRedownload:        ctx.Bool("force-redownload"),
+			IncrementalOnly:        ctx.Bool("incremental-only"),
+			ThreadOrder:            ctx.Bool("thread-order"),
+			NewestFirst:            ctx.Bool("newest-first"),
+			DryRun:                 ctx.Bool("dry-run"),
+			Store:                  store,
+			Shards:                 ctx.Int("shards"),
+			MaildirSize:            ctx.Bool("maildirsize"),
+			TmpMaxAge:              ctx.Duration("tmp-max-age"),
+			Since:                  since,
+			Query:                  ctx.String("query"),
+			IncludeChats:           ctx.Bool("include-chats"),
+			Senders: gmail.SenderFilter{
+				Senders: ctx.StringSlice("from"),
+				Domains: ctx.StringSlice("from-domain"),
+			},
+			Headers: gmail.HeaderFilter{
+				Allow: ctx.StringSlice("keep-header"),
+				Deny:  ctx.StringSlice("strip-header"),
+			},
+		})
 		if err != nil {
 			return err
 		}
+		defer g.Close()
+		if ctx.Bool("check") {
+			return g.Check(ctx.Context, os.Stdout)
+		} else if ctx.Bool("whoami") {
+			return g.WhoAmI(ctx.Context, os.Stdout)
+		} else if ctx.Bool("verify") {
+			repair := ctx.Bool("repair")
+			n, err := g.Verify(ctx.Context, os.Stdout, ctx.Int("verify-sample"), repair)
+			if err != nil {
+				return err
+			}
+			if n > 0 && !repair {
+				// Like --diff-cache.
+				g.Close()
+				if err := closeStore(); err != nil {
+					log.Println(err)
+				}
+				os.Exit(1)
+			}
+			return closeStore()
+		}
 		progress := make(chan lib.Progress)
+		done := make(chan struct{})
 		go func() {
-			l := time.Time{}
-			for p := range progress {
-				if time.Since(l).Seconds() > progressUpdateFreqSecs {
-					l = time.Now()
-					fmt.Printf("\r%d / %d   %.2f%%  ", p.Current, p.Total, float32(p.Current)/float32(p.Total)*100)
-				}
+			defer close(done)
+			if progressFormat == "json" {
+				reportJSON(os.Stderr, progress)
+			} else {
+				report(out, quiet, progress)
 			}
-			fmt.Println()
 		}()
-		if err := g.Sync(ctx.Bool("full"), progress); err != nil {
-			fmt.Println(err)
+		var n uint
+		var size int64
+		op, start := "sync", time.Now()
+		if ctx.Bool("estimate") {
+			op = "estimate"
+			n, size, err = g.Estimate(ctx.Context, progress)
+		} else if ctx.Bool("refresh-metadata") {
+			op = "refresh-metadata"
+			err = g.RefreshMetadata(ctx.Context, progress)
+		} else if ctx.Bool("reconcile-deletes") {
+			op = "reconcile-deletes"
+			err = g.ReconcileDeletes(ctx.Context, progress)
+		} else {
+			err = g.Sync(ctx.Context, ctx.Bool("full"), progress)
+		}
+		// Each operation closes progress when done.
+		<-done
+		if ctx.Bool("estimate") && err == nil {
+			fmt.Fprintf(out, "%d messages, approximately %.1f MB\n", n, float64(size)/(1<<20))
+		} else if ctx.Bool("dry-run") && err == nil {
+			p := g.Planned()
+			fmt.Fprintf(out, "Dry run: would add %d, delete %d and relabel %d messages.\n", p.Adds, p.Deletes, p.Relabels)
+		}
+		if f := ctx.String("stats"); f != "" && err == nil {
+			err = writeStats(g, f, out)
+		}
+		if err != nil && ctx.Context.Err() != nil {
+			// Syncs record how far they got before returning.
+			err = errors.New("Interrupted; saved progress, run again to resume.")
+		}
+		calls, units := g.Usage()
+		if u := ctx.String("webhook-url"); u != "" {
+			s := runSummary{Operation: op, Success: err == nil, Calls: calls, Units: units, Duration: time.Since(start).Seconds()}
+			s.Added, s.Deleted = g.Counts()
+			if err != nil {
+				s.Error = err.Error()
+			}
+			if err := postSummary(u, s); err != nil {
+				log.Println("could not post run summary to", u, err)
+			}
+		}
+		if !summarize(out, os.Stderr, quiet, calls, units, err) {
+			// os.Exit skips deferred calls.
+			g.Close()
+			if err := closeStore(); err != nil {
+				log.Println(err)
+			}
+			if errors.Is(err, gmail.ErrFullSyncNeeded) {
+				// Distinct, so wrappers can schedule the full sync.
+				os.Exit(2)
+			}
 			os.Exit(-1)
 		}
-		return nil
+		// Deletions only take effect in an mbox once it's compacted.
+		return closeStore()
 	}
-	if err := app.Run(os.Args); err != nil {
-		fmt.Println(err)
+	// Interrupting cancels in-flight requests and stops at the next safe
+	// point, saving progress. Interrupting again exits immediately.
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCtx.Done()
+		stop()
+		log.Println("Interrupted; stopping. Interrupt again to exit immediately.")
+	}()
+	if err := app.RunContext(sigCtx, os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(-1)
 	}
 }
+
+// parseSince parses the --since date: a day, as YYYY/MM/DD or YYYY-MM-DD,
+// meaning local midnight, or an RFC 3339 time.
+func parseSince(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, f := range []string{"2006/01/02", "2006-01-02"} {
+		if t, err := time.ParseInLocation(f, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q: expected a date such as 2024/03/05, or an RFC 3339 time such as 2024-03-05T09:00:00Z", s)
+}
+
+// runSummary is the JSON posted to --webhook-url at the end of a run.
+type runSummary struct {
+	// "sync", "estimate", "refresh-metadata" or "reconcile-deletes".
+	Operation string  `json:"operation"`
+	Success   bool    `json:"success"`
+	Error     string  `json:"error,omitempty"`
+	Added     uint    `json:"added"`
+	Deleted   uint    `json:"deleted"`
+	Calls     uint    `json:"api_calls"`
+	Units     uint    `json:"quota_units"`
+	Duration  float64 `json:"duration_seconds"`
+}
+
+var (
+	// Attempts at posting the run summary, and the wait before the first
+	// retry, which doubles each time; replaced in tests.
+	webhookAttempts   = 3
+	webhookRetryDelay = 2 * time.Second
+	webhookClient     = &http.Client{Timeout: 30 * time.Second}
+)
+
+// postSummary posts s as JSON to url, retrying failures. Any 2xx response
+// counts as delivered.
+func postSummary(url string, s runSummary) error {
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	d := webhookRetryDelay
+	for i := 1; ; i++ {
+		err = postJSON(url, bs)
+		if err == nil || i >= webhookAttempts {
+			return err
+		}
+		time.Sleep(d)
+		d *= 2
+	}
+}
+
+func postJSON(url string, bs []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+// writeStats writes g's per-label statistics to the file f, or to out if f is
+// "-".
+func writeStats(g *gmail.Gmail, f string, out io.Writer) error {
+	if f == "-" {
+		return g.LabelStats(out)
+	}
+	fh, err := os.Create(f)
+	if err != nil {
+		return err
+	}
+	if err := g.LabelStats(fh); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// report prints progress updates to out until progress is closed. With quiet,
+// it prints nothing but still drains progress.
+func report(out io.Writer, quiet bool, progress <-chan lib.Progress) {
+	if quiet {
+		for range progress {
+		}
+		return
+	}
+	l := time.Time{}
+	for p := range progress {
+		// The last update, sent when the operation completes, is always shown.
+		if p.Total > 0 && (time.Since(l).Seconds() > progressUpdateFreqSecs || p.Current == p.Total) {
+			l = time.Now()
+			fmt.Fprintf(out, "\r%d / %d   %.2f%%  ", p.Current, p.Total, float32(p.Current)/float32(p.Total)*100)
+			if p.AccountTotal > 0 {
+				fmt.Fprintf(out, "(of ~%d total messages)  ", p.AccountTotal)
+			}
+		}
+	}
+	fmt.Fprintln(out)
+}
+
+// jsonProgress is a progress update as printed by reportJSON.
+type jsonProgress struct {
+	Current      uint   `json:"current"`
+	Total        uint   `json:"total"`
+	AccountTotal uint   `json:"account_total,omitempty"`
+	Phase        string `json:"phase"`
+	Added        uint   `json:"added"`
+	Deleted      uint   `json:"deleted"`
+}
+
+// reportJSON prints each progress update to out as a line of JSON until
+// progress is closed. Unlike report, it prints every update, for programs to
+// consume.
+func reportJSON(out io.Writer, progress <-chan lib.Progress) {
+	enc := json.NewEncoder(out)
+	for p := range progress {
+		enc.Encode(jsonProgress{
+			Current:      p.Current,
+			Total:        p.Total,
+			AccountTotal: p.AccountTotal,
+			Phase:        p.Phase,
+			Added:        p.Added,
+			Deleted:      p.Deleted,
+		})
+	}
+}
+
+// summarize prints the run's API usage and err, if any, returning whether the
+// run succeeded. Errors go to errOut. With quiet, a successful run prints
+// nothing, and a failed one prints its usage to errOut alongside the error.
+func summarize(out, errOut io.Writer, quiet bool, calls, units uint, err error) bool {
+	if quiet {
+		if err == nil {
+			return true
+		}
+		out = errOut
+	}
+	fmt.Fprintf(out, "Made %d API calls, using approximately %d quota units.\n", calls, units)
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return false
+	}
+	return true
+}
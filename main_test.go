@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/danmarg/outtake/lib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietCleanRun(t *testing.T) {
+	var out, errOut bytes.Buffer
+	progress := make(chan lib.Progress)
+	go func() {
+		defer close(progress)
+		for i := uint(1); i <= 3; i++ {
+			progress <- lib.Progress{Current: i, Total: 3}
+		}
+	}()
+	report(&out, true, progress)
+	if !summarize(&out, &errOut, true, 10, 50, nil) {
+		t.Errorf("summarize() = false, expected true")
+	}
+	if out.Len() > 0 || errOut.Len() > 0 {
+		t.Errorf("quiet clean run printed %q to stdout and %q to stderr, expected nothing", out.String(), errOut.String())
+	}
+}
+
+func TestQuietFailedRun(t *testing.T) {
+	var out, errOut bytes.Buffer
+	if summarize(&out, &errOut, true, 10, 50, errors.New("boom")) {
+		t.Errorf("summarize() = true, expected false")
+	}
+	if out.Len() > 0 {
+		t.Errorf("quiet failed run printed %q to stdout, expected nothing", out.String())
+	}
+	if e := errOut.String(); !strings.Contains(e, "Made 10 API calls") || !strings.Contains(e, "boom") {
+		t.Errorf("quiet failed run printed %q to stderr, expected usage and error", e)
+	}
+}
+
+func TestReport(t *testing.T) {
+	var out bytes.Buffer
+	progress := make(chan lib.Progress, 1)
+	progress <- lib.Progress{Current: 3, Total: 3}
+	close(progress)
+	report(&out, false, progress)
+	if !strings.Contains(out.String(), "3 / 3") {
+		t.Errorf("report() printed %q, expected final progress", out.String())
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	var out bytes.Buffer
+	progress := make(chan lib.Progress, 2)
+	progress <- lib.Progress{Current: 1, Total: 3, Phase: "full", Added: 1}
+	progress <- lib.Progress{Current: 3, Total: 3, Phase: "full", Added: 2, Deleted: 1}
+	close(progress)
+	reportJSON(&out, progress)
+	want := `{"current":1,"total":3,"phase":"full","added":1,"deleted":0}
+{"current":3,"total":3,"phase":"full","added":2,"deleted":1}
+`
+	if out.String() != want {
+		t.Errorf("reportJSON() printed %q, expected %q", out.String(), want)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	for _, x := range []struct {
+		s    string
+		want time.Time
+	}{
+		{"2024/03/05", time.Date(2024, 3, 5, 0, 0, 0, 0, time.Local)},
+		{"2024-03-05", time.Date(2024, 3, 5, 0, 0, 0, 0, time.Local)},
+		{"2024-03-05T09:30:00Z", time.Date(2024, 3, 5, 9, 30, 0, 0, time.UTC)},
+	} {
+		if got, err := parseSince(x.s); err != nil || !got.Equal(x.want) {
+			t.Errorf(`parseSince(%q) = %v, %v, expected %v`, x.s, got, err, x.want)
+		}
+	}
+	for _, s := range []string{"yesterday", "2024/13/01", "05/03/2024"} {
+		if _, err := parseSince(s); err == nil || !strings.Contains(err.Error(), "--since") {
+			t.Errorf(`parseSince(%q) = %v, expected an error naming --since`, s, err)
+		}
+	}
+}
+
+func TestPostSummary(t *testing.T) {
+	defer func(d time.Duration) { webhookRetryDelay = d }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+	posts := []runSummary{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		s := runSummary{}
+		if err := json.Unmarshal(bs, &s); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf(`webhook got %q (%v), expected a JSON summary`, string(bs), err)
+		}
+		posts = append(posts, s)
+		// The first attempt fails.
+		if len(posts) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	want := runSummary{Operation: "sync", Success: false, Error: "boom", Added: 3, Deleted: 1, Calls: 10, Units: 50, Duration: 1.5}
+	if err := postSummary(srv.URL, want); err != nil {
+		t.Fatalf(`postSummary() = %v, expected nil after a retry`, err)
+	}
+	if len(posts) != 2 || posts[1] != want {
+		t.Errorf(`webhook got %+v, expected %+v twice`, posts, want)
+	}
+	// Attempts are limited.
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	})
+	if err := postSummary(srv.URL, want); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf(`postSummary() = %v, expected the 500 after %v attempts`, err, webhookAttempts)
+	}
+}